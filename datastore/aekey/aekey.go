@@ -0,0 +1,55 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build appengine
+
+package aekey
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	aedatastore "google.golang.org/appengine/datastore"
+	"google.golang.org/cloud/datastore"
+)
+
+// FromAppEngine returns the Cloud Datastore key equivalent to the App Engine
+// key k, including its ancestors and namespace. The key's app ID is dropped,
+// since a Cloud Datastore key's project is given by the Client that uses it.
+// It returns nil if k is nil.
+func FromAppEngine(ctx context.Context, k *aedatastore.Key) *datastore.Key {
+	if k == nil {
+		return nil
+	}
+	parent := FromAppEngine(ctx, k.Parent())
+	ctx = datastore.WithNamespace(ctx, k.Namespace())
+	return datastore.NewKey(ctx, k.Kind(), k.StringID(), k.IntID(), parent)
+}
+
+// ToAppEngine returns the App Engine key equivalent to the Cloud Datastore
+// key k, including its ancestors and namespace. c must be an App Engine
+// context, which determines the key's app ID. It returns nil if k is nil.
+func ToAppEngine(c context.Context, k *datastore.Key) (*aedatastore.Key, error) {
+	if k == nil {
+		return nil, nil
+	}
+	parent, err := ToAppEngine(c, k.Parent())
+	if err != nil {
+		return nil, err
+	}
+	c, err = appengine.Namespace(c, k.Namespace())
+	if err != nil {
+		return nil, err
+	}
+	return aedatastore.NewKey(c, k.Kind(), k.Name(), k.ID(), parent), nil
+}
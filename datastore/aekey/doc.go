@@ -0,0 +1,23 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package aekey converts between the keys of the App Engine datastore
+// package, google.golang.org/appengine/datastore, and the keys of the
+// google.golang.org/cloud/datastore package. It eases migrating an App Engine
+// application to the Cloud Datastore client one part at a time.
+//
+// The conversion functions are only built with the appengine build tag, which
+// the App Engine SDK sets, so that neither datastore package depends on the
+// other.
+package aekey // import "google.golang.org/cloud/datastore/aekey"
@@ -21,11 +21,16 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"regexp"
+	"sort"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
 	"google.golang.org/cloud"
 	pb "google.golang.org/cloud/internal/datastore"
+	"google.golang.org/cloud/internal/opts"
 	"google.golang.org/cloud/internal/transport"
 )
 
@@ -49,41 +54,132 @@ type protoClient interface {
 }
 
 // Client is a client for reading and writing data in a datastore dataset.
+//
+// A Client is not bound to a namespace. The same Client, and its underlying
+// transport, can be shared across namespaces by scoping each call's context
+// with WithNamespace, or by binding a copy of it to a namespace with
+// InNamespace.
+//
+// NewClient creates the underlying transport once, and every call made
+// through the Client reuses it. A Client is safe for concurrent use by
+// multiple goroutines, and should be created once and reused rather than
+// created per operation.
 type Client struct {
 	client   protoClient
 	endpoint string
-	dataset  string // Called dataset by the datastore API, synonym for project ID.
+	dataset  string       // Called dataset by the datastore API, synonym for project ID.
+	limiter  *rateLimiter // nil if calls are not rate limited.
+	// namespace is the default namespace set by InNamespace.
+	namespace string
+	// retryable is set by RetryPredicate, or nil for the default.
+	retryable func(error) bool
+	// maxProps is set by MaxEntityProperties, or 0 for no limit.
+	maxProps int
+	// autoNoIndex is set by AutoNoIndex.
+	autoNoIndex bool
+	// defaultNoIndex is set by DefaultNoIndex.
+	defaultNoIndex bool
+	// indexFunc is set by IndexFunc, or nil to index all the
+	// properties not marked unindexed.
+	indexFunc func(string) bool
+	// naming is set by FieldNameTransform and UseJSONTags, or nil to name
+	// the fields of structs after their datastore tags or themselves.
+	naming *fieldNaming
+	// closed is set to 1 by Close. It is shared with the copies made by
+	// InNamespace.
+	closed *int32
 }
 
-// NewClient creates a new Client for a given dataset.
-func NewClient(ctx context.Context, projectID string, opts ...cloud.ClientOption) (*Client, error) {
+// validProjectID matches the project IDs accepted by the datastore. It allows
+// an optional domain prefix, as in "example.com:my-project", and an optional
+// partition prefix, as in "s~my-project".
+var validProjectID = regexp.MustCompile(`^(?:[a-z]~)?(?:[a-z0-9][a-z0-9.-]*:)?[a-z0-9][a-z0-9-]*$`)
+
+// checkProjectID returns an error if id is not a valid project ID.
+func checkProjectID(id string) error {
+	if id == "" {
+		return errors.New("datastore: missing project ID")
+	}
+	if len(id) > 100 || !validProjectID.MatchString(id) {
+		return fmt.Errorf("datastore: invalid project ID %q", id)
+	}
+	return nil
+}
+
+// NewClient creates a new Client for a given dataset. It returns an error
+// without contacting the datastore if projectID is empty or malformed.
+//
+// The Client reads and writes the entities of projectID, and its usage is
+// billed to projectID unless the cloud.WithQuotaProject option names another
+// project to bill.
+//
+// If the cloud.WithRateLimit option is given, the Client limits the rate of
+// its calls to the datastore. Calls over the limit that fail fast return
+// ErrRateLimited.
+//
+// The datastore ClientOption values, such as FieldNameTransform, may be given
+// along with the cloud.ClientOption values; they configure only the Client
+// that NewClient returns.
+//
+// Tests can point the Client at a stub server, such as an httptest.Server,
+// with the cloud.WithEndpoint and cloud.WithBaseHTTP options. No credentials
+// are needed when the base HTTP client is given.
+func NewClient(ctx context.Context, projectID string, opt ...cloud.ClientOption) (*Client, error) {
+	if err := checkProjectID(projectID); err != nil {
+		return nil, err
+	}
 	o := []cloud.ClientOption{
 		cloud.WithEndpoint(prodAddr),
 		cloud.WithScopes(ScopeDatastore, ScopeUserEmail),
 		cloud.WithUserAgent(userAgent),
 	}
-	o = append(o, opts...)
+	o = append(o, opt...)
 	client, err := transport.NewProtoClient(ctx, o...)
 	if err != nil {
 		return nil, fmt.Errorf("dialing: %v", err)
 	}
-	return &Client{
+	var do opts.DialOpt
+	for _, opt := range o {
+		opt.Resolve(&do)
+	}
+	c := &Client{
 		client:  client,
 		dataset: projectID,
-	}, nil
-
+		limiter: newRateLimiter(do.RateLimit, do.RateBurst, do.RateLimitFailFast),
+		closed:  new(int32),
+	}
+	for _, opt := range opt {
+		if o, ok := opt.(ClientOption); ok {
+			o.applyClient(c)
+		}
+	}
+	return c, nil
 }
 
 var (
 	// ErrInvalidEntityType is returned when functions like Get or Next are
 	// passed a dst or src argument of invalid type.
 	ErrInvalidEntityType = errors.New("datastore: invalid entity type")
-	// ErrInvalidKey is returned when an invalid key is presented.
+	// ErrInvalidKey is returned when an invalid key is presented to Get,
+	// GetMulti, Put or PutMulti, in a MultiError for the multi versions. The
+	// other functions return an *InvalidKeyError, which matches ErrInvalidKey
+	// with errors.Is but not with ==.
 	ErrInvalidKey = errors.New("datastore: invalid key")
 	// ErrNoSuchEntity is returned when no entity was found for a given key.
 	ErrNoSuchEntity = errors.New("datastore: no such entity")
+	// ErrClientClosed is returned by calls made with a Client after its
+	// Close method has been called.
+	ErrClientClosed = errors.New("datastore: client is closed")
 )
 
+// maxMutations is the maximum number of mutations the datastore accepts in a
+// single commit.
+const maxMutations = 500
+
+// maxLookupKeys is the maximum number of keys the datastore accepts in a
+// single lookup.
+const maxLookupKeys = 1000
+
 type multiArgType int
 
 const (
@@ -100,10 +196,83 @@ type nsKey struct{}
 
 // WithNamespace returns a new context that limits the scope its parent
 // context with a Datastore namespace.
+//
+// Keys created with the returned context belong to namespace, and queries run
+// with it are restricted to namespace. It is cheap to call, so multi-tenant
+// applications can derive a context per tenant and use a single Client.
+//
+// An empty namespace names the default namespace explicitly: queries run
+// with WithNamespace(ctx, "") are restricted to the default namespace even by
+// a Client whose default namespace, set by InNamespace, is another one. A
+// context without a namespace inherits the Client's default namespace.
 func WithNamespace(parent context.Context, namespace string) context.Context {
 	return context.WithValue(parent, nsKey{}, namespace)
 }
 
+// InNamespace returns a copy of c, sharing its transport, whose default
+// namespace is namespace. The copy runs queries in namespace unless their
+// context names a namespace with WithNamespace, and its Get, Put and Delete
+// methods, and those of its transactions, use keys in the default namespace
+// as if they were in namespace. Keys in any other namespace are used as is.
+// Keys returned by the copy are in namespace.
+//
+// Binding a Client to the namespace of a tenant once, at the start of a
+// request, avoids passing the namespace to every call.
+//
+// The namespace of a query run in the context of a WithNamespace call takes
+// precedence over the Client's, even if it is the default namespace. Such a
+// query's ancestor key is used as is. Since keys in the default namespace are
+// bound to the Client's, use the Client the copy was made from, or
+// InNamespace(""), to get, put or delete entities in the default namespace.
+func (c *Client) InNamespace(namespace string) *Client {
+	nc := *c
+	nc.namespace = namespace
+	return &nc
+}
+
+// namespaced returns ctx scoped to the Client's default namespace, unless ctx
+// names a namespace of its own, including the default namespace.
+func (c *Client) namespaced(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(nsKey{}).(string); ok || c.namespace == "" {
+		return ctx
+	}
+	return WithNamespace(ctx, c.namespace)
+}
+
+// bindKeys returns keys with each of its keys in the default namespace
+// replaced by the same key in the Client's default namespace.
+func (c *Client) bindKeys(keys []*Key) []*Key {
+	if c.namespace == "" {
+		return keys
+	}
+	ret := make([]*Key, len(keys))
+	for i, k := range keys {
+		ret[i] = c.bindKey(k)
+	}
+	return ret
+}
+
+// bindAncestor returns the ancestor key of a query run with ctx, a context
+// returned by namespaced: it is bound to the Client's default namespace if the
+// query is run in that namespace.
+func (c *Client) bindAncestor(ctx context.Context, k *Key) *Key {
+	if ctxNamespace(ctx) != c.namespace {
+		return k
+	}
+	return c.bindKey(k)
+}
+
+// bindKey is the single key version of bindKeys.
+func (c *Client) bindKey(k *Key) *Key {
+	if k == nil || k.namespace != "" || c.namespace == "" {
+		return k
+	}
+	nk := *k
+	nk.namespace = c.namespace
+	nk.parent = c.bindKey(k.parent)
+	return &nk
+}
+
 // ctxNamespace returns the active namespace for a context.
 // It defaults to "" if no namespace was specified.
 func ctxNamespace(ctx context.Context) string {
@@ -127,7 +296,34 @@ func (e *ErrFieldMismatch) Error() string {
 		e.FieldName, e.StructType, e.Reason)
 }
 
+// Close closes the Client. Calls made afterwards with it, or with a Client
+// returned by its InNamespace method, fail with ErrClientClosed, so an
+// iterator, including its prefetching, stops at its next fetch. Its idle
+// connections are closed. A Client holds no unsent writes, so there is
+// nothing to flush, but transactions begun with it can no longer be committed
+// or rolled back: finish them before calling Close.
+//
+// Close is safe to call more than once; it always returns nil.
+func (c *Client) Close() error {
+	if c.closed == nil {
+		c.closed = new(int32)
+	}
+	atomic.StoreInt32(c.closed, 1)
+	if cc, ok := c.client.(interface {
+		CloseIdleConnections()
+	}); ok {
+		cc.CloseIdleConnections()
+	}
+	return nil
+}
+
 func (c *Client) call(ctx context.Context, method string, req, resp proto.Message) error {
+	if c.closed != nil && atomic.LoadInt32(c.closed) != 0 {
+		return ErrClientClosed
+	}
+	if err := c.limiter.wait(ctx); err != nil {
+		return err
+	}
 	return c.client.Call(ctx, c.dataset+"/"+method, req, resp)
 }
 
@@ -258,16 +454,37 @@ func checkMultiArg(v reflect.Value) (m multiArgType, elemType reflect.Type) {
 // or implement PropertyLoadSaver. If there is no such entity for the key, Get
 // returns ErrNoSuchEntity.
 //
+// Get is the single-key form of GetMulti: it takes a plain struct pointer
+// rather than a slice, and returns the key's error directly rather than as a
+// MultiError:
+//
+//	var g Gopher
+//	if err := client.Get(ctx, key, &g); err == datastore.ErrNoSuchEntity {
+//		// key was not found.
+//	}
+//
 // The values of dst's unmatched struct fields are not modified, and matching
 // slice-typed fields are not reset before appending to them. In particular, it
 // is recommended to pass a pointer to a zero valued struct on each Get call.
 //
+// A bool, integer, float or string field tagged with a "default" option, as
+// in `datastore:"Score,default=42"`, is instead set to its default when the
+// entity has no property for it, such as an entity saved before the field
+// was added. The default may not contain a comma. A property with a nil value
+// is loaded as usual rather than replaced by the default.
+//
 // ErrFieldMismatch is returned when a field is to be loaded into a different
 // type than the one it was stored from, or when a field is missing or
 // unexported in the destination struct. ErrFieldMismatch is only returned if
 // dst is a struct pointer.
-func (c *Client) Get(ctx context.Context, key *Key, dst interface{}) error {
-	err := c.get(ctx, []*Key{key}, []interface{}{dst}, nil)
+//
+// By default, Get performs a strongly consistent read. Pass
+// EventualConsistency to read a possibly stale value with lower latency. To
+// read within a transaction, use Transaction's Get method instead.
+//
+// Pass LoadProperties to load only some of the entity's properties.
+func (c *Client) Get(ctx context.Context, key *Key, dst interface{}, opts ...ReadOption) error {
+	err := c.get(ctx, []*Key{key}, []interface{}{dst}, lookupOpts(opts))
 	if me, ok := err.(MultiError); ok {
 		return me[0]
 	}
@@ -281,15 +498,215 @@ func (c *Client) Get(ctx context.Context, key *Key, dst interface{}) error {
 // implements PropertyLoadSaver. If an []I, each element must be a valid dst
 // for Get: it must be a struct pointer or implement PropertyLoadSaver.
 //
+// A []S or []P is loaded in place, each entity into the element at its key's
+// index, so there is no need to build a slice of pointers to its elements:
+//
+//	gophers := make([]Gopher, len(keys))
+//	err := client.GetMulti(ctx, keys, gophers)
+//
 // As a special case, PropertyList is an invalid type for dst, even though a
 // PropertyList is a slice of structs. It is treated as invalid to avoid being
 // mistakenly passed when []PropertyList was intended.
-func (c *Client) GetMulti(ctx context.Context, keys []*Key, dst interface{}) error {
-	return c.get(ctx, keys, dst, nil)
+//
+// Keys whose lookup the datastore defers are looked up again, so each key is
+// either found or reported missing. GetMulti fails if a lookup defers all of
+// its keys.
+//
+// If any of the keys are not found, GetMulti returns a MultiError aligned with
+// keys in which the missing keys have ErrNoSuchEntity and the found keys have
+// a nil error (or the error encountered while loading them). The MultiError
+// can therefore be used to tell which of the keys were found:
+//
+//	err := client.GetMulti(ctx, keys, dst)
+//	if me, ok := err.(datastore.MultiError); ok {
+//		for i, err := range me {
+//			if err == datastore.ErrNoSuchEntity {
+//				// keys[i] was not found.
+//			}
+//		}
+//	}
+//
+// Alternatively, dst may be a *[]*S. GetMulti then allocates an *S for each
+// key that is found and appends it to *dst, in the order of keys, skipping
+// the keys that are not found. *dst is therefore not aligned with keys, and
+// missing keys are not reported. Any other errors are returned as a
+// MultiError aligned with keys.
+func (c *Client) GetMulti(ctx context.Context, keys []*Key, dst interface{}, opts ...ReadOption) error {
+	return c.get(ctx, keys, dst, lookupOpts(opts))
 }
 
-func (c *Client) get(ctx context.Context, keys []*Key, dst interface{}, opts *pb.ReadOptions) error {
+// Exists reports which of keys have an entity, without loading the entities.
+// The returned slice is aligned with keys. Any number of keys may be given:
+// they are looked up in chunks of up to 1000 keys, and the keys whose lookup
+// the datastore defers are looked up again, unless it defers all the keys of a
+// chunk, which makes Exists fail. A chunk whose lookup fails with a
+// transient error is retried as Import retries its chunks. An invalid or
+// incomplete key makes Exists fail with an *InvalidKeyError.
+//
+// Exists is not cheaper than Get for the datastore: the v1beta2 API has no
+// keys-only lookup, so each lookup reads the entities and sends them in
+// full, and is billed as a Get of the same keys would be. Exists only saves
+// the client the cost of decoding them into Go values.
+func (c *Client) Exists(ctx context.Context, keys []*Key) ([]bool, error) {
+	keys = c.bindKeys(keys)
+	ret := make([]bool, len(keys))
+	// indexes maps each distinct key to its positions in keys.
+	indexes := make(map[string][]int)
+	var pbKeys []*pb.Key
+	for i, k := range keys {
+		if err := k.check(true); err != nil {
+			return nil, err
+		}
+		s := k.String()
+		if _, ok := indexes[s]; !ok {
+			pbKeys = append(pbKeys, keyToProto(k))
+		}
+		indexes[s] = append(indexes[s], i)
+	}
+	for len(pbKeys) > 0 {
+		n := len(pbKeys)
+		if n > maxLookupKeys {
+			n = maxLookupKeys
+		}
+		req, resp := &pb.LookupRequest{Key: pbKeys[:n]}, &pb.LookupResponse{}
+		err := retryChunk(ctx, func() error {
+			resp.Reset()
+			return c.call(ctx, "lookup", req, resp)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if n != len(resp.Found)+len(resp.Missing)+len(resp.Deferred) {
+			return nil, errors.New("datastore: internal error: server returned the wrong number of entities")
+		}
+		if len(resp.Deferred) == n {
+			return nil, errors.New("datastore: some entities temporarily unavailable")
+		}
+		for _, e := range resp.Found {
+			for _, i := range indexes[protoToKey(e.Entity.Key).String()] {
+				ret[i] = true
+			}
+		}
+		pbKeys = append(resp.Deferred, pbKeys[n:]...)
+	}
+	return ret, nil
+}
+
+// A ReadOption configures a non-transactional read made by Get or GetMulti.
+type ReadOption interface {
+	apply(*lookupOptions)
+}
+
+// lookupOptions holds the options of a lookup.
+type lookupOptions struct {
+	// readOptions are sent with the lookup request. They may be nil.
+	readOptions *pb.ReadOptions
+	// properties, if non-nil, holds the names of the only properties to load.
+	properties map[string]bool
+	// err, if non-nil, is returned instead of making the lookup.
+	err error
+}
+
+type readConsistency struct {
+	level pb.ReadOptions_ReadConsistency
+}
+
+func (r readConsistency) apply(opts *lookupOptions) {
+	if opts.readOptions == nil {
+		opts.readOptions = &pb.ReadOptions{}
+	}
+	opts.readOptions.ReadConsistency = r.level.Enum()
+}
+
+var (
+	// StrongConsistency causes a read to return the latest committed value.
+	// It is the default for lookups by key.
+	StrongConsistency ReadOption = readConsistency{pb.ReadOptions_STRONG}
+	// EventualConsistency causes a read to return a possibly stale value.
+	EventualConsistency ReadOption = readConsistency{pb.ReadOptions_EVENTUAL}
+)
+
+// LoadProperties returns a ReadOption that loads only the named properties
+// of each entity read, leaving the other fields of dst unmodified. The names
+// are those of the stored properties, so a field of a nested struct is named
+// as in "Address.City".
+//
+// The datastore does not support partial lookups: entire entities are still
+// fetched, and the other properties are discarded before loading. This saves
+// decoding work in dst, but not latency or bandwidth. Use a projection query
+// to fetch only some properties from the datastore.
+func LoadProperties(names ...string) ReadOption {
+	return loadProperties(names)
+}
+
+type loadProperties []string
+
+func (l loadProperties) apply(opts *lookupOptions) {
+	if opts.properties == nil {
+		opts.properties = make(map[string]bool)
+	}
+	for _, name := range l {
+		opts.properties[name] = true
+	}
+}
+
+// errReadTime is returned by reads as of a past time.
+var errReadTime = errors.New("datastore: reads as of a past time are not supported by the datastore API version used by this package")
+
+// ReadTime returns a ReadOption that reads the entities as they were at time
+// t. The datastore API used by this package has no read time in its read
+// options, so a read made with ReadTime fails with an error rather than
+// returning the latest entities. Get a consistent snapshot of several
+// entities by reading them in a transaction instead.
+func ReadTime(t time.Time) ReadOption {
+	return readTime(t)
+}
+
+type readTime time.Time
+
+func (readTime) apply(opts *lookupOptions) {
+	opts.err = errReadTime
+}
+
+// lookupOpts returns the lookupOptions for opts, or nil if opts is empty.
+func lookupOpts(opts []ReadOption) *lookupOptions {
+	if len(opts) == 0 {
+		return nil
+	}
+	lo := &lookupOptions{}
+	for _, o := range opts {
+		o.apply(lo)
+	}
+	return lo
+}
+
+// trim removes the properties that are not to be loaded from e.
+func (o *lookupOptions) trim(e *pb.Entity) {
+	if o == nil || o.properties == nil {
+		return
+	}
+	props := e.Property[:0]
+	for _, p := range e.Property {
+		if o.properties[p.GetName()] {
+			props = append(props, p)
+		}
+	}
+	e.Property = props
+}
+
+func (c *Client) get(ctx context.Context, keys []*Key, dst interface{}, opts *lookupOptions) error {
+	if opts != nil && opts.err != nil {
+		return opts.err
+	}
+	keys = c.bindKeys(keys)
 	v := reflect.ValueOf(dst)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		if mat, _ := checkMultiArg(v.Elem()); mat == multiArgTypeStructPtr {
+			return getAppend(keys, v.Elem(), func(dst interface{}) error {
+				return c.get(ctx, keys, dst, opts)
+			})
+		}
+	}
 	multiArgType, _ := checkMultiArg(v)
 
 	// Sanity checks
@@ -319,38 +736,43 @@ func (c *Client) get(ctx context.Context, keys []*Key, dst interface{}, opts *pb
 	if any {
 		return multiErr
 	}
-	req := &pb.LookupRequest{
-		Key:         pbKeys,
-		ReadOptions: opts,
-	}
-	resp := &pb.LookupResponse{}
-	if err := c.call(ctx, "lookup", req, resp); err != nil {
-		return err
-	}
-	if len(resp.Deferred) > 0 {
-		// TODO(jbd): Assess whether we should retry the deferred keys.
-		return errors.New("datastore: some entities temporarily unavailable")
-	}
-	if len(keys) != len(resp.Found)+len(resp.Missing) {
-		return errors.New("datastore: internal error: server returned the wrong number of entities")
-	}
-	for _, e := range resp.Found {
-		k := protoToKey(e.Entity.Key)
-		index := keyMap[k.String()]
-		elem := v.Index(index)
-		if multiArgType == multiArgTypePropertyLoadSaver || multiArgType == multiArgTypeStruct {
-			elem = elem.Addr()
+	// Keys deferred by the datastore, as it does when a lookup would use too
+	// many resources, are looked up again until each key is found or missing.
+	for len(pbKeys) > 0 {
+		req := &pb.LookupRequest{Key: pbKeys}
+		if opts != nil {
+			req.ReadOptions = opts.readOptions
 		}
-		err := loadEntity(elem.Interface(), e.Entity)
-		if err != nil {
-			multiErr[index] = err
+		resp := &pb.LookupResponse{}
+		if err := c.call(ctx, "lookup", req, resp); err != nil {
+			return err
+		}
+		if len(pbKeys) != len(resp.Found)+len(resp.Missing)+len(resp.Deferred) {
+			return errors.New("datastore: internal error: server returned the wrong number of entities")
+		}
+		if len(resp.Deferred) == len(pbKeys) {
+			return errors.New("datastore: some entities temporarily unavailable")
+		}
+		for _, e := range resp.Found {
+			k := protoToKey(e.Entity.Key)
+			index := keyMap[k.String()]
+			elem := v.Index(index)
+			if multiArgType == multiArgTypePropertyLoadSaver || multiArgType == multiArgTypeStruct {
+				elem = elem.Addr()
+			}
+			opts.trim(e.Entity)
+			err := c.loadEntity(elem.Interface(), e.Entity)
+			if err != nil {
+				multiErr[index] = err
+				any = true
+			}
+		}
+		for _, e := range resp.Missing {
+			k := protoToKey(e.Entity.Key)
+			multiErr[keyMap[k.String()]] = ErrNoSuchEntity
 			any = true
 		}
-	}
-	for _, e := range resp.Missing {
-		k := protoToKey(e.Entity.Key)
-		multiErr[keyMap[k.String()]] = ErrNoSuchEntity
-		any = true
+		pbKeys = resp.Deferred
 	}
 	if any {
 		return multiErr
@@ -358,10 +780,80 @@ func (c *Client) get(ctx context.Context, keys []*Key, dst interface{}, opts *pb
 	return nil
 }
 
+// getAppend implements GetMulti for a dst of type *[]*S. It allocates an *S
+// for each key, loads them with get, which is passed a []*S aligned with keys,
+// and appends those of the found keys to sv, in key order.
+func getAppend(keys []*Key, sv reflect.Value, get func(dst interface{}) error) error {
+	elemType := sv.Type().Elem().Elem()
+	tmp := reflect.MakeSlice(sv.Type(), len(keys), len(keys))
+	for i := range keys {
+		tmp.Index(i).Set(reflect.New(elemType))
+	}
+	err := get(tmp.Interface())
+	me, ok := err.(MultiError)
+	if err != nil && !ok {
+		return err
+	}
+	var errs MultiError
+	for i := range keys {
+		if me != nil {
+			if me[i] == ErrNoSuchEntity {
+				continue
+			}
+			if me[i] != nil {
+				if errs == nil {
+					errs = make(MultiError, len(keys))
+				}
+				errs[i] = me[i]
+			}
+		}
+		sv.Set(reflect.Append(sv, tmp.Index(i)))
+	}
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
 // Put saves the entity src into the datastore with key k. src must be a struct
-// pointer or implement PropertyLoadSaver; if a struct pointer then any
+// pointer, a struct value or implement PropertyLoadSaver; if a struct then any
 // unexported fields of that struct will be skipped. If k is an incomplete key,
-// the returned key will be a unique key generated by the datastore.
+// the returned key will be a unique key generated by the datastore. Put
+// returns an error if the datastore does not return a key for an incomplete
+// key, so callers that only use complete keys may ignore the returned key:
+//
+//	if _, err := client.Put(ctx, key, &g); err != nil {
+//		// Handle the error.
+//	}
+//
+// A time.Time field tagged with the "autonow" option, as in
+// `datastore:"UpdatedAt,autonow"`, is set to the current time each time its
+// struct is saved. A field tagged with "autoaddonly" is set only when the
+// struct is saved with an incomplete key, that is, when a new entity is
+// created. If src is a struct pointer, the fields are updated in place.
+//
+// A field tagged with the "required" option, as in
+// `datastore:"Email,required"`, must not be empty: saving fails, naming the
+// field's property, if it has its zero value, or is a slice without elements.
+//
+// A floating-point field, or slice of them, tagged with the "round=N" option,
+// as in `datastore:"Price,round=2"`, is saved rounded half away from zero to N
+// decimal places; the struct itself is not modified. Rounding is lossy: the
+// saved value is not the field's value, and loading it back does not restore
+// the digits that were dropped. Since floats are binary, the saved value is
+// the nearest float to the rounded decimal, so the option suits values that
+// are displayed, not exact amounts such as money, which are better stored as
+// integer counts of the smallest unit.
+//
+// A field tagged with the "index" option, as in `datastore:"Level,index"`, is
+// indexed even if the Client was created with DefaultNoIndex, which leaves
+// the other fields unindexed, or if it is in a struct field tagged noindex.
+// A field cannot be tagged with both index and noindex.
+//
+// Put, PutMulti, Delete and DeleteMulti on a Client are non-transactional
+// writes that are applied immediately. To write as part of a transaction, use
+// the methods of the same names on Transaction, whose writes are always
+// committed in transactional mode.
 func (c *Client) Put(ctx context.Context, key *Key, src interface{}) (*Key, error) {
 	k, err := c.PutMulti(ctx, []*Key{key}, []interface{}{src})
 	if err != nil {
@@ -376,8 +868,42 @@ func (c *Client) Put(ctx context.Context, key *Key, src interface{}) (*Key, erro
 // PutMulti is a batch version of Put.
 //
 // src must satisfy the same conditions as the dst argument to GetMulti.
+// At most 500 entities may be put in a single call.
+//
+// PutMulti returns one key for each of keys, in the same order: each complete
+// key as given, and each incomplete key completed with the ID allocated by the
+// datastore. Callers need not tell the two apart.
+//
+// The datastore does not report whether a put with a complete key created a
+// new entity or replaced an existing one. A put with an incomplete key always
+// creates a new entity.
+//
+// Once the entities are written, each element of src that implements
+// KeySetter has its SetKey method called with its complete key.
 func (c *Client) PutMulti(ctx context.Context, keys []*Key, src interface{}) ([]*Key, error) {
-	mutation, err := putMutation(keys, src)
+	res, err := c.PutMultiResult(ctx, keys, src)
+	if err != nil {
+		return nil, err
+	}
+	return res.Keys, nil
+}
+
+// PutResult is the result of PutMultiResult or ImportResult.
+type PutResult struct {
+	// Keys holds the keys of the entities, as returned by PutMulti or
+	// Import.
+	Keys []*Key
+	// IndexUpdates is the number of index updates reported by the datastore
+	// for the commit of the entities, summed over the chunks of an import.
+	// Bulk importers can log it to estimate the cost of their writes.
+	IndexUpdates int
+}
+
+// PutMultiResult is like PutMulti, but also returns the number of index
+// updates made by the commit.
+func (c *Client) PutMultiResult(ctx context.Context, keys []*Key, src interface{}) (*PutResult, error) {
+	keys = c.bindKeys(keys)
+	mutation, err := c.putMutation(keys, src)
 	if err != nil {
 		return nil, err
 	}
@@ -392,33 +918,266 @@ func (c *Client) PutMulti(ctx context.Context, keys []*Key, src interface{}) ([]
 		return nil, err
 	}
 
-	// Copy any newly minted keys into the returned keys.
-	newKeys := make(map[int]int) // Map of index in returned slice to index in response.
+	ret, err := completeKeys(keys, resp.GetMutationResult().GetInsertAutoIdKey())
+	if err != nil {
+		return nil, err
+	}
+	setKeys(ret, src)
+	return &PutResult{Keys: ret, IndexUpdates: int(resp.GetMutationResult().GetIndexUpdates())}, nil
+}
+
+// completeKeys returns keys with each incomplete key replaced by its key in
+// newKeys, the keys allocated by the datastore for the entities inserted
+// with an incomplete key. The commit response lists them in the order of the
+// insertAutoId mutations, which is that of the incomplete keys.
+func completeKeys(keys []*Key, newKeys []*pb.Key) ([]*Key, error) {
+	errCount := errors.New("datastore: internal error: server returned the wrong number of keys")
 	ret := make([]*Key, len(keys))
-	var idx int
+	n := 0
 	for i, key := range keys {
-		if key.Incomplete() {
-			// This key will be in the mutation result.
-			newKeys[i] = idx
-			idx++
-		} else {
+		if !key.Incomplete() {
 			ret[i] = key
+			continue
 		}
+		if n == len(newKeys) {
+			return nil, errCount
+		}
+		k := protoToKey(newKeys[n])
+		n++
+		if k.Incomplete() || k.Kind() != key.Kind() {
+			return nil, fmt.Errorf("datastore: internal error: server returned key %v for incomplete key %v", k, key)
+		}
+		ret[i] = k
 	}
-	if len(newKeys) != len(resp.MutationResult.InsertAutoIdKey) {
-		return nil, errors.New("datastore: internal error: server returned the wrong number of keys")
-	}
-	for retI, respI := range newKeys {
-		ret[retI] = protoToKey(resp.MutationResult.InsertAutoIdKey[respI])
+	if n != len(newKeys) {
+		return nil, errCount
 	}
 	return ret, nil
 }
 
-func putMutation(keys []*Key, src interface{}) (*pb.Mutation, error) {
+// setKeys calls SetKey with keys[i] on each element i of the slice src that
+// implements KeySetter.
+func setKeys(keys []*Key, src interface{}) {
+	v := reflect.ValueOf(src)
+	for i, k := range keys {
+		elem := v.Index(i)
+		if elem.Kind() == reflect.Struct && elem.CanAddr() {
+			elem = elem.Addr()
+		}
+		if ks, ok := elem.Interface().(KeySetter); ok {
+			ks.SetKey(k)
+		}
+	}
+}
+
+// Import puts the entities src with the given keys, which may be more than a
+// single PutMulti accepts, by splitting them into chunks and committing each
+// chunk non-transactionally. It is intended for bulk loading data; the
+// entities of a chunk are written atomically, but the import as a whole is
+// not.
+//
+// If bestEffort is false, Import stops at the first chunk that fails. If it
+// is true, Import continues with the remaining chunks. In both cases the
+// returned error is an ImportError listing the ranges of keys that were not
+// written, and the returned keys, aligned with keys, are nil for those
+// entities. src must satisfy the same conditions as for PutMulti.
+//
+// A chunk that fails with a transient error, such as a throttled or
+// unavailable server, is retried on its own up to three times, with
+// exponential backoff, before it counts as failed; the other chunks are not
+// written again. If ctx has a deadline, the retries stop as soon as the next
+// backoff would outlast it, and the chunk fails with an error that wraps both
+// context.DeadlineExceeded and the chunk's last error. A chunk with an
+// incomplete key is not retried, since its
+// failed commit may have been applied and retrying it could insert its new
+// entities twice.
+func (c *Client) Import(ctx context.Context, keys []*Key, src interface{}, bestEffort bool) ([]*Key, error) {
+	res, err := c.ImportResult(ctx, keys, src, bestEffort)
+	if res == nil {
+		return nil, err
+	}
+	return res.Keys, err
+}
+
+// ImportResult is like Import, but also returns the number of index updates
+// made by the chunks that were written. It returns a non-nil result along
+// with an ImportError.
+func (c *Client) ImportResult(ctx context.Context, keys []*Key, src interface{}, bestEffort bool) (*PutResult, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("datastore: src has invalid type: got %T, want a slice", src)
+	}
+	if len(keys) != v.Len() {
+		return nil, errors.New("datastore: keys and src slices have different length")
+	}
+	res := &PutResult{Keys: make([]*Key, len(keys))}
+	var ierr ImportError
+	for start := 0; start < len(keys); start += maxMutations {
+		end := start + maxMutations
+		if end > len(keys) {
+			end = len(keys)
+		}
+		var r *PutResult
+		put := func() (err error) {
+			r, err = c.PutMultiResult(ctx, keys[start:end], v.Slice(start, end).Interface())
+			return err
+		}
+		var err error
+		if completeChunk(keys[start:end]) {
+			err = retryChunk(ctx, put)
+		} else {
+			err = put()
+		}
+		if err != nil {
+			ierr = append(ierr, ChunkError{Start: start, End: end, Err: err})
+			if !bestEffort {
+				break
+			}
+			continue
+		}
+		copy(res.Keys[start:], r.Keys)
+		res.IndexUpdates += r.IndexUpdates
+	}
+	if ierr != nil {
+		return res, ierr
+	}
+	return res, nil
+}
+
+// maxChunkAttempts is the number of times retryChunk attempts a chunk.
+const maxChunkAttempts = 4
+
+// chunkRetryDelay is the delay before the first retry of a chunk. It doubles
+// with each later retry.
+var chunkRetryDelay = 100 * time.Millisecond
+
+// retryChunk calls f, which writes or reads one chunk of a batch operation,
+// until it succeeds, fails with an error that is not transient, or has been
+// attempted maxChunkAttempts times, and returns its last error. It waits
+// before each retry for the backoff delay, or for as long as the server
+// asked if that is longer. The deadline of ctx is the retry budget: if the
+// wait would end after it, or ctx is done first, retryChunk stops and returns
+// the context error wrapped with f's last error.
+func retryChunk(ctx context.Context, f func() error) error {
+	delay := chunkRetryDelay
+	for n := 1; ; n++ {
+		err := f()
+		if err == nil || n == maxChunkAttempts || !isTransient(err) {
+			return err
+		}
+		d := delay
+		if e, ok := err.(*transport.ErrHTTP); ok && e.RetryAfter > d {
+			d = e.RetryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(d).After(deadline) {
+			return fmt.Errorf("%w (last attempt: %w)", context.DeadlineExceeded, err)
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return fmt.Errorf("%w (last attempt: %w)", ctx.Err(), err)
+		case <-t.C:
+		}
+		delay *= 2
+	}
+}
+
+// completeChunk reports whether all of keys are complete.
+func completeChunk(keys []*Key) bool {
+	for _, k := range keys {
+		if k.Incomplete() {
+			return false
+		}
+	}
+	return true
+}
+
+// PutChanged is like PutMulti, but only writes the entities that differ from
+// those stored for their keys, and returns the number of entities it skipped
+// because they were unchanged. It suits sync jobs that upsert many entities
+// of which few have changed: the stored entities are first looked up, which
+// costs a read for each key, but an unchanged entity then costs no write and
+// no index updates.
+//
+// An entity is unchanged if the properties it saves, including whether they
+// are indexed, are those of the stored entity, in any order of names. The
+// lookup and the commit are not transactional, so an entity modified in
+// between may be wrongly skipped or written. All the keys must be complete.
+// If every entity is unchanged, nothing is committed.
+func (c *Client) PutChanged(ctx context.Context, keys []*Key, src interface{}) (skipped int, err error) {
+	keys = c.bindKeys(keys)
+	for _, k := range keys {
+		if err := k.check(true); err != nil {
+			return 0, err
+		}
+	}
+	mutation, err := c.putMutation(keys, src)
+	if err != nil || mutation == nil {
+		return 0, err
+	}
+
+	// stored maps the keys of the stored entities to them.
+	stored := make(map[string]*pb.Entity)
+	pbKeys := make([]*pb.Key, len(mutation.Upsert))
+	for i, e := range mutation.Upsert {
+		pbKeys[i] = e.Key
+	}
+	for len(pbKeys) > 0 {
+		req, resp := &pb.LookupRequest{Key: pbKeys}, &pb.LookupResponse{}
+		if err := c.call(ctx, "lookup", req, resp); err != nil {
+			return 0, err
+		}
+		if len(resp.Deferred) == len(pbKeys) {
+			return 0, errors.New("datastore: some entities temporarily unavailable")
+		}
+		for _, e := range resp.Found {
+			stored[protoToKey(e.Entity.Key).String()] = e.Entity
+		}
+		pbKeys = resp.Deferred
+	}
+
+	var changed []*pb.Entity
+	for _, e := range mutation.Upsert {
+		if s, ok := stored[protoToKey(e.Key).String()]; ok && sameProperties(s, e) {
+			skipped++
+			continue
+		}
+		changed = append(changed, e)
+	}
+	if len(changed) > 0 {
+		req := &pb.CommitRequest{
+			Mutation: &pb.Mutation{Upsert: changed},
+			Mode:     pb.CommitRequest_NON_TRANSACTIONAL.Enum(),
+		}
+		if err := c.call(ctx, "commit", req, &pb.CommitResponse{}); err != nil {
+			return 0, err
+		}
+	}
+	setKeys(keys, src)
+	return skipped, nil
+}
+
+// sameProperties reports whether the entities a and b have the same
+// properties. The properties of different names may be in any order.
+func sameProperties(a, b *pb.Entity) bool {
+	x, y := protoToProperties(a), protoToProperties(b)
+	if len(x) != len(y) {
+		return false
+	}
+	byName := func(p []Property) func(i, j int) bool {
+		return func(i, j int) bool { return p[i].Name < p[j].Name }
+	}
+	sort.SliceStable(x, byName(x))
+	sort.SliceStable(y, byName(y))
+	return reflect.DeepEqual(x, y)
+}
+
+func (c *Client) putMutation(keys []*Key, src interface{}) (*pb.Mutation, error) {
 	v := reflect.ValueOf(src)
 	multiArgType, _ := checkMultiArg(v)
 	if multiArgType == multiArgTypeInvalid {
-		return nil, errors.New("datastore: src has invalid type")
+		return nil, fmt.Errorf("datastore: src has invalid type: got %T, want a slice of structs, struct pointers, interfaces or PropertyLoadSavers", src)
 	}
 	if len(keys) != v.Len() {
 		return nil, errors.New("datastore: key and src slices have different length")
@@ -426,6 +1185,9 @@ func putMutation(keys []*Key, src interface{}) (*pb.Mutation, error) {
 	if len(keys) == 0 {
 		return nil, nil
 	}
+	if len(keys) > maxMutations {
+		return nil, fmt.Errorf("datastore: too many entities to put: %d, the limit is %d", len(keys), maxMutations)
+	}
 	if err := multiValid(keys); err != nil {
 		return nil, err
 	}
@@ -440,7 +1202,29 @@ func putMutation(keys []*Key, src interface{}) (*pb.Mutation, error) {
 		if val.Kind() == reflect.Ptr && val.Elem().Kind() == reflect.Slice {
 			val = val.Elem()
 		}
-		p, err := saveEntity(k, val.Interface())
+		// If src holds struct values, such as []T{ent1, ent2} or
+		// []interface{}{ent1, ent2}, save them through a pointer.
+		if val.Kind() == reflect.Interface {
+			val = val.Elem()
+		}
+		if val.Kind() == reflect.Struct {
+			if val.CanAddr() {
+				val = val.Addr()
+			} else {
+				ptr := reflect.New(val.Type())
+				ptr.Elem().Set(val)
+				val = ptr
+			}
+		}
+		if err := checkSrcType(val); err != nil {
+			return nil, fmt.Errorf("datastore: invalid src for %v: %v", k, err)
+		}
+		if b, ok := val.Interface().(BeforeSaver); ok {
+			if err := b.BeforeSave(); err != nil {
+				return nil, err
+			}
+		}
+		p, err := c.saveEntity(k, val.Interface())
 		if err != nil {
 			return nil, fmt.Errorf("datastore: Error while saving %v: %v", k.String(), err)
 		}
@@ -457,6 +1241,89 @@ func putMutation(keys []*Key, src interface{}) (*pb.Mutation, error) {
 	}, nil
 }
 
+// Merge saves src, a struct pointer or PropertyLoadSaver, into the entity
+// stored for the complete key, keeping the entity's properties that src does
+// not represent. Put, by contrast, replaces the whole entity, so putting a
+// struct with fields for only some of an entity's properties drops the
+// others. The properties kept are those whose names match no field of the
+// struct, or, for a PropertyLoadSaver, none of the properties it saves; a
+// field that saves no properties, such as an empty slice, still replaces the
+// property of its name. If no entity is stored for key, Merge stores src, as
+// Put would.
+//
+// The datastore API has no partial updates, so Merge reads the entity and
+// writes the merged result in a transaction run by RunInTransaction, with the
+// given options. It costs a lookup on top of the write, and the two are
+// applied atomically: a concurrent write to the entity makes the transaction
+// conflict and be retried, rather than being lost or losing src's changes.
+func (c *Client) Merge(ctx context.Context, key *Key, src interface{}, opts ...TransactionOption) error {
+	if err := key.check(true); err != nil {
+		return err
+	}
+	if err := checkSrcType(reflect.ValueOf(src)); err != nil {
+		return fmt.Errorf("datastore: invalid src for %v: %v", key, err)
+	}
+	if b, ok := src.(BeforeSaver); ok {
+		if err := b.BeforeSave(); err != nil {
+			return err
+		}
+	}
+	props, err := c.saveProperties(key, src)
+	if err != nil {
+		return err
+	}
+	owned := make(map[string]bool)
+	if _, ok := src.(PropertyLoadSaver); !ok {
+		v := reflect.ValueOf(src).Elem()
+		codec, err := getStructCodec(v.Type(), c.naming)
+		if err != nil {
+			return err
+		}
+		for name, fc := range codec.byName {
+			if v.Type().Field(fc.index).PkgPath == "" {
+				owned[name] = true
+			}
+		}
+	}
+	for _, p := range props {
+		owned[p.Name] = true
+	}
+	_, err = c.RunInTransaction(ctx, func(tx *Transaction) error {
+		var stored PropertyList
+		if err := tx.Get(key, &stored); err != nil && err != ErrNoSuchEntity {
+			return err
+		}
+		merged := make(PropertyList, 0, len(stored)+len(props))
+		for _, p := range stored {
+			if !owned[p.Name] {
+				merged = append(merged, p)
+			}
+		}
+		merged = append(merged, props...)
+		_, err := tx.Put(key, &merged)
+		return err
+	}, opts...)
+	return err
+}
+
+// checkSrcType returns an error describing why v cannot be saved as an
+// entity, or nil if it can.
+func checkSrcType(v reflect.Value) error {
+	if !v.IsValid() {
+		return errors.New("got nil, want pointer to struct or PropertyLoadSaver")
+	}
+	if _, ok := v.Interface().(PropertyLoadSaver); ok {
+		return nil
+	}
+	if v.Kind() != reflect.Ptr || v.Type().Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("got %v, want pointer to struct or PropertyLoadSaver", v.Type())
+	}
+	if v.IsNil() {
+		return fmt.Errorf("got nil %v, want pointer to struct or PropertyLoadSaver", v.Type())
+	}
+	return nil
+}
+
 // Delete deletes the entity for the given key.
 func (c *Client) Delete(ctx context.Context, key *Key) error {
 	err := c.DeleteMulti(ctx, []*Key{key})
@@ -467,8 +1334,9 @@ func (c *Client) Delete(ctx context.Context, key *Key) error {
 }
 
 // DeleteMulti is a batch version of Delete.
+// At most 500 keys may be deleted in a single call.
 func (c *Client) DeleteMulti(ctx context.Context, keys []*Key) error {
-	mutation, err := deleteMutation(keys)
+	mutation, err := deleteMutation(c.bindKeys(keys))
 	if err != nil {
 		return err
 	}
@@ -481,11 +1349,68 @@ func (c *Client) DeleteMulti(ctx context.Context, keys []*Key) error {
 	return c.call(ctx, "commit", req, resp)
 }
 
+// DeleteByAncestor deletes the entities that descend from parent, at any
+// depth, and returns the number of entities deleted. The entity of parent
+// itself is not deleted. parent must be complete.
+//
+// The keys are found by a keys-only ancestor query and deleted in chunks of
+// up to 500 keys as the query returns them, so the deletion as a whole is not
+// atomic. If ctx is done, or a chunk fails to be deleted, DeleteByAncestor
+// stops and returns the number of entities deleted so far with the error.
+func (c *Client) DeleteByAncestor(ctx context.Context, parent *Key) (int, error) {
+	if err := parent.check(true); err != nil {
+		return 0, err
+	}
+	ctx = c.namespaced(ctx)
+	bound := c.bindAncestor(ctx, parent)
+	deleted := 0
+	keys := make([]*Key, 0, maxMutations)
+	flush := func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := c.DeleteMulti(ctx, keys); err != nil {
+			return err
+		}
+		deleted += len(keys)
+		keys = keys[:0]
+		return nil
+	}
+	it := c.Run(ctx, NewQuery("").Ancestor(parent).KeysOnly())
+	for {
+		k, err := it.Next(nil)
+		if err == Done {
+			break
+		}
+		if err != nil {
+			return deleted, err
+		}
+		if k.Equal(bound) {
+			continue
+		}
+		keys = append(keys, k)
+		if len(keys) == maxMutations {
+			if err := flush(); err != nil {
+				return deleted, err
+			}
+		}
+	}
+	if len(keys) > 0 {
+		if err := flush(); err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
 func deleteMutation(keys []*Key) (*pb.Mutation, error) {
+	if len(keys) > maxMutations {
+		return nil, fmt.Errorf("datastore: too many keys to delete: %d, the limit is %d", len(keys), maxMutations)
+	}
 	protoKeys := make([]*pb.Key, len(keys))
 	for i, k := range keys {
-		if k.Incomplete() {
-			return nil, fmt.Errorf("datastore: can't delete the incomplete key: %v", k)
+		if err := k.check(true); err != nil {
+			return nil, err
 		}
 		protoKeys[i] = keyToProto(k)
 	}
@@ -494,3 +1419,8 @@ func deleteMutation(keys []*Key) (*pb.Mutation, error) {
 		Delete: protoKeys,
 	}, nil
 }
+
+// mutationLen returns the number of mutations in m.
+func mutationLen(m *pb.Mutation) int {
+	return len(m.Upsert) + len(m.Update) + len(m.Insert) + len(m.InsertAutoId) + len(m.Delete)
+}
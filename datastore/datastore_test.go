@@ -15,13 +15,25 @@
 package datastore
 
 import (
+	"bytes"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode"
+	"unsafe"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	pb "google.golang.org/cloud/internal/datastore"
+	"google.golang.org/cloud/internal/transport"
 )
 
 type (
@@ -221,6 +233,14 @@ type InvalidTagged2 struct {
 	J int `datastore:"I"`
 }
 
+type InvalidTagged3 struct {
+	I int `datastore:"__key__"`
+}
+
+type InvalidTagged4 struct {
+	I int `datastore:"A.__scatter__"`
+}
+
 type Inner1 struct {
 	W int32
 	X string
@@ -284,6 +304,13 @@ type MutuallyRecursive1 struct {
 	R []MutuallyRecursive0
 }
 
+type RecursiveNested struct {
+	I int
+	N struct {
+		R []RecursiveNested
+	}
+}
+
 type Doubler struct {
 	S string
 	I int64
@@ -548,10 +575,34 @@ var testCases = []testCase{
 	},
 	{
 		"save []float64 load []int64",
+		&Y0{B: true, F: []float64{7.5, 8, 9}},
+		&Y2{B: true, F: []int64{8, 9}},
+		"",
+		"cannot be represented",
+	},
+	{
+		"save integral []float64 load []int64",
 		&Y0{B: true, F: []float64{7, 8, 9}},
-		&Y2{B: true},
+		&Y2{B: true, F: []int64{7, 8, 9}},
+		"",
+		"",
+	},
+	{
+		"save []int64 load []float64",
+		&Y2{B: true, F: []int64{7, 8, 9}},
+		&Y0{B: true, F: []float64{7, 8, 9}},
+		"",
+		"",
+	},
+	{
+		"save mixed int64 and float64 load []float64",
+		&PropertyList{
+			Property{Name: "F", Value: int64(7), Multiple: true},
+			Property{Name: "F", Value: 8.5, Multiple: true},
+		},
+		&Y0{F: []float64{7, 8.5}},
+		"",
 		"",
-		"type mismatch",
 	},
 	{
 		"single slice is too long",
@@ -696,6 +747,20 @@ var testCases = []testCase{
 		"struct tag has repeated property name",
 		"",
 	},
+	{
+		"invalid tagged3",
+		&InvalidTagged3{I: 1},
+		&InvalidTagged3{},
+		"struct tag has reserved property name",
+		"",
+	},
+	{
+		"invalid tagged4",
+		&InvalidTagged4{I: 1},
+		&InvalidTagged4{},
+		"struct tag has reserved property name",
+		"",
+	},
 	{
 		"doubler",
 		&Doubler{S: "s", I: 1, B: true},
@@ -1245,6 +1310,36 @@ func TestQueryConstruction(t *testing.T) {
 				limit: -1,
 			},
 		},
+		{
+			// Query whose kind is overridden.
+			q: NewQuery("Foo").Filter("foo >", 7).Kind("Bar"),
+			exp: &Query{
+				kind: "Bar",
+				filter: []filter{
+					{
+						FieldName: "foo",
+						Op:        greaterThan,
+						Value:     7,
+					},
+				},
+				limit: -1,
+			},
+		},
+		{
+			// Existence filter. The field name is not parsed, so it is not quoted.
+			q: NewQuery("Foo").FilterExists("foo bar"),
+			exp: &Query{
+				kind: "Foo",
+				filter: []filter{
+					{
+						FieldName: "foo bar",
+						Op:        greaterEq,
+						Value:     nil,
+					},
+				},
+				limit: -1,
+			},
+		},
 		{
 			// Regular filtered query with standard spacing.
 			q: NewQuery("Foo").Filter("foo >", 7),
@@ -1357,3 +1452,2537 @@ func TestQueryConstruction(t *testing.T) {
 		}
 	}
 }
+
+func TestNamespacePut(t *testing.T) {
+	gotNamespace := make(chan string, 1)
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			gotNamespace <- req.(*pb.CommitRequest).GetMutation().GetUpsert()[0].GetKey().GetPartitionId().GetNamespace()
+			resp.(*pb.CommitResponse).MutationResult = &pb.MutationResult{}
+			return nil
+		}),
+	}
+
+	for _, ns := range []string{"", "tenant1", "tenant2"} {
+		ctx := WithNamespace(context.Background(), ns)
+		if _, err := client.Put(ctx, NewKey(ctx, "Gopher", "george", 0, nil), &Gopher{Name: "George"}); err != nil {
+			t.Fatalf("namespace %q: Put: %v", ns, err)
+		}
+		if got := <-gotNamespace; got != ns {
+			t.Errorf("Put: got namespace %q, want %q", got, ns)
+		}
+	}
+}
+
+func TestInNamespace(t *testing.T) {
+	ctx := context.Background()
+	var got []string
+	base := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			switch req := req.(type) {
+			case *pb.CommitRequest:
+				m := req.GetMutation()
+				for _, e := range m.GetUpsert() {
+					got = append(got, e.GetKey().GetPartitionId().GetNamespace())
+				}
+				for _, k := range m.GetDelete() {
+					got = append(got, k.GetPartitionId().GetNamespace())
+				}
+				resp.(*pb.CommitResponse).MutationResult = &pb.MutationResult{}
+			case *pb.LookupRequest:
+				k := req.Key[0]
+				got = append(got, k.GetPartitionId().GetNamespace())
+				*resp.(*pb.LookupResponse) = pb.LookupResponse{
+					Missing: []*pb.EntityResult{{Entity: &pb.Entity{Key: k}}},
+				}
+			case *pb.RunQueryRequest:
+				got = append(got, req.GetPartitionId().GetNamespace())
+				if f := req.Query.GetFilter().GetPropertyFilter(); f != nil {
+					got = append(got, f.Value.KeyValue.GetPartitionId().GetNamespace())
+				}
+				*resp.(*pb.RunQueryResponse) = pb.RunQueryResponse{Batch: &pb.QueryResultBatch{
+					EntityResultType: pb.EntityResult_KEY_ONLY.Enum(),
+					MoreResults:      pb.QueryResultBatch_NO_MORE_RESULTS.Enum(),
+				}}
+			}
+			return nil
+		}),
+	}
+	client := base.InNamespace("tenant")
+
+	key := NewKey(ctx, "Gopher", "george", 0, nil)
+	other := NewKey(WithNamespace(ctx, "other"), "Gopher", "george", 0, nil)
+	k, err := client.Put(ctx, key, &Gopher{Name: "George"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Namespace() != "tenant" {
+		t.Errorf("Put returned key %v, want it in namespace %q", k, "tenant")
+	}
+	if _, err := client.Put(ctx, other, &Gopher{Name: "George"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Get(ctx, key, &Gopher{}); err != ErrNoSuchEntity {
+		t.Fatalf("Get: got %v, want ErrNoSuchEntity", err)
+	}
+	if err := client.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetAll(ctx, NewQuery("Gopher").Ancestor(key).KeysOnly(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetAll(WithNamespace(ctx, ""), NewQuery("Gopher").KeysOnly(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := base.GetAll(ctx, NewQuery("Gopher").KeysOnly(), nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"tenant", "other", "tenant", "tenant", "tenant", "tenant", "", ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got namespaces %q, want %q", got, want)
+	}
+}
+
+func TestGetMultiDeferred(t *testing.T) {
+	ctx := context.Background()
+	var lookups [][]int64
+	deferAll := false
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			in, out := req.(*pb.LookupRequest), resp.(*pb.LookupResponse)
+			var ids []int64
+			for _, k := range in.Key {
+				id := protoToKey(k).ID()
+				ids = append(ids, id)
+				switch {
+				case deferAll || (id%2 == 0 && len(lookups) == 0):
+					out.Deferred = append(out.Deferred, k)
+				case id == 3:
+					out.Missing = append(out.Missing, &pb.EntityResult{Entity: &pb.Entity{Key: k}})
+				default:
+					out.Found = append(out.Found, &pb.EntityResult{Entity: &pb.Entity{
+						Key: k,
+						Property: []*pb.Property{
+							{Name: proto.String("Height"), Value: &pb.Value{IntegerValue: proto.Int64(id)}},
+						},
+					}})
+				}
+			}
+			lookups = append(lookups, ids)
+			return nil
+		}),
+	}
+	var keys []*Key
+	for i := int64(1); i <= 4; i++ {
+		keys = append(keys, NewKey(ctx, "Gopher", "", i, nil))
+	}
+	dst := make([]Gopher, len(keys))
+	err := client.GetMulti(ctx, keys, dst)
+	if want := (MultiError{nil, nil, ErrNoSuchEntity, nil}); !reflect.DeepEqual(err, want) {
+		t.Errorf("got error %v, want %v", err, want)
+	}
+	if want := []Gopher{{Height: 1}, {Height: 2}, {}, {Height: 4}}; !reflect.DeepEqual(dst, want) {
+		t.Errorf("got %v, want %v", dst, want)
+	}
+	if want := [][]int64{{1, 2, 3, 4}, {2, 4}}; !reflect.DeepEqual(lookups, want) {
+		t.Errorf("got lookups of %v, want %v", lookups, want)
+	}
+
+	deferAll = true
+	if err := client.GetMulti(ctx, keys, dst); err == nil {
+		t.Error("all keys deferred: got nil error")
+	}
+}
+
+func TestExists(t *testing.T) {
+	ctx := context.Background()
+	var sizes []int
+	deferred := false
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			in, out := req.(*pb.LookupRequest), resp.(*pb.LookupResponse)
+			sizes = append(sizes, len(in.Key))
+			for _, k := range in.Key {
+				id := protoToKey(k).ID()
+				switch {
+				case id == 1 && !deferred:
+					deferred = true
+					out.Deferred = append(out.Deferred, k)
+				case id%2 == 0:
+					out.Found = append(out.Found, &pb.EntityResult{Entity: &pb.Entity{Key: k}})
+				default:
+					out.Missing = append(out.Missing, &pb.EntityResult{Entity: &pb.Entity{Key: k}})
+				}
+			}
+			return nil
+		}),
+	}
+	var keys []*Key
+	for i := 1; i <= 2500; i++ {
+		keys = append(keys, NewKey(ctx, "Gopher", "", int64(i), nil))
+	}
+	keys = append(keys, keys[1])
+	got, err := client.Exists(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, k := range keys {
+		if want := k.ID()%2 == 0; got[i] != want {
+			t.Errorf("key %v: got %v, want %v", k, got[i], want)
+		}
+	}
+	if want := []int{1000, 1000, 501}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("got lookups of %v keys, want %v", sizes, want)
+	}
+	// A datastore that defers every key makes no progress.
+	var lookups int
+	deferAll := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			lookups++
+			resp.(*pb.LookupResponse).Deferred = req.(*pb.LookupRequest).Key
+			return nil
+		}),
+	}
+	if _, err := deferAll.Exists(ctx, keys[:3]); err == nil || lookups != 1 {
+		t.Errorf("all deferred: got error %v after %d lookups, want an error after 1", err, lookups)
+	}
+	// A response that does not answer every key is an error, not a miss.
+	short := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			k := req.(*pb.LookupRequest).Key[0]
+			resp.(*pb.LookupResponse).Found = []*pb.EntityResult{{Entity: &pb.Entity{Key: k}}}
+			return nil
+		}),
+	}
+	if got, err := short.Exists(ctx, keys[:3]); err == nil {
+		t.Errorf("short response: got %v, want an error", got)
+	}
+	if _, err := client.Exists(ctx, []*Key{NewIncompleteKey(ctx, "Gopher", nil)}); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("incomplete key: got error %v, want ErrInvalidKey", err)
+	}
+}
+
+func TestGetMultiMissing(t *testing.T) {
+	ctx := context.Background()
+	found, missing := NewKey(ctx, "Gopher", "george", 0, nil), NewKey(ctx, "Gopher", "rufus", 0, nil)
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			*resp.(*pb.LookupResponse) = pb.LookupResponse{
+				Found: []*pb.EntityResult{{Entity: &pb.Entity{
+					Key: keyToProto(found),
+					Property: []*pb.Property{
+						{Name: proto.String("Name"), Value: &pb.Value{StringValue: proto.String("George")}},
+					},
+				}}},
+				Missing: []*pb.EntityResult{{Entity: &pb.Entity{Key: keyToProto(missing)}}},
+			}
+			return nil
+		}),
+	}
+
+	dst := make([]Gopher, 2)
+	err := client.GetMulti(ctx, []*Key{missing, found}, dst)
+	me, ok := err.(MultiError)
+	if !ok {
+		t.Fatalf("got error %v, want a MultiError", err)
+	}
+	if me[0] != ErrNoSuchEntity || me[1] != nil {
+		t.Errorf("got errors %v, want [ErrNoSuchEntity nil]", []error(me))
+	}
+	if dst[1].Name != "George" {
+		t.Errorf("got %+v for the found key, want Name George", dst[1])
+	}
+}
+
+func TestRepeatedPropertyIndexing(t *testing.T) {
+	src := &struct {
+		S []string `datastore:",noindex"`
+		T []string
+	}{
+		S: []string{"a", "b", "c"},
+		T: []string{"d", "e"},
+	}
+	e, err := saveEntity(testKey0, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range e.Property {
+		wantIndexed := p.GetName() == "T"
+		for i, v := range p.Value.ListValue {
+			if v.GetIndexed() != wantIndexed {
+				t.Errorf("%s[%d]: got indexed %v, want %v", p.GetName(), i, v.GetIndexed(), wantIndexed)
+			}
+		}
+	}
+	for _, p := range protoToProperties(e) {
+		if p.NoIndex != (p.Name == "S") {
+			t.Errorf("loaded %s=%v: got NoIndex %v", p.Name, p.Value, p.NoIndex)
+		}
+	}
+
+	mixed := &PropertyList{
+		{Name: "S", Value: "a", Multiple: true},
+		{Name: "S", Value: "b", Multiple: true, NoIndex: true},
+	}
+	if _, err := saveEntity(testKey0, mixed); err == nil || !strings.Contains(err.Error(), "cannot mix indexed and unindexed") {
+		t.Errorf("mixed indexing: got error %v", err)
+	}
+}
+
+type benchmarkEntity struct {
+	Name    string
+	Height  int64
+	Weight  float64
+	Tags    []string
+	Born    time.Time
+	Private []byte `datastore:",noindex"`
+}
+
+func BenchmarkSaveEntity(b *testing.B) {
+	src := &benchmarkEntity{
+		Name:    "George",
+		Height:  32,
+		Weight:  12.5,
+		Tags:    []string{"a", "b", "c"},
+		Born:    time.Unix(1e9, 0),
+		Private: make([]byte, 64),
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := saveEntity(testKey0, src); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLoadEntity(b *testing.B) {
+	e, err := saveEntity(testKey0, &benchmarkEntity{
+		Name:    "George",
+		Height:  32,
+		Weight:  12.5,
+		Tags:    []string{"a", "b", "c"},
+		Born:    time.Unix(1e9, 0),
+		Private: make([]byte, 64),
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var dst benchmarkEntity
+		if err := loadEntity(&dst, e); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLoadLargeBlob(b *testing.B) {
+	e, err := saveEntity(testKey0, &benchmarkEntity{Private: make([]byte, 1<<20)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var dst benchmarkEntity
+		if err := loadEntity(&dst, e); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLoadBlobNotCopied(t *testing.T) {
+	blob := make([]byte, 1<<20)
+	e, err := saveEntity(testKey0, &benchmarkEntity{Private: blob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dst benchmarkEntity
+	if err := loadEntity(&dst, e); err != nil {
+		t.Fatal(err)
+	}
+	if len(dst.Private) != len(blob) || &dst.Private[0] != &blob[0] {
+		t.Error("loaded blob is a copy of the saved one")
+	}
+}
+
+func TestPutStructValues(t *testing.T) {
+	ctx := context.Background()
+	var got []string
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			for _, e := range req.(*pb.CommitRequest).GetMutation().GetUpsert() {
+				got = append(got, e.Property[0].Value.GetStringValue())
+			}
+			resp.(*pb.CommitResponse).MutationResult = &pb.MutationResult{}
+			return nil
+		}),
+	}
+	k1, k2 := NewKey(ctx, "Gopher", "", 1, nil), NewKey(ctx, "Gopher", "", 2, nil)
+
+	if _, err := client.Put(ctx, k1, Gopher{Name: "George"}); err != nil {
+		t.Errorf("Put with struct value: %v", err)
+	}
+	if _, err := client.PutMulti(ctx, []*Key{k1, k2}, []Gopher{{Name: "Rufus"}, {Name: "Bob"}}); err != nil {
+		t.Errorf("PutMulti with []S: %v", err)
+	}
+	if want := []string{"George", "Rufus", "Bob"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got names %q, want %q", got, want)
+	}
+}
+
+func TestPutInvalidSrc(t *testing.T) {
+	ctx := context.Background()
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			return errors.New("unexpected call")
+		}),
+	}
+	key := NewKey(ctx, "Gopher", "", 1, nil)
+	testCases := []struct {
+		src  interface{}
+		want string
+	}{
+		{5, "invalid src for /Gopher,1: got int, want pointer to struct"},
+		{nil, "invalid src for /Gopher,1: got nil, want pointer to struct"},
+		{(*Gopher)(nil), "invalid src for /Gopher,1: got nil *datastore.Gopher, want pointer to struct"},
+		{new(string), "invalid src for /Gopher,1: got *string, want pointer to struct"},
+	}
+	for _, tc := range testCases {
+		_, err := client.Put(ctx, key, tc.src)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Put(%#v): got error %v, want %q", tc.src, err, tc.want)
+		}
+	}
+
+	_, err := client.PutMulti(ctx, []*Key{key}, 5)
+	if err == nil || !strings.Contains(err.Error(), "src has invalid type: got int") {
+		t.Errorf("PutMulti(5): got error %v", err)
+	}
+}
+
+func TestAutoTimes(t *testing.T) {
+	type Inner struct {
+		Touched time.Time `datastore:",autonow"`
+	}
+	type Record struct {
+		Name      string
+		CreatedAt time.Time `datastore:",autoaddonly"`
+		UpdatedAt time.Time `datastore:",autonow,noindex"`
+		Inner     Inner
+	}
+	ctx := context.Background()
+	old := time.Unix(1e9, 0).UTC()
+
+	before := time.Now().UTC()
+	r := &Record{CreatedAt: old, UpdatedAt: old, Inner: Inner{Touched: old}}
+	e, err := saveEntity(NewIncompleteKey(ctx, "Record", nil), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []time.Time{r.CreatedAt, r.UpdatedAt, r.Inner.Touched} {
+		if f.Before(before) {
+			t.Errorf("new entity: got time %v, want at least %v", f, before)
+		}
+	}
+	for _, p := range e.Property {
+		if p.GetName() == "UpdatedAt" && p.Value.GetIndexed() {
+			t.Errorf("got indexed UpdatedAt, want noindex")
+		}
+	}
+
+	r = &Record{CreatedAt: old, UpdatedAt: old}
+	if _, err := saveEntity(NewKey(ctx, "Record", "", 1, nil), r); err != nil {
+		t.Fatal(err)
+	}
+	if !r.CreatedAt.Equal(old) {
+		t.Errorf("existing entity: got CreatedAt %v, want %v", r.CreatedAt, old)
+	}
+	if r.UpdatedAt.Before(before) {
+		t.Errorf("existing entity: got UpdatedAt %v, want at least %v", r.UpdatedAt, before)
+	}
+
+	type Bad struct {
+		N int `datastore:",autonow"`
+	}
+	if _, err := saveEntity(NewKey(ctx, "Bad", "", 1, nil), &Bad{}); err == nil {
+		t.Error("got nil error for autonow on a non-time field")
+	}
+}
+
+func TestCheckProjectID(t *testing.T) {
+	for _, id := range []string{"project-id", "p1", "example.com:project-id", "s~project-id", "e~example.com:project"} {
+		if err := checkProjectID(id); err != nil {
+			t.Errorf("%q: got error %v, want nil", id, err)
+		}
+	}
+	for _, id := range []string{"", "Project-ID", "project id", "project/id", "-project", ":project", strings.Repeat("a", 101)} {
+		if err := checkProjectID(id); err == nil {
+			t.Errorf("%q: got nil error", id)
+		}
+	}
+	if _, err := NewClient(context.Background(), "bad/id"); err == nil || !strings.Contains(err.Error(), "invalid project ID") {
+		t.Errorf("NewClient: got error %v, want invalid project ID", err)
+	}
+}
+
+func TestGetReadOptions(t *testing.T) {
+	ctx := context.Background()
+	var got *pb.ReadOptions
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			got = req.(*pb.LookupRequest).ReadOptions
+			return nil
+		}),
+	}
+	key := NewKey(ctx, "Gopher", "george", 0, nil)
+
+	client.Get(ctx, key, &Gopher{})
+	if got != nil {
+		t.Errorf("no options: got read options %v, want nil", got)
+	}
+	client.Get(ctx, key, &Gopher{}, EventualConsistency)
+	if got.GetReadConsistency() != pb.ReadOptions_EVENTUAL || got.Transaction != nil {
+		t.Errorf("EventualConsistency: got read options %v", got)
+	}
+	client.GetMulti(ctx, []*Key{key}, []Gopher{{}}, StrongConsistency)
+	if got.GetReadConsistency() != pb.ReadOptions_STRONG {
+		t.Errorf("StrongConsistency: got read options %v", got)
+	}
+}
+
+func TestLoadProperties(t *testing.T) {
+	ctx := context.Background()
+	key := NewKey(ctx, "Gopher", "george", 0, nil)
+	var got *pb.ReadOptions
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			got = req.(*pb.LookupRequest).ReadOptions
+			resp.(*pb.LookupResponse).Found = []*pb.EntityResult{{Entity: &pb.Entity{
+				Key: keyToProto(key),
+				Property: []*pb.Property{
+					{Name: proto.String("Name"), Value: &pb.Value{StringValue: proto.String("George")}},
+					{Name: proto.String("Height"), Value: &pb.Value{IntegerValue: proto.Int64(10)}},
+				},
+			}}}
+			return nil
+		}),
+	}
+
+	g := Gopher{Height: 3}
+	if err := client.Get(ctx, key, &g, LoadProperties("Name")); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Gopher{Name: "George", Height: 3}); g != want {
+		t.Errorf("got %+v, want %+v", g, want)
+	}
+	if got != nil {
+		t.Errorf("got read options %v, want nil", got)
+	}
+
+	g = Gopher{}
+	if err := client.Get(ctx, key, &g, LoadProperties("Name"), LoadProperties("Height"), EventualConsistency); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Gopher{Name: "George", Height: 10}); g != want {
+		t.Errorf("got %+v, want %+v", g, want)
+	}
+	if got.GetReadConsistency() != pb.ReadOptions_EVENTUAL {
+		t.Errorf("got read options %v, want eventual consistency", got)
+	}
+}
+
+func TestIncompleteKeyValues(t *testing.T) {
+	ctx := context.Background()
+	type Post struct {
+		Author *Key
+	}
+	for _, k := range []*Key{
+		NewIncompleteKey(ctx, "Gopher", nil),
+		NewKey(ctx, "Gopher", "george", 0, NewIncompleteKey(ctx, "Burrow", nil)),
+	} {
+		if _, err := saveEntity(testKey0, &Post{Author: k}); err == nil || !strings.Contains(err.Error(), "incomplete key value") {
+			t.Errorf("save %v: got error %v, want an incomplete key value error", k, err)
+		}
+		q := NewQuery("Post").Filter("Author =", k)
+		if err := q.toProto(&pb.RunQueryRequest{}); err == nil || !strings.Contains(err.Error(), "incomplete key value") {
+			t.Errorf("filter %v: got error %v, want an incomplete key value error", k, err)
+		}
+		if err := NewQuery("Post").Ancestor(k).err; err == nil {
+			t.Errorf("ancestor %v: got nil error, want an incomplete ancestor error", k)
+		}
+	}
+	if _, err := saveEntity(testKey0, &Post{}); err != nil {
+		t.Errorf("nil key: %v", err)
+	}
+}
+
+func TestGetSingleKey(t *testing.T) {
+	ctx := context.Background()
+	key := NewKey(ctx, "Gopher", "george", 0, nil)
+	found := true
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			e := &pb.Entity{Key: keyToProto(key)}
+			if found {
+				e.Property = []*pb.Property{
+					{Name: proto.String("Name"), Value: &pb.Value{StringValue: proto.String("George")}},
+				}
+				resp.(*pb.LookupResponse).Found = []*pb.EntityResult{{Entity: e}}
+			} else {
+				resp.(*pb.LookupResponse).Missing = []*pb.EntityResult{{Entity: e}}
+			}
+			return nil
+		}),
+	}
+
+	var g Gopher
+	if err := client.Get(ctx, key, &g); err != nil {
+		t.Fatalf("found: %v", err)
+	}
+	if g.Name != "George" {
+		t.Errorf("found: got %+v, want Name George", g)
+	}
+	found = false
+	if err := client.Get(ctx, key, &Gopher{}); err != ErrNoSuchEntity {
+		t.Errorf("missing: got error %v, want ErrNoSuchEntity", err)
+	}
+}
+
+func TestClientConcurrentUse(t *testing.T) {
+	ctx := context.Background()
+	// The fake is stateless, so that any race is in the Client.
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			switch req := req.(type) {
+			case *pb.LookupRequest:
+				e := &pb.Entity{
+					Key: req.Key[0],
+					Property: []*pb.Property{
+						{Name: proto.String("Name"), Value: &pb.Value{StringValue: proto.String("George")}},
+					},
+				}
+				resp.(*pb.LookupResponse).Found = []*pb.EntityResult{{Entity: e}}
+			case *pb.CommitRequest:
+				resp.(*pb.CommitResponse).MutationResult = &pb.MutationResult{}
+			}
+			return nil
+		}),
+	}
+	// Share the Client across namespaces, too.
+	clients := []*Client{client, client.InNamespace("gopherspace")}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := clients[i%len(clients)]
+			key := NewKey(ctx, "Gopher", "", int64(i+1), nil)
+			for j := 0; j < 10; j++ {
+				var g Gopher
+				if err := c.Get(ctx, key, &g); err != nil || g.Name != "George" {
+					t.Errorf("Get: got %+v, %v", g, err)
+					return
+				}
+				g.Height = j
+				if _, err := c.Put(ctx, key, &g); err != nil {
+					t.Errorf("Put: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMaxEntityProperties(t *testing.T) {
+	ctx := context.Background()
+	key := NewKey(ctx, "Gopher", "george", 0, nil)
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			e := &pb.Entity{
+				Key: keyToProto(key),
+				Property: []*pb.Property{
+					{Name: proto.String("Name"), Value: &pb.Value{StringValue: proto.String("George")}},
+					{Name: proto.String("Tags"), Value: &pb.Value{ListValue: []*pb.Value{
+						{StringValue: proto.String("a")},
+						{StringValue: proto.String("b")},
+					}}},
+				},
+			}
+			resp.(*pb.LookupResponse).Found = []*pb.EntityResult{{Entity: e}}
+			return nil
+		}),
+	}
+	var pl PropertyList
+	if err := client.Get(ctx, key, &pl); err != nil || len(pl) != 3 {
+		t.Errorf("no limit: got %v, %v", pl, err)
+	}
+	MaxEntityProperties(3).applyClient(client)
+	pl = nil
+	if err := client.Get(ctx, key, &pl); err != nil || len(pl) != 3 {
+		t.Errorf("at the limit: got %v, %v", pl, err)
+	}
+	MaxEntityProperties(2).applyClient(client)
+	pl = nil
+	if err := client.Get(ctx, key, &pl); err == nil || pl != nil {
+		t.Errorf("over the limit: got %v, %v; want an error and nothing loaded", pl, err)
+	}
+}
+
+func TestLongIndexedValues(t *testing.T) {
+	type Doc struct {
+		Title string
+		Body  string
+		Tags  []string
+		Data  []byte
+	}
+	long := strings.Repeat("x", 1501)
+	src := &Doc{Title: "t", Body: long, Tags: []string{"a", long}, Data: []byte(long)}
+	var committed *pb.CommitRequest
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			committed = req.(*pb.CommitRequest)
+			resp.(*pb.CommitResponse).MutationResult = &pb.MutationResult{}
+			return nil
+		}),
+	}
+	ctx := context.Background()
+	key := NewKey(ctx, "Doc", "d", 0, nil)
+	_, err := client.Put(ctx, key, src)
+	if err == nil || !strings.Contains(err.Error(), `"Body"`) || !strings.Contains(err.Error(), "1501 bytes") {
+		t.Errorf("got error %v, want one naming Body and its size", err)
+	}
+	if committed != nil {
+		t.Error("the put was sent to the datastore")
+	}
+
+	AutoNoIndex().applyClient(client)
+	if _, err := client.Put(ctx, key, src); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range committed.Mutation.Upsert[0].Property {
+		var indexed []bool
+		if l := p.Value.ListValue; l != nil {
+			for _, v := range l {
+				indexed = append(indexed, v.GetIndexed())
+			}
+		} else {
+			indexed = []bool{p.Value.GetIndexed()}
+		}
+		for _, got := range indexed {
+			if want := p.GetName() == "Title"; got != want {
+				t.Errorf("property %s: got indexed %v, want %v", p.GetName(), got, want)
+			}
+		}
+	}
+}
+
+func TestDefaultNoIndex(t *testing.T) {
+	type Origin struct {
+		Region string `datastore:",index"`
+		Zone   string
+	}
+	type Log struct {
+		Level  string `datastore:",index"`
+		Msg    string
+		Host   string   `datastore:",noindex"`
+		Tags   []string `datastore:",index"`
+		Origin Origin
+		Quiet  Origin `datastore:",noindex"`
+	}
+	src := &Log{Level: "info", Msg: "m", Host: "h", Tags: []string{"a", "b"}, Origin: Origin{"r", "z"}, Quiet: Origin{"r", "z"}}
+	var committed *pb.CommitRequest
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			committed = req.(*pb.CommitRequest)
+			resp.(*pb.CommitResponse).MutationResult = &pb.MutationResult{}
+			return nil
+		}),
+	}
+	ctx := context.Background()
+	key := NewKey(ctx, "Log", "l", 0, nil)
+	indexed := func() map[string]bool {
+		m := make(map[string]bool)
+		for _, p := range committed.Mutation.Upsert[0].Property {
+			v := p.Value
+			if l := v.ListValue; l != nil {
+				v = l[0]
+			}
+			m[p.GetName()] = v.GetIndexed()
+		}
+		return m
+	}
+	for _, tc := range []struct {
+		defaultNoIndex bool
+		src            interface{}
+		want           map[string]bool
+	}{
+		{false, src, map[string]bool{
+			"Level": true, "Msg": true, "Host": false, "Tags": true,
+			"Origin.Region": true, "Origin.Zone": true, "Quiet.Region": true, "Quiet.Zone": false,
+		}},
+		{true, src, map[string]bool{
+			"Level": true, "Msg": false, "Host": false, "Tags": true,
+			"Origin.Region": true, "Origin.Zone": false, "Quiet.Region": true, "Quiet.Zone": false,
+		}},
+		// A PropertyList keeps its properties' NoIndex.
+		{true, &PropertyList{{Name: "A", Value: "a"}, {Name: "B", Value: "b", NoIndex: true}}, map[string]bool{
+			"A": true, "B": false,
+		}},
+	} {
+		client.defaultNoIndex = tc.defaultNoIndex
+		if _, err := client.Put(ctx, key, tc.src); err != nil {
+			t.Fatal(err)
+		}
+		if got := indexed(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("defaultNoIndex %v, %T: got indexed properties %v, want %v", tc.defaultNoIndex, tc.src, got, tc.want)
+		}
+	}
+
+	type Both struct {
+		A string `datastore:",index,noindex"`
+	}
+	if _, err := client.Put(ctx, key, &Both{}); err == nil {
+		t.Error("index and noindex: got nil error")
+	}
+}
+
+func TestIndexFunc(t *testing.T) {
+	type Address struct {
+		City, Street string
+	}
+	type Person struct {
+		Name    string
+		Bio     string `datastore:",noindex"`
+		Tags    []string
+		Address Address
+	}
+	var called []string
+	var committed *pb.CommitRequest
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			committed = req.(*pb.CommitRequest)
+			resp.(*pb.CommitResponse).MutationResult = &pb.MutationResult{}
+			return nil
+		}),
+	}
+	IndexFunc(func(name string) bool {
+		called = append(called, name)
+		return name != "Tags" && name != "Address.Street"
+	}).applyClient(client)
+	ctx := context.Background()
+	src := &Person{Name: "n", Bio: "b", Tags: []string{"a", "b"}, Address: Address{"c", "s"}}
+	if _, err := client.Put(ctx, NewKey(ctx, "Person", "p", 0, nil), src); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]bool)
+	for _, p := range committed.Mutation.Upsert[0].Property {
+		values := p.Value.ListValue
+		if values == nil {
+			values = []*pb.Value{p.Value}
+		}
+		for _, v := range values {
+			got[p.GetName()] = append(got[p.GetName()], v.GetIndexed())
+		}
+	}
+	want := map[string][]bool{
+		"Name":           {true},
+		"Bio":            {false},
+		"Tags":           {false, false},
+		"Address.City":   {true},
+		"Address.Street": {false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got indexed values %v, want %v", got, want)
+	}
+	// The function is called once for each name of the properties that
+	// would be indexed.
+	if want := []string{"Name", "Tags", "Address.City", "Address.Street"}; !reflect.DeepEqual(called, want) {
+		t.Errorf("got calls for %q, want %q", called, want)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	var calls int
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			calls++
+			resp.(*pb.CommitResponse).MutationResult = &pb.MutationResult{}
+			return nil
+		}),
+		closed: new(int32),
+	}
+	ns := client.InNamespace("ns")
+	ctx := context.Background()
+	if err := client.Delete(ctx, NewKey(ctx, "Gopher", "g", 0, nil)); err != nil {
+		t.Fatalf("before Close: got error %v", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("second Close: got error %v", err)
+	}
+	if err := client.Get(ctx, NewKey(ctx, "Gopher", "g", 0, nil), &Gopher{}); err != ErrClientClosed {
+		t.Errorf("Get: got error %v, want ErrClientClosed", err)
+	}
+	if _, err := ns.Run(ctx, NewQuery("Gopher")).Next(&Gopher{}); err != ErrClientClosed {
+		t.Errorf("Run in namespace: got error %v, want ErrClientClosed", err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls, want 1", calls)
+	}
+}
+
+func TestDeleteByAncestor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	parent := NewKey(ctx, "Thread", "t", 0, nil)
+	var commits []int
+	cancelAfter := -1
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			switch req := req.(type) {
+			case *pb.RunQueryRequest:
+				if f := req.Query.Filter.GetPropertyFilter(); f.GetProperty().GetName() != "__key__" || !proto.Equal(f.Value.KeyValue, keyToProto(parent)) {
+					t.Errorf("got filter %v, want an ancestor filter on %v", req.Query.Filter, parent)
+				}
+				// The parent itself is matched, along with 1201 descendants.
+				results := []*pb.EntityResult{{Entity: &pb.Entity{Key: keyToProto(parent)}}}
+				for i := 1; i <= 1201; i++ {
+					k := NewKey(ctx, "Post", "", int64(i), parent)
+					if i%2 == 0 {
+						k = NewKey(ctx, "Comment", "", int64(i), NewKey(ctx, "Post", "", int64(i-1), parent))
+					}
+					results = append(results, &pb.EntityResult{Entity: &pb.Entity{Key: keyToProto(k)}})
+				}
+				*resp.(*pb.RunQueryResponse) = pb.RunQueryResponse{Batch: &pb.QueryResultBatch{
+					EntityResultType: pb.EntityResult_KEY_ONLY.Enum(),
+					MoreResults:      pb.QueryResultBatch_NO_MORE_RESULTS.Enum(),
+					EntityResult:     results,
+				}}
+			case *pb.CommitRequest:
+				for _, k := range req.Mutation.Delete {
+					if proto.Equal(k, keyToProto(parent)) {
+						t.Error("the parent was deleted")
+					}
+				}
+				commits = append(commits, len(req.Mutation.Delete))
+				if len(commits) == cancelAfter {
+					cancel()
+				}
+				resp.(*pb.CommitResponse).MutationResult = &pb.MutationResult{}
+			}
+			return nil
+		}),
+	}
+	n, err := client.DeleteByAncestor(ctx, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{500, 500, 201}; n != 1201 || !reflect.DeepEqual(commits, want) {
+		t.Errorf("got %d deleted in commits %v, want 1201 in %v", n, commits, want)
+	}
+
+	commits, cancelAfter = nil, 1
+	if n, err := client.DeleteByAncestor(ctx, parent); n != 500 || err != context.Canceled {
+		t.Errorf("canceled: got %d, %v; want 500, context.Canceled", n, err)
+	}
+	if n, err := client.DeleteByAncestor(ctx, NewIncompleteKey(ctx, "Thread", nil)); n != 0 || !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("incomplete parent: got %d, %v; want 0 and an invalid key error", n, err)
+	}
+
+	// A Client with a default namespace runs the query, and matches the
+	// parent, in that namespace.
+	nsCtx := WithNamespace(context.Background(), "ns")
+	nsParent, child := NewKey(nsCtx, "Thread", "t", 0, nil), NewKey(nsCtx, "Post", "", 1, nil)
+	child.SetParent(nsParent)
+	var deleted []*pb.Key
+	nsClient := (&Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			switch req := req.(type) {
+			case *pb.RunQueryRequest:
+				if ns := req.GetPartitionId().GetNamespace(); ns != "ns" {
+					t.Errorf("got query in namespace %q, want ns", ns)
+				}
+				*resp.(*pb.RunQueryResponse) = pb.RunQueryResponse{Batch: &pb.QueryResultBatch{
+					EntityResultType: pb.EntityResult_KEY_ONLY.Enum(),
+					MoreResults:      pb.QueryResultBatch_NO_MORE_RESULTS.Enum(),
+					EntityResult: []*pb.EntityResult{
+						{Entity: &pb.Entity{Key: keyToProto(nsParent)}},
+						{Entity: &pb.Entity{Key: keyToProto(child)}},
+					},
+				}}
+			case *pb.CommitRequest:
+				deleted = append(deleted, req.Mutation.Delete...)
+				resp.(*pb.CommitResponse).MutationResult = &pb.MutationResult{}
+			}
+			return nil
+		}),
+	}).InNamespace("ns")
+	n, err = nsClient.DeleteByAncestor(context.Background(), NewKey(context.Background(), "Thread", "t", 0, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || len(deleted) != 1 || !proto.Equal(deleted[0], keyToProto(child)) {
+		t.Errorf("InNamespace: got %d deleted, keys %v; want only %v", n, deleted, child)
+	}
+}
+
+func TestReadTime(t *testing.T) {
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			t.Errorf("got unexpected request %v", req)
+			return nil
+		}),
+	}
+	ctx := context.Background()
+	past := time.Now().Add(-time.Hour)
+	var g Gopher
+	if err := client.Get(ctx, NewKey(ctx, "Gopher", "g", 0, nil), &g, ReadTime(past)); err != errReadTime {
+		t.Errorf("Get: got error %v, want %v", err, errReadTime)
+	}
+	if _, err := client.Run(ctx, NewQuery("Gopher").AsOf(past)).Next(&g); err != errReadTime {
+		t.Errorf("Run: got error %v, want %v", err, errReadTime)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	ctx := context.Background()
+	key := NewKey(ctx, "Gopher", "george", 0, nil)
+	var stored *pb.Entity
+	var committed []*pb.Entity
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			switch resp := resp.(type) {
+			case *pb.BeginTransactionResponse:
+				resp.Transaction = []byte("tx")
+			case *pb.LookupResponse:
+				if stored != nil {
+					resp.Found = []*pb.EntityResult{{Entity: stored}}
+				} else {
+					resp.Missing = []*pb.EntityResult{{Entity: &pb.Entity{Key: keyToProto(key)}}}
+				}
+			case *pb.CommitResponse:
+				committed = req.(*pb.CommitRequest).Mutation.Upsert
+				resp.MutationResult = &pb.MutationResult{}
+			}
+			return nil
+		}),
+	}
+	type Profile struct {
+		Name string
+		Tags []string
+	}
+	// The stored entity has properties for both fields of Profile, and one
+	// that Profile does not represent.
+	stored = &pb.Entity{
+		Key: keyToProto(key),
+		Property: []*pb.Property{
+			{Name: proto.String("Name"), Value: &pb.Value{StringValue: proto.String("George")}},
+			{Name: proto.String("Tags"), Value: &pb.Value{StringValue: proto.String("old")}},
+			{Name: proto.String("Height"), Value: &pb.Value{IntegerValue: proto.Int64(7)}},
+		},
+	}
+	if err := client.Merge(ctx, key, &Profile{Name: "Georgina"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(committed) != 1 {
+		t.Fatalf("got %d entities committed, want 1", len(committed))
+	}
+	got := protoToProperties(committed[0])
+	want := []Property{
+		{Name: "Height", Value: int64(7)},
+		{Name: "Name", Value: "Georgina"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Without a stored entity, Merge saves src alone.
+	stored, committed = nil, nil
+	if err := client.Merge(ctx, key, &Profile{Name: "Georgina", Tags: []string{"new"}}); err != nil {
+		t.Fatal(err)
+	}
+	got = protoToProperties(committed[0])
+	want = []Property{
+		{Name: "Name", Value: "Georgina"},
+		{Name: "Tags", Value: "new", Multiple: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("no stored entity: got %v, want %v", got, want)
+	}
+
+	if err := client.Merge(ctx, NewIncompleteKey(ctx, "Gopher", nil), &Profile{}); err == nil {
+		t.Error("incomplete key: got nil error")
+	}
+}
+
+func TestPutMissingKey(t *testing.T) {
+	ctx := context.Background()
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			// Return no keys, even for incomplete ones.
+			resp.(*pb.CommitResponse).MutationResult = &pb.MutationResult{}
+			return nil
+		}),
+	}
+	if _, err := client.Put(ctx, NewKey(ctx, "Gopher", "", 1, nil), &Gopher{}); err != nil {
+		t.Errorf("complete key: %v", err)
+	}
+	if _, err := client.Put(ctx, NewIncompleteKey(ctx, "Gopher", nil), &Gopher{}); err == nil {
+		t.Error("incomplete key: got nil error when no key was returned")
+	}
+}
+
+// testMoney is a struct type that is saved by a registered converter as a
+// single string property rather than being flattened.
+type testMoney struct {
+	Units    int64
+	Currency string
+}
+
+func init() {
+	RegisterConverter(reflect.TypeOf(testMoney{}),
+		func(v interface{}) (Property, error) {
+			m := v.(testMoney)
+			if m.Currency == "" {
+				return Property{}, errors.New("missing currency")
+			}
+			return Property{Value: fmt.Sprintf("%d %s", m.Units, m.Currency), NoIndex: m.Units == 0}, nil
+		},
+		func(p Property, dst interface{}) error {
+			s, ok := p.Value.(string)
+			if !ok {
+				return fmt.Errorf("cannot load %T into testMoney", p.Value)
+			}
+			m := dst.(*testMoney)
+			_, err := fmt.Sscanf(s, "%d %s", &m.Units, &m.Currency)
+			return err
+		})
+}
+
+func TestRegisterConverter(t *testing.T) {
+	type Order struct {
+		Total   testMoney
+		Refunds []testMoney `datastore:",noindex"`
+	}
+	src := &Order{
+		Total:   testMoney{1250, "USD"},
+		Refunds: []testMoney{{0, "USD"}, {300, "EUR"}},
+	}
+	e, err := saveEntity(testKey0, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Property{
+		{Name: "Total", Value: "1250 USD"},
+		{Name: "Refunds", Value: "0 USD", NoIndex: true, Multiple: true},
+		{Name: "Refunds", Value: "300 EUR", NoIndex: true, Multiple: true},
+	}
+	if got := protoToProperties(e); !reflect.DeepEqual(got, want) {
+		t.Errorf("save: got %v, want %v", got, want)
+	}
+
+	var dst Order
+	if err := loadEntity(&dst, e); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&dst, src) {
+		t.Errorf("load: got %+v, want %+v", dst, src)
+	}
+
+	if _, err := saveEntity(testKey0, &Order{}); err == nil || !strings.Contains(err.Error(), "missing currency") {
+		t.Errorf("save with converter error: got %v", err)
+	}
+	e.Property[0].Value = &pb.Value{IntegerValue: proto.Int64(5)}
+	if err := loadEntity(&Order{}, e); err == nil || !strings.Contains(err.Error(), "cannot load int64") {
+		t.Errorf("load with converter error: got %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a duplicate converter did not panic")
+		}
+	}()
+	RegisterConverter(reflect.TypeOf(testMoney{}), func(interface{}) (Property, error) { return Property{}, nil }, func(Property, interface{}) error { return nil })
+}
+
+func TestEstimateIndexWrites(t *testing.T) {
+	type Post struct {
+		Title   string
+		Tags    []string
+		Body    string    `datastore:",noindex"`
+		Updated time.Time `datastore:",autonow"`
+	}
+	p := &Post{Title: "Hello", Tags: []string{"a", "b", "c"}, Body: "World"}
+	client := &Client{}
+	// 2 for the entity, plus 2 for each of Title, Updated and the three Tags.
+	n, err := client.EstimateIndexWrites(testKey0, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 12 {
+		t.Errorf("got %d writes, want 12", n)
+	}
+	if !p.Updated.IsZero() {
+		t.Errorf("got Updated %v, want src to be unmodified", p.Updated)
+	}
+
+	pl := PropertyList{{Name: "A", Value: int64(1)}, {Name: "B", Value: "x", NoIndex: true}}
+	if n, err := client.EstimateIndexWrites(testKey0, &pl); err != nil || n != 4 {
+		t.Errorf("PropertyList: got %d writes and error %v, want 4", n, err)
+	}
+	if _, err := client.EstimateIndexWrites(nil, p); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("nil key: got error %v, want ErrInvalidKey", err)
+	}
+
+	// The Client's options apply: properties its IndexFunc rejects are not
+	// counted, and with DefaultNoIndex only the entity is.
+	indexed := &Client{}
+	IndexFunc(func(name string) bool { return name != "Tags" }).applyClient(indexed)
+	if n, err := indexed.EstimateIndexWrites(testKey0, p); err != nil || n != 6 {
+		t.Errorf("IndexFunc: got %d writes and error %v, want 6", n, err)
+	}
+	DefaultNoIndex().applyClient(client)
+	if n, err := client.EstimateIndexWrites(testKey0, p); err != nil || n != 2 {
+		t.Errorf("DefaultNoIndex: got %d writes and error %v, want 2", n, err)
+	}
+}
+
+func TestGetMultiAppend(t *testing.T) {
+	ctx := context.Background()
+	k1, k2, k3 := NewKey(ctx, "Gopher", "a", 0, nil), NewKey(ctx, "Gopher", "b", 0, nil), NewKey(ctx, "Gopher", "c", 0, nil)
+	found := func(k *Key, name string) *pb.EntityResult {
+		return &pb.EntityResult{Entity: &pb.Entity{
+			Key: keyToProto(k),
+			Property: []*pb.Property{
+				{Name: proto.String("Name"), Value: &pb.Value{StringValue: proto.String(name)}},
+			},
+		}}
+	}
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			*resp.(*pb.LookupResponse) = pb.LookupResponse{
+				// Found entities may be returned in any order.
+				Found:   []*pb.EntityResult{found(k3, "Charlie"), found(k1, "Alice")},
+				Missing: []*pb.EntityResult{{Entity: &pb.Entity{Key: keyToProto(k2)}}},
+			}
+			return nil
+		}),
+	}
+
+	dst := []*Gopher{{Name: "Existing"}}
+	if err := client.GetMulti(ctx, []*Key{k1, k2, k3}, &dst); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, g := range dst {
+		got = append(got, g.Name)
+	}
+	if want := []string{"Existing", "Alice", "Charlie"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got names %q, want %q", got, want)
+	}
+}
+
+// testPoint is saved in its binary form, since it implements
+// encoding.BinaryMarshaler and encoding.BinaryUnmarshaler.
+type testPoint struct {
+	X, Y byte
+}
+
+func (p testPoint) MarshalBinary() ([]byte, error) {
+	return []byte{p.X, p.Y}, nil
+}
+
+func (p *testPoint) UnmarshalBinary(b []byte) error {
+	if len(b) != 2 {
+		return fmt.Errorf("bad testPoint length %d", len(b))
+	}
+	p.X, p.Y = b[0], b[1]
+	return nil
+}
+
+// testName implements encoding.BinaryMarshaler but, being a string type, is
+// saved as a string.
+type testName string
+
+func (n testName) MarshalBinary() ([]byte, error) { return nil, errors.New("unexpected call") }
+func (n *testName) UnmarshalBinary([]byte) error  { return errors.New("unexpected call") }
+
+func TestBinaryMarshaler(t *testing.T) {
+	type Shape struct {
+		Name   testName
+		Origin testPoint
+		Path   []testPoint `datastore:",noindex"`
+	}
+	src := &Shape{Name: "line", Origin: testPoint{1, 2}, Path: []testPoint{{3, 4}, {5, 6}}}
+	e, err := saveEntity(testKey0, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Property{
+		{Name: "Name", Value: "line"},
+		{Name: "Origin", Value: []byte{1, 2}},
+		{Name: "Path", Value: []byte{3, 4}, NoIndex: true, Multiple: true},
+		{Name: "Path", Value: []byte{5, 6}, NoIndex: true, Multiple: true},
+	}
+	if got := protoToProperties(e); !reflect.DeepEqual(got, want) {
+		t.Errorf("save: got %v, want %v", got, want)
+	}
+	var dst Shape
+	if err := loadEntity(&dst, e); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&dst, src) {
+		t.Errorf("load: got %+v, want %+v", dst, src)
+	}
+
+	e.Property[1].Value = &pb.Value{BlobValue: []byte{1}}
+	if err := loadEntity(&Shape{}, e); err == nil || !strings.Contains(err.Error(), "bad testPoint length") {
+		t.Errorf("load with unmarshal error: got %v", err)
+	}
+}
+
+func TestUnsupportedFieldTypes(t *testing.T) {
+	testCases := []struct {
+		src  interface{}
+		want string
+	}{
+		{&struct{ C chan int }{}, `unsupported struct field type chan int in field "C"`},
+		{&struct{ F func() }{}, `unsupported struct field type func() in field "F"`},
+		{&struct{ X complex128 }{}, `unsupported struct field type complex128 in field "X"`},
+		{&struct{ P unsafe.Pointer }{}, `unsupported struct field type unsafe.Pointer in field "P"`},
+		{&struct{ M map[string]int }{}, `unsupported struct field type map[string]int in field "M"`},
+		{&struct{ S []chan int }{[]chan int{nil}}, `unsupported struct field type chan int in field "S"`},
+		{&struct{ I struct{ C chan int } }{}, `unsupported struct field type chan int in field "I.C"`},
+	}
+	for _, tc := range testCases {
+		_, err := saveEntity(testKey0, tc.src)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%T: got error %v, want %q", tc.src, err, tc.want)
+		}
+	}
+}
+
+func TestSliceOfStructs(t *testing.T) {
+	type LineItem struct {
+		SKU   string
+		Price float64
+		Note  []byte
+	}
+	type Order struct {
+		ID    int64
+		Items []LineItem
+	}
+	for _, src := range []*Order{
+		{ID: 1, Items: []LineItem{{"a", 1.5, nil}, {"b", 2, []byte("gift")}, {"", 0, nil}}},
+		{ID: 2, Items: nil},
+	} {
+		e, err := saveEntity(testKey0, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dst Order
+		if err := loadEntity(&dst, e); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(&dst, src) {
+			t.Errorf("got %+v, want %+v", dst, src)
+		}
+	}
+}
+
+func TestNestedStructs(t *testing.T) {
+	type Point struct {
+		Lat, Lng float64
+	}
+	type Geo struct {
+		Point Point
+		Label string
+	}
+	type Address struct {
+		City string
+		Geo  Geo
+		Raw  []byte
+	}
+	type Person struct {
+		Addrs []Address
+		Home  struct{ Addr Address }
+		Work  struct{ Addrs []Address }
+	}
+
+	// Round trips through every combination of nested and repeated structs.
+	a := Address{"a", Geo{Point{1, 2}, "x"}, nil}
+	b := Address{"b", Geo{Point{3, 4}, ""}, []byte("raw")}
+	srcs := []*Person{{}, {Addrs: []Address{a, b}}}
+	p := &Person{Addrs: []Address{b}}
+	p.Home.Addr = a
+	p.Work.Addrs = []Address{a, {}, b}
+	srcs = append(srcs, p)
+	for _, src := range srcs {
+		e, err := saveEntity(testKey0, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dst Person
+		if err := loadEntity(&dst, e); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(&dst, src) {
+			t.Errorf("got %+v, want %+v", dst, src)
+		}
+	}
+	props, err := SaveStruct(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range props {
+		if len(names) == 0 || names[len(names)-1] != p.Name {
+			names = append(names, p.Name)
+		}
+	}
+	if want := "Addrs.Geo.Point.Lat"; !strings.Contains(strings.Join(names, " "), want) {
+		t.Errorf("got property names %q, want one named %q", names, want)
+	}
+
+	// Embedded entity values, as written by other client libraries, load
+	// as if they had been saved flattened.
+	str := func(s string) *pb.Value { return &pb.Value{StringValue: proto.String(s)} }
+	dbl := func(f float64) *pb.Value { return &pb.Value{DoubleValue: proto.Float64(f)} }
+	entity := func(props ...*pb.Property) *pb.Value { return &pb.Value{EntityValue: &pb.Entity{Property: props}} }
+	prop := func(name string, v *pb.Value) *pb.Property { return &pb.Property{Name: proto.String(name), Value: v} }
+	geo := entity(prop("Point", entity(prop("Lat", dbl(1)), prop("Lng", dbl(2)))), prop("Label", str("x")))
+	e := &pb.Entity{Property: []*pb.Property{
+		prop("Addrs", &pb.Value{ListValue: []*pb.Value{
+			entity(prop("City", str("a")), prop("Geo", geo)),
+			entity(prop("City", str("b"))),
+			entity(prop("Geo", geo), prop("City", str("c"))),
+		}}),
+		prop("Home", entity(prop("Addr", entity(prop("City", str("h")), prop("Geo", geo))))),
+	}}
+	var dst Person
+	if err := loadEntity(&dst, e); err != nil {
+		t.Fatal(err)
+	}
+	want := Person{Addrs: []Address{{City: "a", Geo: a.Geo}, {City: "b"}, {City: "c", Geo: a.Geo}}}
+	want.Home.Addr = Address{City: "h", Geo: a.Geo}
+	if !reflect.DeepEqual(dst, want) {
+		t.Errorf("embedded entities: got %+v, want %+v", dst, want)
+	}
+
+	// Struct types that cannot be flattened, and unsupported leaf types,
+	// are reported with the path to the field.
+	for _, tc := range []struct {
+		src  interface{}
+		want string
+	}{
+		{&RecursiveNested{}, `recursive struct: field "R"`},
+		{&struct {
+			A []struct{ B struct{ C []int } }
+		}{}, `slice of slices: field "A"`},
+		{&struct {
+			A struct {
+				B []struct{ C struct{ D []int } }
+			}
+		}{}, `slice of slices: field "B"`},
+		{&struct {
+			A []struct{ B struct{ C chan int } }
+		}{A: make([]struct{ B struct{ C chan int } }, 1)}, `unsupported struct field type chan int in field "A.B.C"`},
+		{&struct{ A []*Address }{A: []*Address{{}}}, `unsupported struct field type *datastore.Address in field "A"`},
+	} {
+		_, err := saveEntity(testKey0, tc.src)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%T: got error %v, want %q", tc.src, err, tc.want)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	type Timing struct {
+		D  time.Duration
+		Ds []time.Duration
+	}
+	src := &Timing{
+		D:  -90 * time.Second,
+		Ds: []time.Duration{0, time.Nanosecond, -time.Hour, 1<<63 - 1},
+	}
+	e, err := saveEntity(testKey0, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := protoToProperties(e)[0].Value; got != int64(-90e9) {
+		t.Errorf("got value %v, want %d nanoseconds", got, int64(-90e9))
+	}
+	var dst Timing
+	if err := loadEntity(&dst, e); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&dst, src) {
+		t.Errorf("got %+v, want %+v", dst, src)
+	}
+}
+
+func TestRoundOption(t *testing.T) {
+	type Product struct {
+		Price  float64   `datastore:",round=2"`
+		Weight float32   `datastore:",round=0"`
+		Scores []float64 `datastore:",round=1"`
+		Huge   float64   `datastore:",round=2"`
+	}
+	src := &Product{Price: 3.14159, Weight: -2.5, Scores: []float64{0.25, 9.96}, Huge: 1e308}
+	props, err := SaveStruct(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Property{
+		{Name: "Price", Value: 3.14},
+		{Name: "Weight", Value: -3.0},
+		{Name: "Scores", Value: 0.3, Multiple: true},
+		{Name: "Scores", Value: 10.0, Multiple: true},
+		{Name: "Huge", Value: 1e308},
+	}
+	if !reflect.DeepEqual(props, want) {
+		t.Errorf("got %v, want %v", props, want)
+	}
+	if src.Price != 3.14159 || src.Scores[0] != 0.25 {
+		t.Errorf("saving modified the struct: %+v", src)
+	}
+
+	for _, bad := range []interface{}{
+		&struct {
+			N int `datastore:",round=2"`
+		}{},
+		&struct {
+			F float64 `datastore:",round=-1"`
+		}{},
+		&struct {
+			F float64 `datastore:",round=x"`
+		}{},
+	} {
+		if _, err := SaveStruct(bad); err == nil {
+			t.Errorf("%T: got nil error", bad)
+		}
+	}
+}
+
+func TestRequiredOption(t *testing.T) {
+	type Address struct {
+		City string `datastore:",required"`
+	}
+	type Account struct {
+		Email   string    `datastore:",required"`
+		Bio     string    `datastore:",required,noindex"`
+		Tags    []string  `datastore:",required"`
+		Created time.Time `datastore:",required"`
+		Home    Address
+		Note    string
+	}
+	valid := func() *Account {
+		return &Account{
+			Email:   "gopher@example.com",
+			Bio:     "b",
+			Tags:    []string{"t"},
+			Created: time.Unix(1e9, 0),
+			Home:    Address{City: "Sydney"},
+		}
+	}
+	if _, err := SaveStruct(valid()); err != nil {
+		t.Fatalf("all required fields set: %v", err)
+	}
+	for _, tc := range []struct {
+		name  string
+		clear func(*Account)
+	}{
+		{"Email", func(a *Account) { a.Email = "" }},
+		{"Bio", func(a *Account) { a.Bio = "" }},
+		{"Tags", func(a *Account) { a.Tags = []string{} }},
+		{"Created", func(a *Account) { a.Created = time.Time{} }},
+		{"Home.City", func(a *Account) { a.Home.City = "" }},
+	} {
+		a := valid()
+		tc.clear(a)
+		_, err := SaveStruct(a)
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("%q", tc.name)) {
+			t.Errorf("empty %s: got error %v, want one naming the field", tc.name, err)
+		}
+		if _, err := saveEntity(testKey0, a); err == nil {
+			t.Errorf("empty %s: saveEntity got nil error", tc.name)
+		}
+	}
+}
+
+func TestURLFields(t *testing.T) {
+	type Bookmark struct {
+		Home  url.URL
+		Link  *url.URL
+		None  *url.URL
+		Links []*url.URL
+	}
+	parse := func(s string) *url.URL {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	src := &Bookmark{
+		Home:  *parse("https://golang.org/"),
+		Link:  parse("https://example.com/a?b=c#d"),
+		Links: []*url.URL{parse("/relative"), parse("mailto:gopher@example.com")},
+	}
+	props, err := SaveStruct(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Property{
+		{Name: "Home", Value: "https://golang.org/"},
+		{Name: "Link", Value: "https://example.com/a?b=c#d"},
+		{Name: "None"},
+		{Name: "Links", Value: "/relative", Multiple: true},
+		{Name: "Links", Value: "mailto:gopher@example.com", Multiple: true},
+	}
+	if !reflect.DeepEqual(props, want) {
+		t.Errorf("got %v, want %v", props, want)
+	}
+	var dst Bookmark
+	if err := LoadStruct(&dst, props); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&dst, src) {
+		t.Errorf("got %+v, want %+v", dst, src)
+	}
+
+	// An unparsable URL fails to load, without a panic, and the other
+	// fields are still loaded.
+	dst = Bookmark{}
+	err = LoadStruct(&dst, []Property{
+		{Name: "Link", Value: "%zz"},
+		{Name: "Home", Value: "https://golang.org/"},
+	})
+	if e, ok := err.(*ErrFieldMismatch); !ok || e.FieldName != "Link" {
+		t.Errorf("unparsable URL: got error %v, want a field mismatch for Link", err)
+	}
+	if dst.Home.Host != "golang.org" {
+		t.Errorf("unparsable URL: got %+v, want Home loaded", dst)
+	}
+}
+
+func TestPropertyListCopy(t *testing.T) {
+	l := PropertyList{
+		{Name: "Name", Value: "George"},
+		{Name: "Data", Value: []byte("abc"), NoIndex: true},
+		{Name: "Parent", Value: testKey1a},
+	}
+	c := l.Copy()
+	if !reflect.DeepEqual(c, l) {
+		t.Fatalf("got %v, want %v", c, l)
+	}
+	c[0].Value = "Rufus"
+	c[1].Value.([]byte)[0] = 'x'
+	if l[0].Value != "George" || string(l[1].Value.([]byte)) != "abc" {
+		t.Errorf("modifying the copy modified the original: %v", l)
+	}
+	if PropertyList(nil).Copy() != nil {
+		t.Error("copy of a nil list is not nil")
+	}
+}
+
+func TestInterfaceFields(t *testing.T) {
+	type Dynamic struct {
+		Int, Float, Str, Time, Key, Blob, Nil interface{}
+		List                                  []interface{}
+	}
+	now := time.Unix(1e9, 0)
+	src := &Dynamic{
+		Int:   7,
+		Float: float32(1.5),
+		Str:   "s",
+		Time:  now,
+		Key:   testKey1a,
+		Blob:  []byte("b"),
+		List:  []interface{}{int64(1), "two", true},
+	}
+	e, err := saveEntity(testKey0, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dst Dynamic
+	if err := loadEntity(&dst, e); err != nil {
+		t.Fatal(err)
+	}
+	want := &Dynamic{
+		Int:   int64(7),
+		Float: float64(1.5),
+		Str:   "s",
+		Time:  now,
+		Key:   testKey1a,
+		Blob:  []byte("b"),
+		List:  []interface{}{int64(1), "two", true},
+	}
+	if !reflect.DeepEqual(&dst, want) {
+		t.Errorf("got %+v, want %+v", dst, want)
+	}
+
+	if _, err := saveEntity(testKey0, &struct{ I interface{} }{[]string{"a"}}); err == nil {
+		t.Error("saving a slice in an interface{} field: got nil error")
+	}
+	e, err = saveEntity(testKey0, &struct{ I interface{} }{"x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s struct{ I fmt.Stringer }
+	if err := loadEntity(&s, e); err == nil {
+		t.Error("loading into a non-empty interface field: got nil error")
+	}
+}
+
+func TestJSONRawMessage(t *testing.T) {
+	type Section struct {
+		Title string
+		Doc   json.RawMessage
+	}
+	type Page struct {
+		Doc      json.RawMessage
+		Docs     []json.RawMessage
+		Sections []Section
+	}
+	// The documents' formatting must survive the round trip.
+	doc := json.RawMessage(`{ "b": 1,  "a": [2, 3] }`)
+	src := &Page{
+		Doc:      doc,
+		Docs:     []json.RawMessage{json.RawMessage(`[]`), json.RawMessage(`"x"`)},
+		Sections: []Section{{Title: "intro", Doc: json.RawMessage(`null`)}},
+	}
+	e, err := saveEntity(testKey0, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := protoToProperties(e)[0]; got.Name != "Doc" || !reflect.DeepEqual(got.Value, []byte(doc)) {
+		t.Errorf("save: got property %v, want a blob of %s", got, doc)
+	}
+	var dst Page
+	if err := loadEntity(&dst, e); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&dst, src) {
+		t.Errorf("load: got %+v, want %+v", dst, src)
+	}
+}
+
+func TestSQLNullTypes(t *testing.T) {
+	type Row struct {
+		Name   sql.NullString
+		Age    sql.NullInt64
+		Score  sql.NullFloat64
+		Active sql.NullBool
+		Tags   []sql.NullString
+	}
+	src := &Row{
+		Name:  sql.NullString{String: "George", Valid: true},
+		Age:   sql.NullInt64{},
+		Score: sql.NullFloat64{Float64: 2.5, Valid: true},
+		Tags:  []sql.NullString{{String: "a", Valid: true}, {}},
+	}
+	e, err := saveEntity(testKey0, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Property{
+		{Name: "Name", Value: "George"},
+		{Name: "Age", Value: nil},
+		{Name: "Score", Value: 2.5},
+		{Name: "Active", Value: nil},
+		{Name: "Tags", Value: "a", Multiple: true},
+		{Name: "Tags", Value: nil, Multiple: true},
+	}
+	if got := protoToProperties(e); !reflect.DeepEqual(got, want) {
+		t.Errorf("save: got %v, want %v", got, want)
+	}
+	var dst Row
+	if err := loadEntity(&dst, e); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&dst, src) {
+		t.Errorf("load: got %+v, want %+v", dst, src)
+	}
+
+	// A missing property leaves the field invalid.
+	var partial Row
+	if err := LoadStruct(&partial, []Property{{Name: "Age", Value: int64(7)}}); err != nil {
+		t.Fatal(err)
+	}
+	if partial.Name.Valid || !partial.Age.Valid || partial.Age.Int64 != 7 {
+		t.Errorf("partial load: got %+v", partial)
+	}
+}
+
+func TestPutMultiMixedKeys(t *testing.T) {
+	ctx := context.Background()
+	var commit *pb.CommitRequest
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			commit = req.(*pb.CommitRequest)
+			r := &pb.MutationResult{}
+			for i := range commit.Mutation.InsertAutoId {
+				r.InsertAutoIdKey = append(r.InsertAutoIdKey, keyToProto(NewKey(ctx, "Gopher", "", int64(100+i), nil)))
+			}
+			resp.(*pb.CommitResponse).MutationResult = r
+			return nil
+		}),
+	}
+	keys := []*Key{
+		NewIncompleteKey(ctx, "Gopher", nil),
+		NewKey(ctx, "Gopher", "george", 0, nil),
+		NewIncompleteKey(ctx, "Gopher", nil),
+		NewKey(ctx, "Gopher", "", 7, nil),
+		NewIncompleteKey(ctx, "Gopher", nil),
+	}
+	src := make([]*Gopher, len(keys))
+	for i := range src {
+		src[i] = &Gopher{Name: fmt.Sprint(i)}
+	}
+	got, err := client.PutMulti(ctx, keys, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := commit.Mutation
+	if len(m.Upsert) != 2 || len(m.InsertAutoId) != 3 {
+		t.Fatalf("got %d upserts and %d inserts, want 2 and 3", len(m.Upsert), len(m.InsertAutoId))
+	}
+	if len(got) != len(keys) {
+		t.Fatalf("got %d keys, want %d", len(got), len(keys))
+	}
+	want := []*Key{
+		NewKey(ctx, "Gopher", "", 100, nil),
+		keys[1],
+		NewKey(ctx, "Gopher", "", 101, nil),
+		keys[3],
+		NewKey(ctx, "Gopher", "", 102, nil),
+	}
+	for i := range want {
+		if !got[i].Equal(want[i]) {
+			t.Errorf("key %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPutChanged(t *testing.T) {
+	ctx := context.Background()
+	stored := make(map[string]*pb.Entity)
+	var commits [][]*pb.Entity
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			switch resp := resp.(type) {
+			case *pb.LookupResponse:
+				for _, k := range req.(*pb.LookupRequest).Key {
+					if e, ok := stored[protoToKey(k).String()]; ok {
+						resp.Found = append(resp.Found, &pb.EntityResult{Entity: e})
+					} else {
+						resp.Missing = append(resp.Missing, &pb.EntityResult{Entity: &pb.Entity{Key: k}})
+					}
+				}
+			case *pb.CommitResponse:
+				upsert := req.(*pb.CommitRequest).Mutation.Upsert
+				commits = append(commits, upsert)
+				for _, e := range upsert {
+					stored[protoToKey(e.Key).String()] = e
+				}
+				resp.MutationResult = &pb.MutationResult{}
+			}
+			return nil
+		}),
+	}
+	keys := []*Key{
+		NewKey(ctx, "Gopher", "george", 0, nil),
+		NewKey(ctx, "Gopher", "rufus", 0, nil),
+		NewKey(ctx, "Gopher", "bob", 0, nil),
+	}
+	// George is stored unchanged, with his properties in another order,
+	// Rufus is stored with another height, and Bob is not stored.
+	stored[keys[0].String()] = &pb.Entity{Key: keyToProto(keys[0]), Property: []*pb.Property{
+		{Name: proto.String("Height"), Value: &pb.Value{IntegerValue: proto.Int64(10)}},
+		{Name: proto.String("Name"), Value: &pb.Value{StringValue: proto.String("George")}},
+	}}
+	stored[keys[1].String()] = &pb.Entity{Key: keyToProto(keys[1]), Property: []*pb.Property{
+		{Name: proto.String("Name"), Value: &pb.Value{StringValue: proto.String("Rufus")}},
+		{Name: proto.String("Height"), Value: &pb.Value{IntegerValue: proto.Int64(1)}},
+	}}
+	src := []Gopher{{"George", 10}, {"Rufus", 2}, {"Bob", 3}}
+	skipped, err := client.PutChanged(ctx, keys, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 1 {
+		t.Errorf("got %d skipped, want 1", skipped)
+	}
+	if len(commits) != 1 || len(commits[0]) != 2 || !protoToKey(commits[0][0].Key).Equal(keys[1]) || !protoToKey(commits[0][1].Key).Equal(keys[2]) {
+		t.Fatalf("got commits %v, want one of Rufus and Bob", commits)
+	}
+
+	// Once written, nothing has changed.
+	commits = nil
+	if skipped, err := client.PutChanged(ctx, keys, src); err != nil || skipped != 3 {
+		t.Errorf("unchanged: got %d skipped, error %v; want 3 skipped", skipped, err)
+	}
+	if commits != nil {
+		t.Errorf("unchanged: got commits %v, want none", commits)
+	}
+
+	if _, err := client.PutChanged(ctx, []*Key{NewIncompleteKey(ctx, "Gopher", nil)}, src[:1]); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("incomplete key: got error %v, want ErrInvalidKey", err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	n := 2*maxMutations + 10
+	keys := make([]*Key, n)
+	src := make([]*Gopher, n)
+	for i := range keys {
+		keys[i] = NewKey(ctx, "Gopher", "", int64(i+1), nil)
+		src[i] = &Gopher{}
+	}
+	newClient := func(failChunks ...int) (*Client, *int) {
+		var nCommit int
+		return &Client{
+			client: fakeClient(func(req, resp proto.Message) error {
+				chunk := nCommit
+				nCommit++
+				for _, c := range failChunks {
+					if c == chunk {
+						return fmt.Errorf("chunk %d failed", chunk)
+					}
+				}
+				resp.(*pb.CommitResponse).MutationResult = &pb.MutationResult{}
+				return nil
+			}),
+		}, &nCommit
+	}
+
+	client, nCommit := newClient()
+	got, err := client.Import(ctx, keys, src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *nCommit != 3 || !reflect.DeepEqual(got, keys) {
+		t.Errorf("got %d commits and %d keys, want 3 commits and %d keys", *nCommit, len(got), n)
+	}
+
+	client, nCommit = newClient(1)
+	got, err = client.Import(ctx, keys, src, false)
+	want := ImportError{{Start: maxMutations, End: 2 * maxMutations, Err: errors.New("chunk 1 failed")}}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("strict: got error %v, want %v", err, want)
+	}
+	if *nCommit != 2 || got[0] == nil || got[maxMutations] != nil || got[n-1] != nil {
+		t.Errorf("strict: got %d commits, want to stop after the failed second chunk", *nCommit)
+	}
+
+	client, nCommit = newClient(0, 2)
+	got, err = client.Import(ctx, keys, src, true)
+	want = ImportError{
+		{Start: 0, End: maxMutations, Err: errors.New("chunk 0 failed")},
+		{Start: 2 * maxMutations, End: n, Err: errors.New("chunk 2 failed")},
+	}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("best effort: got error %v, want %v", err, want)
+	}
+	if *nCommit != 3 || got[0] != nil || got[maxMutations] == nil || got[n-1] != nil {
+		t.Errorf("best effort: got %d commits, want all 3 chunks attempted", *nCommit)
+	}
+	if s := err.Error(); !strings.Contains(s, "[0, 500): chunk 0 failed") || !strings.Contains(s, "[1000, 1010): chunk 2 failed") {
+		t.Errorf("best effort: got error string %q", s)
+	}
+}
+
+// checkedGopher computes a derived field and checks an invariant after it is
+// loaded.
+type checkedGopher struct {
+	Name   string
+	Height int64
+	Tall   bool `datastore:"-"`
+}
+
+func (g *checkedGopher) AfterLoad() error {
+	if g.Height < 0 {
+		return fmt.Errorf("gopher %q has negative height", g.Name)
+	}
+	g.Tall = g.Height > 10
+	return nil
+}
+
+func TestImportRetry(t *testing.T) {
+	defer func(d time.Duration) { chunkRetryDelay = d }(chunkRetryDelay)
+	chunkRetryDelay = time.Millisecond
+	ctx := context.Background()
+	n := 2*maxMutations + 10
+	keys := make([]*Key, n)
+	src := make([]*Gopher, n)
+	for i := range keys {
+		keys[i] = NewKey(ctx, "Gopher", "", int64(i+1), nil)
+		src[i] = &Gopher{}
+	}
+	unavailable := &transport.ErrHTTP{StatusCode: http.StatusServiceUnavailable}
+	// The first chunk is flaky, failing twice before succeeding, and the
+	// last one always fails.
+	attempts := make(map[int64]int)
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			first := req.(*pb.CommitRequest).Mutation.Upsert[0].Key.PathElement[0].GetId()
+			attempts[first]++
+			switch {
+			case first == 1 && attempts[first] <= 2, first == 2*maxMutations+1:
+				return unavailable
+			}
+			resp.(*pb.CommitResponse).MutationResult = &pb.MutationResult{}
+			return nil
+		}),
+	}
+	got, err := client.Import(ctx, keys, src, true)
+	want := ImportError{{Start: 2 * maxMutations, End: n, Err: unavailable}}
+	if !reflect.DeepEqual(err, want) {
+		t.Errorf("got error %v, want %v", err, want)
+	}
+	wantAttempts := map[int64]int{1: 3, maxMutations + 1: 1, 2*maxMutations + 1: maxChunkAttempts}
+	if !reflect.DeepEqual(attempts, wantAttempts) {
+		t.Errorf("got attempts by chunk %v, want %v", attempts, wantAttempts)
+	}
+	if got[0] == nil || got[maxMutations] == nil || got[n-1] != nil {
+		t.Errorf("got keys %v, %v, %v; want only the last chunk unwritten", got[0], got[maxMutations], got[n-1])
+	}
+
+	// A chunk with an incomplete key may have been committed, so it is not
+	// retried.
+	attempts = make(map[int64]int)
+	firstKeys := []*Key{keys[0], NewIncompleteKey(ctx, "Gopher", nil)}
+	if _, err := client.Import(ctx, firstKeys, src[:2], false); err == nil || attempts[1] != 1 {
+		t.Errorf("incomplete key: got error %v after %d attempts, want an error after 1", err, attempts[1])
+	}
+}
+
+func TestRetryChunkBudget(t *testing.T) {
+	defer func(d time.Duration) { chunkRetryDelay = d }(chunkRetryDelay)
+	chunkRetryDelay = 40 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	unavailable := &transport.ErrHTTP{StatusCode: http.StatusServiceUnavailable}
+	var attempts int
+	start := time.Now()
+	err := retryChunk(ctx, func() error {
+		attempts++
+		return unavailable
+	})
+	// The second retry would wait 80ms more, past the deadline, so
+	// retryChunk gives up after the first one instead of waiting it out.
+	if attempts != 2 {
+		t.Errorf("got %d attempts, want 2", attempts)
+	}
+	if d := time.Since(start); d >= 100*time.Millisecond {
+		t.Errorf("gave up after %v, want before the deadline", d)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, unavailable) {
+		t.Errorf("got error %v, want %v wrapping %v", err, context.DeadlineExceeded, unavailable)
+	}
+}
+
+func TestPutResultIndexUpdates(t *testing.T) {
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			switch resp := resp.(type) {
+			case *pb.BeginTransactionResponse:
+				resp.Transaction = []byte("tx")
+			case *pb.CommitResponse:
+				// Each entity updates two indexes.
+				m := req.(*pb.CommitRequest).Mutation
+				resp.MutationResult = &pb.MutationResult{IndexUpdates: proto.Int32(int32(2 * len(m.Upsert)))}
+			}
+			return nil
+		}),
+	}
+	ctx := context.Background()
+	keys := make([]*Key, maxMutations+10)
+	src := make([]*Gopher, len(keys))
+	for i := range keys {
+		keys[i] = NewKey(ctx, "Gopher", "", int64(i+1), nil)
+		src[i] = &Gopher{}
+	}
+	res, err := client.ImportResult(ctx, keys, src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 2 * len(keys); res.IndexUpdates != want || !reflect.DeepEqual(res.Keys, keys) {
+		t.Errorf("ImportResult: got %d index updates and %d keys, want %d and %d", res.IndexUpdates, len(res.Keys), want, len(keys))
+	}
+	res, err = client.PutMultiResult(ctx, keys[:3], src[:3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.IndexUpdates != 6 || len(res.Keys) != 3 {
+		t.Errorf("PutMultiResult: got %d index updates and %d keys, want 6 and 3", res.IndexUpdates, len(res.Keys))
+	}
+
+	cmt, err := client.RunInTransaction(ctx, func(tx *Transaction) error {
+		_, err := tx.PutMulti(keys[:5], src[:5])
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmt.IndexUpdates() != 10 {
+		t.Errorf("transaction: got %d index updates, want 10", cmt.IndexUpdates())
+	}
+}
+
+func TestAfterLoad(t *testing.T) {
+	ctx := context.Background()
+	k1, k2 := NewKey(ctx, "Gopher", "a", 0, nil), NewKey(ctx, "Gopher", "b", 0, nil)
+	entity := func(k *Key, height int64) *pb.EntityResult {
+		return &pb.EntityResult{Entity: &pb.Entity{
+			Key: keyToProto(k),
+			Property: []*pb.Property{
+				{Name: proto.String("Name"), Value: &pb.Value{StringValue: proto.String(k.Name())}},
+				{Name: proto.String("Height"), Value: &pb.Value{IntegerValue: proto.Int64(height)}},
+			},
+		}}
+	}
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			resp.(*pb.LookupResponse).Found = []*pb.EntityResult{entity(k1, 12), entity(k2, -1)}
+			return nil
+		}),
+	}
+	dst := make([]checkedGopher, 2)
+	err := client.GetMulti(ctx, []*Key{k1, k2}, dst)
+	me, ok := err.(MultiError)
+	if !ok {
+		t.Fatalf("got error %v, want a MultiError", err)
+	}
+	if me[0] != nil || !dst[0].Tall {
+		t.Errorf("got %v and %+v for the valid entity, want no error and Tall", me[0], dst[0])
+	}
+	if me[1] == nil || !strings.Contains(me[1].Error(), "negative height") {
+		t.Errorf("got error %v for the invalid entity, want negative height", me[1])
+	}
+}
+
+// normalizedGopher trims its name and requires it to be set before it is
+// saved.
+type normalizedGopher struct {
+	Name string
+}
+
+func (g *normalizedGopher) BeforeSave() error {
+	g.Name = strings.TrimSpace(g.Name)
+	if g.Name == "" {
+		return errors.New("name is required")
+	}
+	return nil
+}
+
+func TestBeforeSave(t *testing.T) {
+	ctx := context.Background()
+	var nCall int
+	var saved string
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			nCall++
+			saved = req.(*pb.CommitRequest).Mutation.Upsert[0].Property[0].Value.GetStringValue()
+			resp.(*pb.CommitResponse).MutationResult = &pb.MutationResult{}
+			return nil
+		}),
+	}
+	key := NewKey(ctx, "Gopher", "", 1, nil)
+	if _, err := client.Put(ctx, key, &normalizedGopher{Name: "  George "}); err != nil {
+		t.Fatal(err)
+	}
+	if saved != "George" {
+		t.Errorf("got saved name %q, want %q", saved, "George")
+	}
+	nCall = 0
+	_, err := client.PutMulti(ctx, []*Key{key, key}, []*normalizedGopher{{Name: "Rufus"}, {Name: " "}})
+	if err == nil || err.Error() != "name is required" {
+		t.Errorf("got error %v, want name is required", err)
+	}
+	if nCall != 0 {
+		t.Errorf("got %d calls after BeforeSave failed, want 0", nCall)
+	}
+}
+
+func TestGetMultiHeterogeneous(t *testing.T) {
+	ctx := context.Background()
+	gk, pk := NewKey(ctx, "Gopher", "george", 0, nil), NewKey(ctx, "Post", "", 1, nil)
+	str := func(s string) *pb.Value { return &pb.Value{StringValue: proto.String(s)} }
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			resp.(*pb.LookupResponse).Found = []*pb.EntityResult{
+				{Entity: &pb.Entity{Key: keyToProto(pk), Property: []*pb.Property{
+					{Name: proto.String("Title"), Value: str("Hello")},
+					{Name: proto.String("Comments"), Value: &pb.Value{IntegerValue: proto.Int64(3)}},
+				}}},
+				{Entity: &pb.Entity{Key: keyToProto(gk), Property: []*pb.Property{
+					{Name: proto.String("Name"), Value: str("George")},
+				}}},
+			}
+			return nil
+		}),
+	}
+	type Post struct {
+		Title    string
+		Comments int
+	}
+	g, p := &Gopher{}, &Post{}
+	if err := client.GetMulti(ctx, []*Key{gk, pk}, []interface{}{g, p}); err != nil {
+		t.Fatal(err)
+	}
+	if g.Name != "George" {
+		t.Errorf("got gopher %+v, want Name George", g)
+	}
+	if p.Title != "Hello" || p.Comments != 3 {
+		t.Errorf("got post %+v, want Title Hello and 3 comments", p)
+	}
+}
+
+// keyedGopher records the key it was saved with.
+type keyedGopher struct {
+	Name string
+	Key  *Key `datastore:"-"`
+}
+
+func (g *keyedGopher) SetKey(k *Key) { g.Key = k }
+
+func TestPutMultiAutoIDKeys(t *testing.T) {
+	ctx := context.Background()
+	var autoIDKeys func(inserts []*pb.Entity) []*pb.Key
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			inserts := req.(*pb.CommitRequest).Mutation.InsertAutoId
+			if keys := autoIDKeys(inserts); keys != nil {
+				resp.(*pb.CommitResponse).MutationResult = &pb.MutationResult{InsertAutoIdKey: keys}
+			}
+			return nil
+		}),
+	}
+	// allocate returns keys for inserts with IDs from 101.
+	allocate := func(inserts []*pb.Entity) []*pb.Key {
+		var keys []*pb.Key
+		for i, e := range inserts {
+			k := protoToKey(e.Key)
+			keys = append(keys, keyToProto(NewKey(ctx, k.Kind(), "", int64(101+i), k.Parent())))
+		}
+		return keys
+	}
+	parent := NewKey(ctx, "Blog", "b", 0, nil)
+	keys := []*Key{
+		NewKey(ctx, "Gopher", "george", 0, nil),
+		NewIncompleteKey(ctx, "Gopher", nil),
+		NewKey(ctx, "Post", "", 7, parent),
+		NewIncompleteKey(ctx, "Post", parent),
+		NewIncompleteKey(ctx, "Gopher", nil),
+	}
+	src := make([]Gopher, len(keys))
+	autoIDKeys = allocate
+	got, err := client.PutMulti(ctx, keys, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Key{
+		keys[0],
+		NewKey(ctx, "Gopher", "", 101, nil),
+		keys[2],
+		NewKey(ctx, "Post", "", 102, parent),
+		NewKey(ctx, "Gopher", "", 103, nil),
+	}
+	for i := range want {
+		if !got[i].Equal(want[i]) {
+			t.Errorf("key %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	// Without incomplete keys, the response need not have a mutation
+	// result.
+	autoIDKeys = func([]*pb.Entity) []*pb.Key { return nil }
+	if _, err := client.PutMulti(ctx, keys[:1], src[:1]); err != nil {
+		t.Errorf("complete keys only: %v", err)
+	}
+	if _, err := client.PutMulti(ctx, keys, src); err == nil {
+		t.Error("no keys returned: got nil error")
+	}
+	autoIDKeys = func(inserts []*pb.Entity) []*pb.Key {
+		keys := allocate(inserts)
+		keys[0], keys[1] = keys[1], keys[0]
+		return keys
+	}
+	if _, err := client.PutMulti(ctx, keys, src); err == nil {
+		t.Error("keys of the wrong kinds returned: got nil error")
+	}
+}
+
+func TestKeySetter(t *testing.T) {
+	ctx := context.Background()
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			var ids []*pb.Key
+			for i := range req.(*pb.CommitRequest).Mutation.InsertAutoId {
+				ids = append(ids, keyToProto(NewKey(ctx, "Gopher", "", int64(100+i), nil)))
+			}
+			resp.(*pb.CommitResponse).MutationResult = &pb.MutationResult{InsertAutoIdKey: ids}
+			return nil
+		}),
+	}
+
+	g := &keyedGopher{Name: "George"}
+	if _, err := client.Put(ctx, NewIncompleteKey(ctx, "Gopher", nil), g); err != nil {
+		t.Fatal(err)
+	}
+	if g.Key == nil || g.Key.ID() != 100 {
+		t.Errorf("Put: got key %v, want ID 100", g.Key)
+	}
+
+	complete := NewKey(ctx, "Gopher", "rufus", 0, nil)
+	gs := []keyedGopher{{Name: "Rufus"}, {Name: "Bob"}}
+	if _, err := client.PutMulti(ctx, []*Key{complete, NewIncompleteKey(ctx, "Gopher", nil)}, gs); err != nil {
+		t.Fatal(err)
+	}
+	if !gs[0].Key.Equal(complete) || gs[1].Key == nil || gs[1].Key.ID() != 100 {
+		t.Errorf("PutMulti: got keys %v and %v, want %v and ID 100", gs[0].Key, gs[1].Key, complete)
+	}
+}
+
+// snakeCase maps a name like "CreatedAt" to "created_at".
+func snakeCase(name string) string {
+	var b bytes.Buffer
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func TestFieldNameTransform(t *testing.T) {
+	type Inner struct {
+		FooBar string
+	}
+	type Record struct {
+		CreatedAt int64
+		UserID    string `datastore:"uid"`
+		Inner     Inner
+	}
+	snake := &Client{}
+	FieldNameTransform(snakeCase).applyClient(snake)
+	plain := &Client{}
+	key := NewKey(context.Background(), "Record", "r", 0, nil)
+	names := func(c *Client) []string {
+		props, err := c.saveProperties(key, &Record{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, p := range props {
+			names = append(names, p.Name)
+		}
+		return names
+	}
+	if got, want := names(snake), []string{"created_at", "uid", "inner.foo_bar"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with transform: got property names %q, want %q", got, want)
+	}
+	// The codec built for snake does not leak into a Client without the
+	// option, nor into the package functions.
+	if got, want := names(plain), []string{"CreatedAt", "uid", "Inner.FooBar"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("without transform: got property names %q, want %q", got, want)
+	}
+	if props, err := SaveStruct(&Record{}); err != nil || props[0].Name != "CreatedAt" {
+		t.Errorf("SaveStruct: got %v, %v, want CreatedAt first", props, err)
+	}
+
+	src := &Record{CreatedAt: 7, UserID: "u", Inner: Inner{"x"}}
+	e, err := snake.saveEntity(key, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dst Record
+	if err := snake.loadEntity(&dst, e); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&dst, src) {
+		t.Errorf("got %+v, want %+v", dst, src)
+	}
+
+	// The codecs built with the transform are cached with snake's naming,
+	// not in the shared cache, so they are freed with the Client.
+	structCodecsMutex.Lock()
+	cached := len(snake.naming.codecs)
+	for _, c := range structCodecs {
+		if c.naming == snake.naming {
+			t.Error("codec built with a transform is in the shared cache")
+		}
+	}
+	structCodecsMutex.Unlock()
+	if cached == 0 {
+		t.Error("no codec cached with the transform")
+	}
+
+	bad := &Client{}
+	FieldNameTransform(func(string) string { return "" }).applyClient(bad)
+	if _, err := bad.saveEntity(key, src); err == nil {
+		t.Error("transform to an empty name: got nil error")
+	}
+}
+
+func TestUseJSONTags(t *testing.T) {
+	type Inner struct {
+		City string `json:"city"`
+	}
+	type Record struct {
+		ID      string `json:"id,omitempty"`
+		Secret  string `json:"-"`
+		Email   string `json:",omitempty"`
+		Name    string `json:"name" datastore:"full_name"`
+		Note    string `json:"note" datastore:""`
+		Address Inner  `json:"addr"`
+	}
+	src := &Record{ID: "1", Secret: "s", Email: "e", Name: "n", Note: "x", Address: Inner{"c"}}
+	tagged := &Client{}
+	UseJSONTags().applyClient(tagged)
+	plain := &Client{}
+	key := NewKey(context.Background(), "Record", "r", 0, nil)
+	names := func(c *Client) []string {
+		props, err := c.saveProperties(key, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, p := range props {
+			names = append(names, p.Name)
+		}
+		return names
+	}
+	if got, want := names(tagged), []string{"id", "Email", "full_name", "Note", "addr.city"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with json tags: got property names %q, want %q", got, want)
+	}
+	if got, want := names(plain), []string{"ID", "Secret", "Email", "full_name", "Note", "Address.City"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("without json tags: got property names %q, want %q", got, want)
+	}
+	// Clients that only use json tags share their codecs.
+	other := &Client{}
+	UseJSONTags().applyClient(other)
+	c1, err1 := getStructCodec(reflect.TypeOf(Record{}), tagged.naming)
+	c2, err2 := getStructCodec(reflect.TypeOf(Record{}), other.naming)
+	if err1 != nil || err2 != nil || c1 != c2 {
+		t.Errorf("two Clients using json tags: got codecs %p and %p (%v, %v), want one", c1, c2, err1, err2)
+	}
+	e, err := tagged.saveEntity(key, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dst Record
+	if err := tagged.loadEntity(&dst, e); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Record{ID: "1", Email: "e", Name: "n", Note: "x", Address: Inner{"c"}}); dst != want {
+		t.Errorf("got %+v, want %+v", dst, want)
+	}
+}
+
+func TestDefaultValues(t *testing.T) {
+	type Stats struct {
+		Views int `datastore:",default=-1"`
+	}
+	type Post struct {
+		Title  string  `datastore:",default=untitled"`
+		Score  float64 `datastore:"score,noindex,default=2.5"`
+		Public bool    `datastore:",default=true"`
+		Count  int8
+		Stats  Stats
+	}
+	var got Post
+	if err := LoadStruct(&got, []Property{{Name: "score", Value: 1.0}, {Name: "Count", Value: int64(3)}}); err != nil {
+		t.Fatal(err)
+	}
+	want := Post{Title: "untitled", Score: 1, Public: true, Count: 3, Stats: Stats{Views: -1}}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	got = Post{}
+	if err := LoadStruct(&got, []Property{{Name: "Public", Value: false}, {Name: "Stats.Views", Value: int64(7)}}); err != nil {
+		t.Fatal(err)
+	}
+	want = Post{Title: "untitled", Score: 2.5, Stats: Stats{Views: 7}}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	type BadDefault struct {
+		N int `datastore:",default=many"`
+	}
+	type UnsupportedDefault struct {
+		T time.Time `datastore:",default=now"`
+	}
+	for _, dst := range []interface{}{&BadDefault{}, &UnsupportedDefault{}} {
+		if err := LoadStruct(dst, nil); err == nil || !strings.Contains(err.Error(), "invalid default") {
+			t.Errorf("%T: got error %v, want an invalid default error", dst, err)
+		}
+	}
+}
+
+func TestParseAPIError(t *testing.T) {
+	body := `{"error": {
+		"code": 400,
+		"status": "FAILED_PRECONDITION",
+		"message": "no matching index found.",
+		"details": [
+			{"@type": "type.googleapis.com/google.rpc.PreconditionFailure", "violations": [{
+				"type": "INDEX",
+				"subject": "Gopher",
+				"description": "The suggested index for this query is:\n- kind: Gopher\n  properties:\n  - name: Name\n  - name: Height\n    direction: desc\n"
+			}]},
+			{"@type": "type.googleapis.com/google.rpc.QuotaFailure", "violations": [{"subject": "entity-reads", "description": "exceeded"}]},
+			{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "1.5s"},
+			{"@type": "type.googleapis.com/google.rpc.DebugInfo", "detail": "x"}
+		]
+	}}`
+	err := fmt.Errorf("wrapped: %w", &transport.ErrHTTP{StatusCode: http.StatusBadRequest, Body: []byte(body)})
+	e, ok := ParseAPIError(err)
+	if !ok {
+		t.Fatalf("ParseAPIError(%v) reported false", err)
+	}
+	if e.StatusCode != http.StatusBadRequest || e.Status != "FAILED_PRECONDITION" || e.Message != "no matching index found." {
+		t.Errorf("got status %d %q, message %q", e.StatusCode, e.Status, e.Message)
+	}
+	if len(e.Details) != 4 {
+		t.Fatalf("got %d details, want 4", len(e.Details))
+	}
+	if pf, ok := e.Details[0].(*PreconditionFailure); !ok || len(pf.Violations) != 1 || pf.Violations[0].Type != "INDEX" {
+		t.Errorf("detail 0: got %+v, want a PreconditionFailure", e.Details[0])
+	}
+	if qf, ok := e.Details[1].(*QuotaFailure); !ok || len(qf.Violations) != 1 || qf.Violations[0].Subject != "entity-reads" {
+		t.Errorf("detail 1: got %+v, want a QuotaFailure", e.Details[1])
+	}
+	if ri, ok := e.Details[2].(*RetryInfo); !ok || ri.RetryDelay != 1500*time.Millisecond {
+		t.Errorf("detail 2: got %+v, want a RetryInfo", e.Details[2])
+	}
+	if u, ok := e.Details[3].(*UnknownDetail); !ok || u.Type != "type.googleapis.com/google.rpc.DebugInfo" {
+		t.Errorf("detail 3: got %+v, want an UnknownDetail", e.Details[3])
+	}
+	want := "- kind: Gopher\n  properties:\n  - name: Name\n  - name: Height\n    direction: desc\n"
+	if got := e.SuggestedIndex(); got != want {
+		t.Errorf("got suggested index %q, want %q", got, want)
+	}
+
+	// An unstructured body is the message.
+	e, ok = ParseAPIError(&transport.ErrHTTP{StatusCode: http.StatusConflict, Body: []byte("too much contention\n")})
+	if !ok || e.Message != "too much contention" || e.Details != nil || e.SuggestedIndex() != "" {
+		t.Errorf("unstructured body: got %+v, %v", e, ok)
+	}
+	if _, ok := ParseAPIError(errors.New("not an API error")); ok {
+		t.Error("other error: got true")
+	}
+}
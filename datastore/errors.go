@@ -17,7 +17,14 @@
 package datastore
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/cloud/internal/transport"
 )
 
 // MultiError is returned by batch operations when there are errors with
@@ -45,3 +52,213 @@ func (m MultiError) Error() string {
 	}
 	return fmt.Sprintf("%s (and %d other errors)", s, n-1)
 }
+
+// ChunkError records the failure of one chunk of an Import: the keys in the
+// range [Start, End) were not written.
+type ChunkError struct {
+	Start, End int
+	Err        error
+}
+
+// ImportError is returned by Import when some of its chunks fail. It lists
+// the failed chunks in order.
+type ImportError []ChunkError
+
+func (e ImportError) Error() string {
+	if len(e) == 1 {
+		return fmt.Sprintf("datastore: import of entities [%d, %d) failed: %v", e[0].Start, e[0].End, e[0].Err)
+	}
+	s := fmt.Sprintf("datastore: import of %d chunks failed:", len(e))
+	for _, c := range e {
+		s += fmt.Sprintf(" [%d, %d): %v;", c.Start, c.End, c.Err)
+	}
+	return s[:len(s)-1]
+}
+
+// isTransient reports whether err is a response of the datastore that a
+// later attempt may not get: a throttled request, or an internal or
+// unavailable server.
+func isTransient(err error) bool {
+	e, ok := err.(*transport.ErrHTTP)
+	if !ok {
+		return false
+	}
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// APIError describes an error response of the datastore API, as parsed by
+// ParseAPIError.
+type APIError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Status is the canonical error code, such as "FAILED_PRECONDITION",
+	// if the response gave one.
+	Status string
+	// Message is the error message. If the response was not a structured
+	// error, it is the whole response body.
+	Message string
+	// Details holds the typed details of the error, in the order of the
+	// response: *ErrorInfo, *QuotaFailure, *PreconditionFailure, *BadRequest,
+	// *RetryInfo, or *UnknownDetail for details of other types.
+	Details []interface{}
+}
+
+func (e *APIError) Error() string {
+	if e.Status != "" {
+		return fmt.Sprintf("datastore: API error %d (%s): %s", e.StatusCode, e.Status, e.Message)
+	}
+	return fmt.Sprintf("datastore: API error %d: %s", e.StatusCode, e.Message)
+}
+
+// ErrorInfo is an error detail giving the reason for the error.
+type ErrorInfo struct {
+	Reason   string            `json:"reason"`
+	Domain   string            `json:"domain"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// QuotaFailure is an error detail listing the quotas that were exceeded.
+type QuotaFailure struct {
+	Violations []struct {
+		// Subject is the quota that was exceeded, such as a quota metric.
+		Subject     string `json:"subject"`
+		Description string `json:"description"`
+	} `json:"violations"`
+}
+
+// PreconditionFailure is an error detail listing the preconditions of the
+// request that were not met, such as the composite index a query needs.
+type PreconditionFailure struct {
+	Violations []struct {
+		Type        string `json:"type"`
+		Subject     string `json:"subject"`
+		Description string `json:"description"`
+	} `json:"violations"`
+}
+
+// BadRequest is an error detail listing the invalid fields of the request.
+type BadRequest struct {
+	FieldViolations []struct {
+		Field       string `json:"field"`
+		Description string `json:"description"`
+	} `json:"fieldViolations"`
+}
+
+// RetryInfo is an error detail giving how long to wait before retrying.
+type RetryInfo struct {
+	RetryDelay time.Duration
+}
+
+// UnknownDetail is an error detail of a type not known to this package.
+type UnknownDetail struct {
+	// Type is the detail's type URL.
+	Type string
+	// JSON is the JSON encoding of the detail.
+	JSON []byte
+}
+
+// ParseAPIError returns a description of err if it is an error response of
+// the datastore API, as returned by the Client's methods. It reports false
+// if err is not such an error.
+func ParseAPIError(err error) (*APIError, bool) {
+	var e *transport.ErrHTTP
+	if !errors.As(err, &e) {
+		return nil, false
+	}
+	a := &APIError{StatusCode: e.StatusCode, Message: strings.TrimSpace(string(e.Body))}
+	var body struct {
+		Error *struct {
+			Message string            `json:"message"`
+			Status  string            `json:"status"`
+			Details []json.RawMessage `json:"details"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(e.Body, &body) != nil || body.Error == nil {
+		return a, true
+	}
+	a.Message, a.Status = body.Error.Message, body.Error.Status
+	for _, raw := range body.Error.Details {
+		a.Details = append(a.Details, parseErrorDetail(raw))
+	}
+	return a, true
+}
+
+// parseErrorDetail returns the typed value of the error detail raw, or an
+// *UnknownDetail if its type is unknown or it is invalid.
+func parseErrorDetail(raw json.RawMessage) interface{} {
+	var typ struct {
+		Type string `json:"@type"`
+	}
+	json.Unmarshal(raw, &typ)
+	unknown := &UnknownDetail{Type: typ.Type, JSON: raw}
+	var d interface{}
+	switch strings.TrimPrefix(typ.Type, "type.googleapis.com/") {
+	case "google.rpc.ErrorInfo":
+		d = &ErrorInfo{}
+	case "google.rpc.QuotaFailure":
+		d = &QuotaFailure{}
+	case "google.rpc.PreconditionFailure":
+		d = &PreconditionFailure{}
+	case "google.rpc.BadRequest":
+		d = &BadRequest{}
+	case "google.rpc.RetryInfo":
+		// The delay is encoded as a duration string, such as "1.5s".
+		var ri struct {
+			RetryDelay string `json:"retryDelay"`
+		}
+		if json.Unmarshal(raw, &ri) != nil {
+			return unknown
+		}
+		delay, err := time.ParseDuration(ri.RetryDelay)
+		if err != nil {
+			return unknown
+		}
+		return &RetryInfo{RetryDelay: delay}
+	default:
+		return unknown
+	}
+	if json.Unmarshal(raw, d) != nil {
+		return unknown
+	}
+	return d
+}
+
+// SuggestedIndex returns the definition of the composite index suggested by
+// the datastore for a query that failed for lack of one, as an entry of the
+// indexes list of an index.yaml file, or "" if the error suggests none. The
+// definition is taken from the error's message or from a PreconditionFailure
+// detail, where it begins with a "- kind:" line:
+//
+//	indexes:
+//	- kind: Gopher
+//	  properties:
+//	  - name: Name
+//	  - name: Height
+//	    direction: desc
+func (e *APIError) SuggestedIndex() string {
+	texts := []string{e.Message}
+	for _, d := range e.Details {
+		if pf, ok := d.(*PreconditionFailure); ok {
+			for _, v := range pf.Violations {
+				texts = append(texts, v.Description)
+			}
+		}
+	}
+	for _, s := range texts {
+		i := strings.Index(s, "- kind:")
+		if i < 0 {
+			continue
+		}
+		if j := strings.LastIndex(s[:i], "\n"); strings.TrimSpace(s[j+1:i]) != "" {
+			// "- kind:" is not at the start of a line.
+			continue
+		}
+		return strings.TrimRight(s[i:], "\n ") + "\n"
+	}
+	return ""
+}
@@ -15,8 +15,11 @@
 package datastore_test
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"time"
 
 	"golang.org/x/net/context"
@@ -52,6 +55,41 @@ func Example_auth() *datastore.Client {
 	return client
 }
 
+// This example points a Client at a stub server, so that tests can run
+// without credentials or a connection to the datastore. The stub answers in
+// JSON, which is easier to write by hand than protocol buffers.
+func Example_httptest() {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Calls are POSTed to the endpoint followed by "<project ID>/<method>".
+		if r.URL.Path != "/my-project/lookup" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"found": [{"entity": {
+			"key": {"pathElement": [{"kind": "Gopher", "name": "george"}]},
+			"property": [{"name": "Name", "value": {"stringValue": "George"}}]
+		}}]}`)
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	client, err := datastore.NewClient(ctx, "my-project",
+		cloud.WithEndpoint(ts.URL+"/"),
+		cloud.WithBaseHTTP(http.DefaultClient),
+		cloud.WithJSONEncoding(),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var g struct{ Name string }
+	if err := client.Get(ctx, datastore.NewKey(ctx, "Gopher", "george", 0, nil), &g); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(g.Name)
+	// Output: George
+}
+
 func ExampleGet() {
 	ctx := context.Background()
 	client, err := datastore.NewClient(ctx, "project-id")
@@ -210,6 +248,59 @@ func ExampleQuery() {
 	datastore.NewQuery("Post").Offset(20).Limit(10)
 }
 
+func ExampleQuery_Filter() {
+	ctx := context.Background()
+	client, err := datastore.NewClient(ctx, "project-id")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Build a query from conditions chosen at run time. The filters are
+	// AND'ed together.
+	conds := []struct {
+		filter string
+		value  interface{}
+	}{
+		{"Comments >=", 10},
+		{"Comments <", 100},
+	}
+	q := datastore.NewQuery("Post")
+	for _, c := range conds {
+		q = q.Filter(c.filter, c.value)
+	}
+	var posts []Post
+	if _, err := client.GetAll(ctx, q, &posts); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func ExampleIterator_Next() {
+	ctx := context.Background()
+	client, err := datastore.NewClient(ctx, "project-id")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	type Post struct {
+		Title    string
+		Comments int
+	}
+
+	// Process every post without loading all of them into memory at once.
+	it := client.Run(ctx, datastore.NewQuery("Post"))
+	for {
+		var p Post
+		key, err := it.Next(&p)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%v: %q has %d comments", key, p.Title, p.Comments)
+	}
+}
+
 func ExampleTransaction() {
 	ctx := context.Background()
 	client, err := datastore.NewClient(ctx, "project-id")
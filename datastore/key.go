@@ -16,9 +16,12 @@ package datastore
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/gob"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 
@@ -60,6 +63,9 @@ func (k *Key) SetParent(v *Key) {
 	k.parent = v
 }
 
+// Namespace returns the namespace of the key, which is empty for the default
+// namespace. Encode and DecodeKey preserve it, as do the gob and JSON
+// encodings of the key.
 func (k *Key) Namespace() string {
 	return k.namespace
 }
@@ -71,26 +77,114 @@ func (k *Key) Incomplete() bool {
 
 // valid returns whether the key is valid.
 func (k *Key) valid() bool {
+	return k.invalidReason() == 0
+}
+
+// invalidReason returns why the key is invalid, or 0 if it is valid.
+func (k *Key) invalidReason() InvalidKeyReason {
 	if k == nil {
-		return false
+		return KeyNil
 	}
 	for ; k != nil; k = k.parent {
 		if k.kind == "" {
-			return false
+			return KeyNoKind
 		}
 		if k.name != "" && k.id != 0 {
-			return false
+			return KeyNameAndID
 		}
 		if k.parent != nil {
 			if k.parent.Incomplete() {
-				return false
+				return KeyIncompleteParent
 			}
 			if k.parent.namespace != k.namespace {
-				return false
+				return KeyNamespaceMismatch
 			}
 		}
 	}
-	return true
+	return 0
+}
+
+// check returns an *InvalidKeyError if the key is invalid, or if it is
+// incomplete and complete is true, and nil otherwise.
+func (k *Key) check(complete bool) error {
+	if r := k.invalidReason(); r != 0 {
+		return &InvalidKeyError{Key: k, Reason: r}
+	}
+	if complete && k.Incomplete() {
+		return &InvalidKeyError{Key: k, Reason: KeyIncomplete}
+	}
+	return nil
+}
+
+// InvalidKeyReason is the reason an InvalidKeyError reports a key as invalid.
+type InvalidKeyReason int
+
+const (
+	// KeyNil is the reason for a nil key.
+	KeyNil InvalidKeyReason = iota + 1
+	// KeyNoKind is the reason for a key, or an ancestor, with an empty kind.
+	KeyNoKind
+	// KeyNameAndID is the reason for a key, or an ancestor, with both a name
+	// and a numeric ID.
+	KeyNameAndID
+	// KeyIncompleteParent is the reason for a key with an incomplete
+	// ancestor.
+	KeyIncompleteParent
+	// KeyNamespaceMismatch is the reason for a key with an ancestor in a
+	// different namespace.
+	KeyNamespaceMismatch
+	// KeyIncomplete is the reason for an incomplete key where a complete
+	// key is required, as when deleting.
+	KeyIncomplete
+	// KeyEmptyID is the reason for an empty string ID passed to
+	// KeyFromStringID.
+	KeyEmptyID
+)
+
+var invalidKeyReasons = map[InvalidKeyReason]string{
+	KeyNil:               "nil key",
+	KeyNoKind:            "empty kind",
+	KeyNameAndID:         "both a name and an ID",
+	KeyIncompleteParent:  "incomplete parent",
+	KeyNamespaceMismatch: "parent in a different namespace",
+	KeyIncomplete:        "incomplete key",
+	KeyEmptyID:           "empty string ID",
+}
+
+func (r InvalidKeyReason) String() string {
+	if s, ok := invalidKeyReasons[r]; ok {
+		return s
+	}
+	return "InvalidKeyReason(" + strconv.Itoa(int(r)) + ")"
+}
+
+// InvalidKeyError is returned when an invalid key is presented. It records
+// the key, which is nil if there was none, and why it is invalid, so that
+// callers can categorize failures:
+//
+//	var e *datastore.InvalidKeyError
+//	if errors.As(err, &e) && e.Reason == datastore.KeyIncomplete {
+//		// Handle the incomplete key e.Key.
+//	}
+//
+// An InvalidKeyError matches ErrInvalidKey with errors.Is. Get, GetMulti, Put
+// and PutMulti still report invalid keys with ErrInvalidKey itself, so that
+// callers comparing their errors to it with == keep working.
+type InvalidKeyError struct {
+	Key    *Key
+	Reason InvalidKeyReason
+}
+
+func (e *InvalidKeyError) Error() string {
+	if e.Key == nil {
+		return "datastore: invalid key: " + e.Reason.String()
+	}
+	return fmt.Sprintf("datastore: invalid key %v: %v", e.Key, e.Reason)
+}
+
+// Is reports whether target is ErrInvalidKey.
+func (e *InvalidKeyError) Is(target error) bool {
+	return target == ErrInvalidKey
 }
 
 func (k *Key) Equal(o *Key) bool {
@@ -235,6 +329,9 @@ func DecodeKey(encoded string) (*Key, error) {
 	if err := proto.Unmarshal(b, pKey); err != nil {
 		return nil, err
 	}
+	if len(pKey.PathElement) == 0 {
+		return nil, errors.New("datastore: encoded key has no path")
+	}
 
 	return protoToKey(pKey), nil
 }
@@ -245,6 +342,63 @@ func NewIncompleteKey(ctx context.Context, kind string, parent *Key) *Key {
 	return NewKey(ctx, kind, "", 0, parent)
 }
 
+// NameKey creates a new key with a name, in the namespace of parent, or in
+// the default namespace if parent is nil. It and IDKey and IncompleteKey
+// have the signatures of the key constructors of the cloud.google.com/go
+// datastore package, which take no context, to ease migrating to it; a
+// Client created with InNamespace uses keys in the default namespace as if
+// they were in its namespace. kind cannot be empty.
+func NameKey(kind, name string, parent *Key) *Key {
+	return &Key{kind: kind, name: name, parent: parent, namespace: parentNamespace(parent)}
+}
+
+// IDKey creates a new key with a numeric ID, in the namespace of parent, or
+// in the default namespace if parent is nil. kind cannot be empty.
+func IDKey(kind string, id int64, parent *Key) *Key {
+	return &Key{kind: kind, id: id, parent: parent, namespace: parentNamespace(parent)}
+}
+
+// IncompleteKey creates a new incomplete key, in the namespace of parent, or
+// in the default namespace if parent is nil. kind cannot be empty.
+func IncompleteKey(kind string, parent *Key) *Key {
+	return &Key{kind: kind, parent: parent, namespace: parentNamespace(parent)}
+}
+
+// parentNamespace returns the namespace of parent, or "" if it is nil.
+func parentNamespace(parent *Key) string {
+	if parent == nil {
+		return ""
+	}
+	return parent.namespace
+}
+
+// NewUUIDKey creates a new complete key whose name is a random (version 4)
+// UUID generated on the client, such as
+// "f47ac10b-58cc-4372-a567-0e02b3c479d8". kind cannot be empty.
+//
+// Unlike an incomplete key, whose ID the datastore allocates anew on every
+// Put, a key named on the client identifies the same entity each time it is
+// used. Generating the key once, before the first attempt, makes a Put safe
+// to retry after a timeout or other ambiguous failure: a retry that follows a
+// write which did succeed overwrites the entity with the same data, instead
+// of creating a duplicate.
+//
+//	key := datastore.NewUUIDKey(ctx, "Order", nil)
+//	if _, err := client.Put(ctx, key, &order); err != nil {
+//		// The write may or may not have been applied; retrying
+//		// client.Put(ctx, key, &order) is safe either way.
+//	}
+func NewUUIDKey(ctx context.Context, kind string, parent *Key) *Key {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		panic("datastore: reading random bytes for a UUID: " + err.Error())
+	}
+	u[6] = u[6]&0x0f | 0x40 // Version 4.
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant.
+	h := hex.EncodeToString(u[:])
+	return NewKey(ctx, kind, h[:8]+"-"+h[8:12]+"-"+h[12:16]+"-"+h[16:20]+"-"+h[20:], 0, parent)
+}
+
 // NewKey creates a new key.
 // kind cannot be empty.
 // Either one or both of stringID and intID must be zero. If both are zero,
@@ -260,6 +414,38 @@ func NewKey(ctx context.Context, kind, name string, id int64, parent *Key) *Key
 	}
 }
 
+// StringID returns a compact string identifying k among the keys of the same
+// kind and parent, such as for use as a path segment in a URL: k's name, or
+// its ID in decimal if it has no name. It is the empty string for an
+// incomplete key. Unlike Encode, it does not include k's kind, parent or
+// namespace, which must be known to map it back to k with KeyFromStringID.
+//
+// Names made only of decimal digits cannot be told apart from IDs, so
+// StringID is only a faithful representation of keys whose kind never uses
+// such names.
+func (k *Key) StringID() string {
+	if k.name != "" || k.id == 0 {
+		return k.name
+	}
+	return strconv.FormatInt(k.id, 10)
+}
+
+// KeyFromStringID returns the key of the given kind and parent that has the
+// string ID id, as returned by Key.StringID, in the namespace of ctx. id is
+// parsed as a numeric ID if it is a positive decimal integer without leading
+// zeros, and is otherwise the key's name. For a key with a parent, the string
+// ID only identifies it among its parent's children, so the same parent must
+// be given to recover it.
+func KeyFromStringID(ctx context.Context, kind, id string, parent *Key) (*Key, error) {
+	if id == "" {
+		return nil, &InvalidKeyError{Reason: KeyEmptyID}
+	}
+	if n, err := strconv.ParseInt(id, 10, 64); err == nil && n > 0 && id[0] != '0' && id[0] != '+' {
+		return NewKey(ctx, kind, "", n, parent), nil
+	}
+	return NewKey(ctx, kind, id, 0, parent), nil
+}
+
 // AllocateIDs accepts a slice of incomplete keys and returns a
 // slice of complete keys that are guaranteed to be valid in the datastore
 func (c *Client) AllocateIDs(ctx context.Context, keys []*Key) ([]*Key, error) {
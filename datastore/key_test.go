@@ -18,8 +18,11 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
+	"regexp"
 	"testing"
 
+	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
 )
 
@@ -122,6 +125,29 @@ func TestEqual(t *testing.T) {
 	}
 }
 
+func TestDecodeKeyNamespace(t *testing.T) {
+	for _, ns := range []string{"", "gopherspace"} {
+		ctx := WithNamespace(context.Background(), ns)
+		parent := NewKey(ctx, "Gopher", "george", 0, nil)
+		want := NewKey(ctx, "Post", "", 7, parent)
+		got, err := DecodeKey(want.Encode())
+		if err != nil {
+			t.Fatalf("namespace %q: %v", ns, err)
+		}
+		if !got.Equal(want) {
+			t.Errorf("namespace %q: got %v, want %v", ns, got, want)
+		}
+		for k := got; k != nil; k = k.Parent() {
+			if k.Namespace() != ns {
+				t.Errorf("namespace %q: key %v has namespace %q", ns, k, k.Namespace())
+			}
+		}
+	}
+	if _, err := DecodeKey(""); err == nil {
+		t.Error("empty encoding: got nil error")
+	}
+}
+
 func TestEncoding(t *testing.T) {
 	c := context.Background()
 	cN := WithNamespace(c, "gopherspace")
@@ -221,3 +247,176 @@ func TestEncoding(t *testing.T) {
 		}
 	}
 }
+
+func TestMixedAncestorRoundTrip(t *testing.T) {
+	c := WithNamespace(context.Background(), "gopherspace")
+	k := NewKey(c, "Country", "gb", 0, nil)
+	k = NewKey(c, "City", "", 42, k)
+	k = NewKey(c, "Street", "1", 0, k) // A name that looks like an ID.
+	k = NewKey(c, "House", "", 1, k)   // An ID that looks like the name above.
+	k = NewKey(c, "Room", "kitchen", 0, k)
+
+	if got := protoToKey(keyToProto(k)); !got.Equal(k) {
+		t.Errorf("proto round trip: got %v, want %v", got, k)
+	}
+	for p, want := protoToKey(keyToProto(k)), k; want != nil; p, want = p.Parent(), want.Parent() {
+		if p.ID() != want.ID() || p.Name() != want.Name() {
+			t.Errorf("%s: got id %d and name %q, want id %d and name %q", want.Kind(), p.ID(), p.Name(), want.ID(), want.Name())
+		}
+	}
+
+	src := &struct{ K *Key }{K: k}
+	e, err := saveEntity(testKey0, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := &struct{ K *Key }{}
+	if err := loadEntity(dst, e); err != nil {
+		t.Fatal(err)
+	}
+	if !dst.K.Equal(k) {
+		t.Errorf("property round trip: got %v, want %v", dst.K, k)
+	}
+}
+
+func TestStringID(t *testing.T) {
+	ctx := WithNamespace(context.Background(), "gopherspace")
+	parent := NewKey(ctx, "Burrow", "home", 0, nil)
+	for _, k := range []*Key{
+		NewKey(ctx, "Gopher", "george", 0, nil),
+		NewKey(ctx, "Gopher", "", 42, nil),
+		NewKey(ctx, "Gopher", "007x", 0, parent),
+		NewKey(ctx, "Gopher", "", 1<<62, parent),
+	} {
+		got, err := KeyFromStringID(ctx, k.Kind(), k.StringID(), k.Parent())
+		if err != nil {
+			t.Errorf("%v: %v", k, err)
+			continue
+		}
+		if !got.Equal(k) {
+			t.Errorf("KeyFromStringID(%q) = %v, want %v", k.StringID(), got, k)
+		}
+	}
+
+	for id, want := range map[string]*Key{
+		"12":  NewKey(ctx, "Gopher", "", 12, nil),
+		"012": NewKey(ctx, "Gopher", "012", 0, nil),
+		"+12": NewKey(ctx, "Gopher", "+12", 0, nil),
+		"-12": NewKey(ctx, "Gopher", "-12", 0, nil),
+		"0":   NewKey(ctx, "Gopher", "0", 0, nil),
+	} {
+		if got, err := KeyFromStringID(ctx, "Gopher", id, nil); err != nil || !got.Equal(want) {
+			t.Errorf("KeyFromStringID(%q) = %v, %v, want %v", id, got, err, want)
+		}
+	}
+	if _, err := KeyFromStringID(ctx, "Gopher", "", nil); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("empty ID: got error %v, want ErrInvalidKey", err)
+	}
+	if got := NewIncompleteKey(ctx, "Gopher", nil).StringID(); got != "" {
+		t.Errorf("incomplete key: got %q, want empty", got)
+	}
+}
+
+func TestInvalidKeyError(t *testing.T) {
+	ctx := context.Background()
+	parent := NewKey(ctx, "Gopher", "george", 0, nil)
+	for _, tc := range []struct {
+		key  *Key
+		want InvalidKeyReason
+	}{
+		{nil, KeyNil},
+		{NewKey(ctx, "", "a", 0, nil), KeyNoKind},
+		{NewKey(ctx, "Gopher", "a", 1, nil), KeyNameAndID},
+		{NewKey(ctx, "Post", "a", 0, NewIncompleteKey(ctx, "Gopher", nil)), KeyIncompleteParent},
+		{NewKey(WithNamespace(ctx, "other"), "Post", "a", 0, parent), KeyNamespaceMismatch},
+		{NewIncompleteKey(ctx, "Post", parent), KeyIncomplete},
+	} {
+		err := tc.key.check(true)
+		var e *InvalidKeyError
+		if !errors.As(err, &e) {
+			t.Errorf("%v: got error %v, want an *InvalidKeyError", tc.key, err)
+			continue
+		}
+		if e.Key != tc.key || e.Reason != tc.want {
+			t.Errorf("%v: got key %v, reason %v; want reason %v", tc.key, e.Key, e.Reason, tc.want)
+		}
+		if !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("%v: error %v does not match ErrInvalidKey", tc.key, err)
+		}
+	}
+	if err := NewIncompleteKey(ctx, "Post", parent).check(false); err != nil {
+		t.Errorf("incomplete key allowed: got error %v", err)
+	}
+	if got, want := NewKey(ctx, "Gopher", "a", 1, nil).check(false).Error(), "datastore: invalid key /Gopher,a: both a name and an ID"; got != want {
+		t.Errorf("got message %q, want %q", got, want)
+	}
+
+	client := &Client{client: fakeClient(func(req, resp proto.Message) error { return nil })}
+	err := client.Delete(ctx, NewIncompleteKey(ctx, "Post", nil))
+	if e, ok := err.(*InvalidKeyError); !ok || e.Reason != KeyIncomplete {
+		t.Errorf("Delete of an incomplete key: got error %v, want an incomplete key error", err)
+	}
+}
+
+func TestInvalidKeySentinel(t *testing.T) {
+	// Get and Put report invalid keys with ErrInvalidKey itself, as they
+	// always have, so comparing their errors with == still works.
+	ctx := context.Background()
+	client := &Client{client: fakeClient(func(req, resp proto.Message) error { return nil })}
+	invalid := NewKey(ctx, "", "a", 0, nil)
+	if err := client.Get(ctx, invalid, &Gopher{}); err != ErrInvalidKey {
+		t.Errorf("Get: got error %v, want ErrInvalidKey", err)
+	}
+	err := client.GetMulti(ctx, []*Key{invalid}, make([]Gopher, 1))
+	if me, ok := err.(MultiError); !ok || me[0] != ErrInvalidKey {
+		t.Errorf("GetMulti: got error %v, want ErrInvalidKey in a MultiError", err)
+	}
+	if _, err := client.Put(ctx, invalid, &Gopher{}); err != ErrInvalidKey {
+		t.Errorf("Put: got error %v, want ErrInvalidKey", err)
+	}
+	_, err = client.PutMulti(ctx, []*Key{invalid}, []Gopher{{}})
+	if me, ok := err.(MultiError); !ok || me[0] != ErrInvalidKey {
+		t.Errorf("PutMulti: got error %v, want ErrInvalidKey in a MultiError", err)
+	}
+}
+
+func TestNewUUIDKey(t *testing.T) {
+	ctx := WithNamespace(context.Background(), "gopherspace")
+	parent := NewKey(ctx, "Customer", "c1", 0, nil)
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		k := NewUUIDKey(ctx, "Order", parent)
+		if !uuid.MatchString(k.Name()) {
+			t.Fatalf("got name %q, want a version 4 UUID", k.Name())
+		}
+		if k.Incomplete() || k.Kind() != "Order" || k.Parent() != parent || k.Namespace() != "gopherspace" {
+			t.Fatalf("got key %v in namespace %q", k, k.Namespace())
+		}
+		if seen[k.Name()] {
+			t.Fatalf("duplicate name %q", k.Name())
+		}
+		seen[k.Name()] = true
+	}
+}
+
+func TestKeyConstructors(t *testing.T) {
+	ctx := context.Background()
+	parent := IDKey("Customer", 7, nil)
+	for _, tc := range []struct {
+		got, want *Key
+	}{
+		{parent, NewKey(ctx, "Customer", "", 7, nil)},
+		{NameKey("Order", "o1", parent), NewKey(ctx, "Order", "o1", 0, parent)},
+		{IncompleteKey("Order", nil), NewIncompleteKey(ctx, "Order", nil)},
+	} {
+		if !tc.got.Equal(tc.want) {
+			t.Errorf("got key %v, want %v", tc.got, tc.want)
+		}
+	}
+	// Keys inherit the namespace of their parent.
+	nsParent := NewKey(WithNamespace(ctx, "gopherspace"), "Customer", "c1", 0, nil)
+	if k := IncompleteKey("Order", nsParent); k.Namespace() != "gopherspace" || !k.Incomplete() {
+		t.Errorf("got key %v in namespace %q, want an incomplete key in gopherspace", k, k.Namespace())
+	}
+}
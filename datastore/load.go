@@ -15,7 +15,10 @@
 package datastore
 
 import (
+	"database/sql"
+	"encoding"
 	"fmt"
+	"math"
 	"reflect"
 	"time"
 
@@ -44,6 +47,8 @@ func typeMismatchReason(p Property, v reflect.Value) string {
 		entityType = "*datastore.Key"
 	case time.Time:
 		entityType = "time.Time"
+	case User:
+		entityType = "datastore.User"
 	case []byte:
 		entityType = "[]byte"
 	}
@@ -98,7 +103,7 @@ func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p P
 	}
 
 	var slice reflect.Value
-	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 && !hasConverter(v.Type()) {
 		slice = v
 		v = reflect.New(v.Type().Elem()).Elem()
 	} else if _, ok := prev[p.Name]; ok && !sliceOk {
@@ -110,10 +115,49 @@ func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p P
 
 	prev[p.Name] = struct{}{}
 
+	if conv, ok := lookupConverter(v.Type()); ok {
+		if err := conv.from(p, v.Addr().Interface()); err != nil {
+			return err.Error()
+		}
+		if slice.IsValid() {
+			slice.Set(reflect.Append(slice, v))
+		}
+		return ""
+	}
+	if sqlValued(v.Type()) {
+		if err := v.Addr().Interface().(sql.Scanner).Scan(p.Value); err != nil {
+			return err.Error()
+		}
+		if slice.IsValid() {
+			slice.Set(reflect.Append(slice, v))
+		}
+		return ""
+	}
+	if binaryMarshaled(v.Type()) {
+		b, ok := p.Value.([]byte)
+		if !ok && p.Value != nil {
+			return typeMismatchReason(p, v)
+		}
+		if err := v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(b); err != nil {
+			return err.Error()
+		}
+		if slice.IsValid() {
+			slice.Set(reflect.Append(slice, v))
+		}
+		return ""
+	}
+
 	pValue := p.Value
 	switch v.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		x, ok := pValue.(int64)
+		if f, isFloat := pValue.(float64); isFloat {
+			// A float is loaded into an integer field only if no precision is lost.
+			if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+				return fmt.Sprintf("value %v cannot be represented by struct field of type %v", f, v.Type())
+			}
+			x, ok = int64(f), true
+		}
 		if !ok && pValue != nil {
 			return typeMismatchReason(p, v)
 		}
@@ -135,6 +179,9 @@ func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p P
 		v.SetString(x)
 	case reflect.Float32, reflect.Float64:
 		x, ok := pValue.(float64)
+		if i, isInt := pValue.(int64); isInt {
+			x, ok = float64(i), true
+		}
 		if !ok && pValue != nil {
 			return typeMismatchReason(p, v)
 		}
@@ -159,6 +206,12 @@ func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p P
 				return typeMismatchReason(p, v)
 			}
 			v.Set(reflect.ValueOf(x))
+		case typeOfUser:
+			x, ok := pValue.(User)
+			if !ok && pValue != nil {
+				return typeMismatchReason(p, v)
+			}
+			v.Set(reflect.ValueOf(x))
 		default:
 			return typeMismatchReason(p, v)
 		}
@@ -171,6 +224,15 @@ func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p P
 			return typeMismatchReason(p, v)
 		}
 		v.SetBytes(x)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return typeMismatchReason(p, v)
+		}
+		if pValue == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(pValue))
+		}
 	default:
 		return typeMismatchReason(p, v)
 	}
@@ -181,12 +243,58 @@ func (l *propertyLoader) load(codec *structCodec, structValue reflect.Value, p P
 }
 
 // loadEntity loads an EntityProto into PropertyLoadSaver or struct pointer.
-func loadEntity(dst interface{}, src *pb.Entity) (err error) {
+// If dst implements KeySetter, its SetKey method is first called with the
+// entity's key. If dst implements AfterLoader, its AfterLoad method is then
+// called, unless loading failed with an error other than *ErrFieldMismatch.
+func loadEntity(dst interface{}, src *pb.Entity) error {
+	return loadNamedEntity(dst, src, nil)
+}
+
+// loadNamedEntity is loadEntity, naming the fields of a struct dst as naming
+// asks.
+func loadNamedEntity(dst interface{}, src *pb.Entity, naming *fieldNaming) (err error) {
+	if ks, ok := dst.(KeySetter); ok && src.Key != nil {
+		ks.SetKey(protoToKey(src.Key))
+	}
 	props := protoToProperties(src)
 	if e, ok := dst.(PropertyLoadSaver); ok {
-		return e.Load(props)
+		err = e.Load(props)
+	} else {
+		err = loadStruct(dst, props, naming)
 	}
-	return LoadStruct(dst, props)
+	if a, ok := dst.(AfterLoader); ok {
+		if _, mismatch := err.(*ErrFieldMismatch); err == nil || mismatch {
+			if aerr := a.AfterLoad(); aerr != nil {
+				return aerr
+			}
+		}
+	}
+	return err
+}
+
+// loadEntity is like the package function loadEntity, but fails if src has
+// more property values than the Client's limit.
+func (c *Client) loadEntity(dst interface{}, src *pb.Entity) error {
+	if c.maxProps > 0 {
+		if n := countPropertyValues(src); n > c.maxProps {
+			return fmt.Errorf("datastore: entity has %d property values, more than the limit of %d", n, c.maxProps)
+		}
+	}
+	return loadNamedEntity(dst, src, c.naming)
+}
+
+// countPropertyValues returns the number of property values of src, counting
+// each value of a list.
+func countPropertyValues(src *pb.Entity) int {
+	n := 0
+	for _, p := range src.Property {
+		if l := p.Value.GetListValue(); l != nil {
+			n += len(l)
+		} else {
+			n++
+		}
+	}
+	return n
 }
 
 func (s structPLS) Load(props []Property) error {
@@ -202,6 +310,13 @@ func (s structPLS) Load(props []Property) error {
 			fieldName, reason = p.Name, errStr
 		}
 	}
+	if s.codec.hasDefault {
+		loaded := make(map[string]bool, len(props))
+		for _, p := range props {
+			loaded[p.Name] = true
+		}
+		setDefaults(s.codec, s.v, loaded, "")
+	}
 	if reason != "" {
 		return &ErrFieldMismatch{
 			StructType: s.v.Type(),
@@ -212,34 +327,38 @@ func (s structPLS) Load(props []Property) error {
 	return nil
 }
 
+// protoToProperties returns the properties of src. An embedded entity value,
+// such as one saved by another client library for a struct field, is
+// flattened the way this package saves struct fields: its properties are
+// named after their path, like "Address.City". Flattening a list of embedded
+// entities gives a multi-valued property for each nested name, holding a
+// value for each element in order, with a nil value for an element that
+// lacks the property.
 func protoToProperties(src *pb.Entity) []Property {
-	props := src.Property
-	out := make([]Property, 0, len(props))
-	for {
-		var (
-			x       *pb.Property
-			noIndex bool
-		)
-		if len(props) > 0 {
-			x, props = props[0], props[1:]
-			noIndex = !x.GetValue().GetIndexed()
-		} else {
-			break
-		}
+	return appendProtoProperties(make([]Property, 0, len(src.Property)), "", src.Property)
+}
 
-		if x.Value.ListValue == nil {
+func appendProtoProperties(out []Property, prefix string, props []*pb.Property) []Property {
+	for _, x := range props {
+		name, v := prefix+x.GetName(), x.GetValue()
+		switch {
+		case v.ListValue == nil && embeddedEntity(v):
+			out = appendProtoProperties(out, name+".", v.EntityValue.Property)
+		case v.ListValue == nil:
 			out = append(out, Property{
-				Name:     x.GetName(),
-				Value:    propValue(x.Value),
-				NoIndex:  noIndex,
+				Name:     name,
+				Value:    propValue(v),
+				NoIndex:  !v.GetIndexed(),
 				Multiple: false,
 			})
-		} else {
-			for _, v := range x.Value.ListValue {
+		case embeddedEntityList(v.ListValue):
+			out = appendEntityList(out, name+".", v.ListValue)
+		default:
+			for _, lv := range v.ListValue {
 				out = append(out, Property{
-					Name:     x.GetName(),
-					Value:    propValue(v),
-					NoIndex:  noIndex,
+					Name:     name,
+					Value:    propValue(lv),
+					NoIndex:  !lv.GetIndexed(),
 					Multiple: true,
 				})
 			}
@@ -248,10 +367,53 @@ func protoToProperties(src *pb.Entity) []Property {
 	return out
 }
 
+// appendEntityList appends the flattened properties of a list of embedded
+// entities, each name taking one value per element of the list.
+func appendEntityList(out []Property, prefix string, values []*pb.Value) []Property {
+	var names []string
+	byName := make(map[string][]Property)
+	pad := func(name string, n int) {
+		for len(byName[name]) < n {
+			byName[name] = append(byName[name], Property{Name: name, NoIndex: true, Multiple: true})
+		}
+	}
+	for i, v := range values {
+		for _, p := range appendProtoProperties(nil, prefix, v.EntityValue.Property) {
+			if _, ok := byName[p.Name]; !ok {
+				names = append(names, p.Name)
+			}
+			pad(p.Name, i)
+			p.Multiple = true
+			byName[p.Name] = append(byName[p.Name], p)
+		}
+	}
+	for _, name := range names {
+		pad(name, len(values))
+		out = append(out, byName[name]...)
+	}
+	return out
+}
+
+// embeddedEntity reports whether v holds an embedded entity, as opposed to
+// an entity value with a meaning of its own, such as a User.
+func embeddedEntity(v *pb.Value) bool {
+	return v.EntityValue != nil && v.GetMeaning() != meaningUser
+}
+
+// embeddedEntityList reports whether values is a non-empty list of embedded
+// entities.
+func embeddedEntityList(values []*pb.Value) bool {
+	for _, v := range values {
+		if !embeddedEntity(v) {
+			return false
+		}
+	}
+	return len(values) > 0
+}
+
 // propValue returns a Go value that combines the raw PropertyValue with a
 // meaning. For example, an Int64Value with GD_WHEN becomes a time.Time.
 func propValue(v *pb.Value) interface{} {
-	//TODO(PSG-Luna): Support EntityValue
 	//TODO(PSG-Luna): GeoPoint seems gone from the v1 proto, reimplement it once it's readded
 	switch {
 	case v.IntegerValue != nil:
@@ -263,13 +425,18 @@ func propValue(v *pb.Value) interface{} {
 	case v.StringValue != nil:
 		return *v.StringValue
 	case v.BlobValue != nil:
-		return []byte(v.BlobValue)
+		// The blob is not copied; see the Property.Value documentation.
+		return v.BlobValue
 	case v.BlobKeyValue != nil:
 		return *v.BlobKeyValue
 	case v.DoubleValue != nil:
 		return *v.DoubleValue
 	case v.KeyValue != nil:
 		return protoToKey(v.KeyValue)
+	case v.EntityValue != nil && v.GetMeaning() == meaningUser:
+		return protoToUser(v.EntityValue)
 	}
+	// Other value types, such as an embedded entity in a list that also
+	// holds values of other types, are not supported and are loaded as nil.
 	return nil
 }
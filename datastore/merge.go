@@ -0,0 +1,375 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// This file merges the results of several queries into a single stream, and
+// sorts results on the client.
+
+// RunMerged runs each of queries and returns an iterator over their results,
+// merged into a single stream sorted by the property named by orderStr. It
+// serves feeds that blend entities of several kinds, such as an activity feed
+// of posts and comments sorted by time, which a single query cannot return.
+//
+// orderStr is a property name, optionally prefixed by "-" for descending
+// order, as for Query.Order. It is added to each query as its first order, so
+// every query must be able to sort on the property, and must not be
+// keys-only. Results with equal values for the property are returned in the
+// order of queries. Any limit of a query applies to that query alone.
+//
+// The position of the merged stream is the position of each query, as
+// returned by MergedIterator.Cursors. To resume the stream, start each query
+// at its cursor and merge them again:
+//
+//	cursors, err := it.Cursors()
+//	...
+//	it = client.RunMerged(ctx, "-Time", posts.Start(cursors[0]), comments.Start(cursors[1]))
+func (c *Client) RunMerged(ctx context.Context, orderStr string, queries ...*Query) *MergedIterator {
+	o := (&Query{}).Order(orderStr)
+	if o.err != nil {
+		return &MergedIterator{err: o.err}
+	}
+	t := &MergedIterator{
+		field:      o.order[0].FieldName,
+		descending: o.order[0].Direction == descending,
+		streams:    make([]*mergeStream, len(queries)),
+	}
+	for i, q := range queries {
+		if q.keysOnly {
+			return &MergedIterator{err: errors.New("datastore: merged queries cannot be keys-only")}
+		}
+		if q.dedup {
+			t.seen = make(map[string]bool)
+		}
+		q = q.clone()
+		q.order = append([]order{o.order[0]}, q.order...)
+		t.streams[i] = &mergeStream{it: c.Run(ctx, q)}
+	}
+	return t
+}
+
+// MergedIterator is the result of running several queries with RunMerged.
+type MergedIterator struct {
+	field      string
+	descending bool
+	streams    []*mergeStream
+	err        error
+	// seen holds the keys returned so far, if any of the queries
+	// deduplicates them.
+	seen map[string]bool
+}
+
+// mergeStream holds the next result of one of the merged queries.
+type mergeStream struct {
+	it *Iterator
+	// pending is whether key, props and value hold a result fetched from it
+	// but not yet returned.
+	pending bool
+	done    bool
+	key     *Key
+	props   PropertyList
+	value   interface{}
+}
+
+// Next returns the key of the next result of the merged stream, and loads
+// its entity into dst, which must be a struct pointer or PropertyLoadSaver.
+// Since the results may be of different kinds, a *PropertyList dst loads
+// any of them; it can then be loaded into a struct chosen by the key's kind
+// with LoadStruct. When there are no more results, Done is returned as the
+// error.
+func (t *MergedIterator) Next(dst interface{}) (*Key, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+	for {
+		next, err := t.nextStream()
+		if err != nil {
+			return nil, err
+		}
+		next.pending = false
+		if t.seen != nil {
+			s := next.key.String()
+			if t.seen[s] && next.it.q.dedup {
+				continue
+			}
+			t.seen[s] = true
+		}
+		if pls, ok := dst.(PropertyLoadSaver); ok {
+			return next.key, pls.Load(next.props)
+		}
+		return next.key, loadStruct(dst, next.props, next.it.client.naming)
+	}
+}
+
+// nextStream returns the stream whose pending result is next in the merged
+// order, first fetching a result from each stream that has none pending.
+func (t *MergedIterator) nextStream() (*mergeStream, error) {
+	var next *mergeStream
+	for _, s := range t.streams {
+		if !s.pending && !s.done {
+			s.props = nil
+			k, err := s.it.Next(&s.props)
+			if err == Done {
+				s.done = true
+				continue
+			}
+			if err != nil {
+				t.err = err
+				return nil, err
+			}
+			s.key, s.value, s.pending = k, propertyValue(s.props, t.field), true
+		}
+		if !s.pending {
+			continue
+		}
+		if next == nil {
+			next = s
+			continue
+		}
+		cmp := compareValues(s.value, next.value)
+		if t.descending {
+			cmp = -cmp
+		}
+		if cmp < 0 {
+			next = s
+		}
+	}
+	if next == nil {
+		t.err = Done
+		return nil, Done
+	}
+	return next, nil
+}
+
+// Cursors returns the position of the merged stream: for each of the merged
+// queries, in order, a cursor for the position after its last result that
+// Next returned. Results that were fetched to be compared, but not returned,
+// are after the cursors.
+func (t *MergedIterator) Cursors() ([]Cursor, error) {
+	if t.err != nil && t.err != Done {
+		return nil, t.err
+	}
+	cursors := make([]Cursor, len(t.streams))
+	for i, s := range t.streams {
+		var err error
+		if s.pending {
+			cursors[i], err = s.it.cursorAt(s.it.i - 1)
+		} else {
+			cursors[i], err = s.it.Cursor()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cursors, nil
+}
+
+// SortResults sorts keys, and entities aligned with them, by the value of
+// their property named field, as a query ordered by the property would. It
+// suits small result sets filtered in memory, or queries whose composite index
+// is not yet available. entities must be a slice of structs, struct pointers,
+// PropertyLoadSavers such as PropertyList, or interfaces holding them, of the
+// same length as keys; the property values are those the entities would save.
+//
+// Values of different types sort in the datastore's order of their types:
+// nil, then integers and times, booleans, strings and blobs, floats, users
+// and keys. As for the datastore, an entity with several values for the
+// property sorts by its smallest value in ascending order and its largest in
+// descending order. Unlike the datastore, which drops them from query
+// results, entities without the property sort as if its value were nil.
+// Entities with equal values keep their relative order.
+func SortResults(keys []*Key, entities interface{}, field string, desc bool) error {
+	v := reflect.ValueOf(entities)
+	if v.Kind() != reflect.Slice {
+		return fmt.Errorf("datastore: entities has invalid type: got %T, want a slice", entities)
+	}
+	if v.Len() != len(keys) {
+		return errors.New("datastore: keys and entities slices have different length")
+	}
+	s := &resultSorter{keys: keys, entities: v, desc: desc, values: make([]interface{}, len(keys))}
+	for i := range keys {
+		props, err := entityProperties(v.Index(i))
+		if err != nil {
+			return err
+		}
+		s.values[i] = sortValue(props, field, desc)
+	}
+	sort.Stable(s)
+	return nil
+}
+
+// resultSorter sorts keys, entities and the values they are sorted by.
+type resultSorter struct {
+	keys     []*Key
+	entities reflect.Value
+	values   []interface{}
+	desc     bool
+}
+
+func (s *resultSorter) Len() int { return len(s.keys) }
+
+func (s *resultSorter) Less(i, j int) bool {
+	if s.desc {
+		return compareValues(s.values[i], s.values[j]) > 0
+	}
+	return compareValues(s.values[i], s.values[j]) < 0
+}
+
+func (s *resultSorter) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+	a, b := s.entities.Index(i), s.entities.Index(j)
+	tmp := reflect.New(a.Type()).Elem()
+	tmp.Set(a)
+	a.Set(b)
+	b.Set(tmp)
+}
+
+// entityProperties returns the properties that the entity v, an element of
+// a slice, would save.
+func entityProperties(v reflect.Value) ([]Property, error) {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() {
+		v = v.Addr()
+	}
+	if !v.IsValid() {
+		return nil, ErrInvalidEntityType
+	}
+	if pls, ok := v.Interface().(PropertyLoadSaver); ok {
+		return pls.Save()
+	}
+	return SaveStruct(v.Interface())
+}
+
+// sortValue returns the value of the properties named name in props by which
+// a query ordered by the property sorts them: the smallest value, or the
+// largest if desc is true. It is nil if there is no such property.
+func sortValue(props []Property, name string, desc bool) interface{} {
+	var ret interface{}
+	found := false
+	for _, p := range props {
+		if p.Name != name {
+			continue
+		}
+		if c := compareValues(p.Value, ret); !found || (desc && c > 0) || (!desc && c < 0) {
+			ret, found = p.Value, true
+		}
+	}
+	return ret
+}
+
+// propertyValue returns the value of the first property named name in props,
+// or nil if there is none.
+func propertyValue(props PropertyList, name string) interface{} {
+	for _, p := range props {
+		if p.Name == name {
+			return p.Value
+		}
+	}
+	return nil
+}
+
+// valueTypeRank returns the rank of v's type in the order in which the
+// datastore sorts values of different types.
+func valueTypeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case int64, time.Time:
+		return 1
+	case bool:
+		return 2
+	case []byte, string:
+		return 3
+	case float64:
+		return 4
+	case User:
+		return 5
+	case *Key:
+		return 6
+	}
+	return 7
+}
+
+// compareValues returns -1, 0 or 1 as the property value a sorts before, with
+// or after b.
+func compareValues(a, b interface{}) int {
+	if ra, rb := valueTypeRank(a), valueTypeRank(b); ra != rb {
+		return compareInts(int64(ra), int64(rb))
+	}
+	switch a := a.(type) {
+	case int64, time.Time:
+		return compareInts(integerValue(a), integerValue(b))
+	case bool:
+		if b := b.(bool); a != b {
+			if a {
+				return 1
+			}
+			return -1
+		}
+	case []byte, string:
+		return bytes.Compare(bytesValue(a), bytesValue(b))
+	case float64:
+		if b := b.(float64); a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+	case User:
+		return strings.Compare(a.Email, b.(User).Email)
+	case *Key:
+		return strings.Compare(a.String(), b.(*Key).String())
+	}
+	return 0
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// integerValue returns v, an int64 or time.Time, as an integer. Times are
+// in microseconds, as stored by the datastore.
+func integerValue(v interface{}) int64 {
+	if t, ok := v.(time.Time); ok {
+		return toUnixMicro(t)
+	}
+	return v.(int64)
+}
+
+func bytesValue(v interface{}) []byte {
+	if s, ok := v.(string); ok {
+		return []byte(s)
+	}
+	return v.([]byte)
+}
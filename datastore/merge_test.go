@@ -0,0 +1,232 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	pb "google.golang.org/cloud/internal/datastore"
+)
+
+// fakeFeedClient returns a client whose queries return the entities of
+// their kind, which have an integer Time property with the given values in
+// order. Cursors are indexes into those entities.
+func fakeFeedClient(times map[string][]int64, check func(*pb.RunQueryRequest)) *Client {
+	ctx := context.Background()
+	return &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			in := req.(*pb.RunQueryRequest)
+			check(in)
+			kind := in.Query.Kind[0].GetName()
+			start := 0
+			if c := in.Query.StartCursor; c != nil {
+				start = int(c[0])
+			}
+			start += int(in.Query.GetOffset())
+			end := len(times[kind])
+			if in.Query.Limit != nil && start+int(in.Query.GetLimit()) < end {
+				end = start + int(in.Query.GetLimit())
+			}
+			b := &pb.QueryResultBatch{
+				EntityResultType: pb.EntityResult_FULL.Enum(),
+				MoreResults:      pb.QueryResultBatch_NO_MORE_RESULTS.Enum(),
+				SkippedResults:   proto.Int32(in.Query.GetOffset()),
+				EndCursor:        []byte{byte(end)},
+			}
+			for i := start; i < end; i++ {
+				k := NewKey(ctx, kind, "", int64(i+1), nil)
+				b.EntityResult = append(b.EntityResult, &pb.EntityResult{Entity: &pb.Entity{
+					Key: keyToProto(k),
+					Property: []*pb.Property{
+						{Name: proto.String("Time"), Value: &pb.Value{IntegerValue: proto.Int64(times[kind][i])}},
+					},
+				}})
+			}
+			*resp.(*pb.RunQueryResponse) = pb.RunQueryResponse{Batch: b}
+			return nil
+		}),
+	}
+}
+
+type feedItem struct {
+	Time int64
+}
+
+func TestRunMerged(t *testing.T) {
+	ctx := context.Background()
+	client := fakeFeedClient(map[string][]int64{
+		"Post":    {5, 3, 1},
+		"Comment": {4, 3, 2},
+	}, func(req *pb.RunQueryRequest) {
+		o := req.Query.Order
+		if len(o) == 0 || o[0].Property.GetName() != "Time" || o[0].GetDirection() != pb.PropertyOrder_DESCENDING {
+			t.Errorf("got orders %v, want a descending order on Time first", o)
+		}
+	})
+	posts, comments := NewQuery("Post"), NewQuery("Comment")
+
+	type result struct {
+		kind string
+		time int64
+	}
+	next := func(it *MergedIterator) (result, error) {
+		var item feedItem
+		k, err := it.Next(&item)
+		if err != nil {
+			return result{}, err
+		}
+		return result{k.Kind(), item.Time}, nil
+	}
+
+	it := client.RunMerged(ctx, "-Time", posts, comments)
+	var got []result
+	for {
+		r, err := next(it)
+		if err == Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r)
+	}
+	want := []result{{"Post", 5}, {"Comment", 4}, {"Post", 3}, {"Comment", 3}, {"Comment", 2}, {"Post", 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Resume after the first three results.
+	it = client.RunMerged(ctx, "-Time", posts, comments)
+	for i := 0; i < 3; i++ {
+		if _, err := next(it); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cursors, err := it.Cursors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	it = client.RunMerged(ctx, "-Time", posts.Start(cursors[0]), comments.Start(cursors[1]))
+	got = nil
+	for {
+		r, err := next(it)
+		if err == Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r)
+	}
+	if want := want[3:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("after resuming: got %v, want %v", got, want)
+	}
+}
+
+func TestRunMergedErrors(t *testing.T) {
+	ctx := context.Background()
+	client := fakeFeedClient(nil, func(*pb.RunQueryRequest) {})
+	if _, err := client.RunMerged(ctx, "", NewQuery("Post")).Next(&feedItem{}); err == nil {
+		t.Error("empty order: got nil error")
+	}
+	if _, err := client.RunMerged(ctx, "Time", NewQuery("Post").KeysOnly()).Next(&feedItem{}); err == nil {
+		t.Error("keys-only query: got nil error")
+	}
+}
+
+func TestRunMergedDedupKeys(t *testing.T) {
+	ctx := context.Background()
+	client := fakeFeedClient(map[string][]int64{"Post": {3, 2, 1}}, func(*pb.RunQueryRequest) {})
+	count := func(queries ...*Query) int {
+		n := 0
+		for it := client.RunMerged(ctx, "-Time", queries...); ; n++ {
+			if _, err := it.Next(&feedItem{}); err == Done {
+				return n
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Both queries match the same three posts.
+	q := NewQuery("Post")
+	if got := count(q, q); got != 6 {
+		t.Errorf("without DedupKeys: got %d results, want 6", got)
+	}
+	if got := count(q, q.DedupKeys()); got != 3 {
+		t.Errorf("with DedupKeys: got %d results, want 3", got)
+	}
+}
+
+func TestSortResults(t *testing.T) {
+	ctx := context.Background()
+	keys := []*Key{NewKey(ctx, "Post", "", 1, nil), NewKey(ctx, "Post", "", 2, nil), NewKey(ctx, "Post", "", 3, nil)}
+	items := []feedItem{{3}, {1}, {2}}
+	if err := SortResults(keys, items, "Time", false); err != nil {
+		t.Fatal(err)
+	}
+	if want := []feedItem{{1}, {2}, {3}}; !reflect.DeepEqual(items, want) {
+		t.Errorf("got items %v, want %v", items, want)
+	}
+	if keys[0].ID() != 2 || keys[1].ID() != 3 || keys[2].ID() != 1 {
+		t.Errorf("got keys %v, want them sorted with the items", keys)
+	}
+
+	// Values of mixed types, missing and multiple values.
+	lists := func() []PropertyList {
+		return []PropertyList{
+			{{Name: "V", Value: "a"}},
+			{{Name: "V", Value: int64(5)}},
+			{{Name: "W", Value: int64(0)}},
+			{{Name: "V", Value: int64(9), Multiple: true}, {Name: "V", Value: int64(1), Multiple: true}},
+		}
+	}
+	for _, tc := range []struct {
+		desc bool
+		want []int
+	}{
+		{false, []int{2, 3, 1, 0}},
+		{true, []int{0, 3, 1, 2}},
+	} {
+		got, orig := lists(), lists()
+		keys := make([]*Key, len(got))
+		if err := SortResults(keys, got, "V", tc.desc); err != nil {
+			t.Fatal(err)
+		}
+		for i, j := range tc.want {
+			if !reflect.DeepEqual(got[i], orig[j]) {
+				t.Errorf("desc %v: result %d is %v, want %v", tc.desc, i, got[i], orig[j])
+			}
+		}
+	}
+
+	if err := SortResults(keys, items[:1], "Time", false); err == nil {
+		t.Error("different lengths: got nil error")
+	}
+}
+
+func TestCompareValues(t *testing.T) {
+	ordered := []interface{}{nil, int64(-1), int64(2), false, true, "a", "b", 1.5, 2.5}
+	for i, a := range ordered {
+		for j, b := range ordered {
+			want := compareInts(int64(i), int64(j))
+			if got := compareValues(a, b); got != want {
+				t.Errorf("compareValues(%v, %v) = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"sort"
+
+	"golang.org/x/net/context"
+)
+
+// This file provides queries against the datastore's metadata kinds.
+
+const (
+	namespaceKind = "__namespace__"
+	kindKind      = "__kind__"
+	propertyKind  = "__property__"
+)
+
+// Namespaces returns the names of all the namespaces in the dataset. The
+// default namespace is returned as the empty string.
+func (c *Client) Namespaces(ctx context.Context) ([]string, error) {
+	// Metadata entities for namespaces live in the default namespace.
+	keys, err := c.GetAll(WithNamespace(ctx, ""), NewQuery(namespaceKind).KeysOnly(), nil)
+	if err != nil {
+		return nil, err
+	}
+	namespaces := make([]string, len(keys))
+	for i, k := range keys {
+		// The default namespace is represented by a key with a numeric ID
+		// rather than a name, so k.Name() is the empty string.
+		namespaces[i] = k.Name()
+	}
+	return namespaces, nil
+}
+
+// Kinds returns the names of all the kinds in the namespace of ctx.
+func (c *Client) Kinds(ctx context.Context) ([]string, error) {
+	keys, err := c.GetAll(ctx, NewQuery(kindKind).KeysOnly(), nil)
+	if err != nil {
+		return nil, err
+	}
+	kinds := make([]string, len(keys))
+	for i, k := range keys {
+		kinds[i] = k.Name()
+	}
+	return kinds, nil
+}
+
+// Properties returns the sorted names of the indexed properties of kind in
+// the namespace of ctx. These are the properties that queries on kind can
+// filter and sort on.
+func (c *Client) Properties(ctx context.Context, kind string) ([]string, error) {
+	q := NewQuery(propertyKind).Ancestor(NewKey(ctx, kindKind, kind, 0, nil)).KeysOnly()
+	keys, err := c.GetAll(ctx, q, nil)
+	if err != nil {
+		return nil, err
+	}
+	var props []string
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		if name := k.Name(); !seen[name] {
+			seen[name] = true
+			props = append(props, name)
+		}
+	}
+	sort.Strings(props)
+	return props, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+	pb "google.golang.org/cloud/internal/datastore"
+)
+
+func TestNamespaces(t *testing.T) {
+	ctx := context.Background()
+	client := fakeKeysClient([][]*Key{
+		{NewKey(ctx, namespaceKind, "", 1, nil), NewKey(ctx, namespaceKind, "a", 0, nil)},
+		{NewKey(ctx, namespaceKind, "b", 0, nil)},
+	}, func(req *pb.RunQueryRequest) {
+		if got := req.Query.Kind[0].GetName(); got != namespaceKind {
+			t.Errorf("got kind %q, want %q", got, namespaceKind)
+		}
+		if ns := req.GetPartitionId().GetNamespace(); ns != "" {
+			t.Errorf("got namespace %q, want the default namespace", ns)
+		}
+	})
+
+	got, err := client.Namespaces(WithNamespace(ctx, "ignored"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"", "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestKinds(t *testing.T) {
+	ctx := WithNamespace(context.Background(), "gopherspace")
+	client := fakeKeysClient([][]*Key{
+		{NewKey(ctx, kindKind, "Gopher", 0, nil)},
+		{NewKey(ctx, kindKind, "Post", 0, nil)},
+	}, func(req *pb.RunQueryRequest) {
+		if got := req.Query.Kind[0].GetName(); got != kindKind {
+			t.Errorf("got kind %q, want %q", got, kindKind)
+		}
+		if got := req.GetPartitionId().GetNamespace(); got != "gopherspace" {
+			t.Errorf("got namespace %q, want %q", got, "gopherspace")
+		}
+	})
+
+	got, err := client.Kinds(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Gopher", "Post"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestProperties(t *testing.T) {
+	ctx := context.Background()
+	parent := NewKey(ctx, kindKind, "Gopher", 0, nil)
+	client := fakeKeysClient([][]*Key{
+		{NewKey(ctx, propertyKind, "Name", 0, parent), NewKey(ctx, propertyKind, "Height", 0, parent)},
+		{NewKey(ctx, propertyKind, "Name", 0, parent)},
+	}, func(req *pb.RunQueryRequest) {
+		if got := req.Query.Kind[0].GetName(); got != propertyKind {
+			t.Errorf("got kind %q, want %q", got, propertyKind)
+		}
+		f := req.Query.Filter.GetPropertyFilter()
+		if f.GetOperator() != pb.PropertyFilter_HAS_ANCESTOR || !protoToKey(f.Value.KeyValue).Equal(parent) {
+			t.Errorf("got filter %v, want an ancestor filter on %v", f, parent)
+		}
+	})
+
+	got, err := client.Properties(ctx, "Gopher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Height", "Name"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"google.golang.org/cloud"
+	"google.golang.org/cloud/internal/opts"
+)
+
+// A ClientOption configures how a Client saves, loads and retries, rather
+// than how it dials the datastore. It is given to NewClient along with the
+// cloud.ClientOption values, and applies only to the Client it creates, and
+// to the copies of that Client made by InNamespace.
+type ClientOption interface {
+	cloud.ClientOption
+	applyClient(*Client)
+}
+
+// clientOption implements ClientOption with a function that configures a
+// Client.
+type clientOption func(*Client)
+
+// Resolve implements cloud.ClientOption. A ClientOption has nothing to dial.
+func (clientOption) Resolve(*opts.DialOpt) {}
+
+func (o clientOption) applyClient(c *Client) { o(c) }
+
+// FieldNameTransform returns a ClientOption that maps the names of struct
+// fields without a name in their datastore tag to property names, such as a
+// function that maps "CreatedAt" to "created_at". The same mapping is used to
+// save and to load structs, so they round trip. Without this option the
+// field names are used as they are. Names given in tags are not transformed,
+// nor are those of unexported fields and embedded structs. Saving or loading
+// a struct fails if the transform returns an invalid property name.
+//
+// The package functions SaveStruct and LoadStruct, and the structs sorted by
+// SortResults, always use the field names as they are. Combined with
+// UseJSONTags, the transform names only the fields without a json tag.
+func FieldNameTransform(transform func(fieldName string) string) ClientOption {
+	return clientOption(func(c *Client) {
+		if c.naming == nil {
+			c.naming = &fieldNaming{}
+		}
+		c.naming.transform = transform
+	})
+}
+
+// UseJSONTags returns a ClientOption that names properties after the json
+// tags of struct fields, so that structs shared with JSON APIs need not be
+// tagged twice. A field without a datastore tag but with a json tag is
+// treated as if its datastore tag had the json tag's name: the property is
+// named as in the json tag, or is not saved or loaded if the json tag is "-".
+// The options of json tags, such as omitempty, are ignored. A field with a
+// datastore tag, even an empty one, ignores its json tag. Without this
+// option, json tags are ignored, as they are by SaveStruct and LoadStruct.
+func UseJSONTags() ClientOption {
+	return clientOption(func(c *Client) {
+		if c.naming == nil {
+			c.naming = &fieldNaming{}
+		}
+		c.naming.jsonTags = true
+	})
+}
+
+// MaxEntityProperties returns a ClientOption that makes a Client fail to load
+// entities with more than n property values, each value of a list counting
+// as one, instead of converting them. It protects programs that read entities
+// written by untrusted or buggy writers from spending unbounded resources on
+// them. By default there is no limit.
+func MaxEntityProperties(n int) ClientOption {
+	return clientOption(func(c *Client) {
+		c.maxProps = n
+	})
+}
+
+// AutoNoIndex returns a ClientOption that makes a Client save indexed string
+// and []byte properties whose values are longer than the datastore's
+// 1500-byte limit for indexed values as unindexed, instead of failing the
+// write. Such properties cannot be filtered or sorted on.
+func AutoNoIndex() ClientOption {
+	return clientOption(func(c *Client) {
+		c.autoNoIndex = true
+	})
+}
+
+// DefaultNoIndex returns a ClientOption that makes a Client save the fields of
+// structs as unindexed properties unless they are tagged with the index
+// option, as in `datastore:",index"`, instead of indexing all the fields not
+// tagged with noindex. It suits write-heavy kinds, such as logs, of which few
+// properties are queried, since each indexed property costs index writes.
+// The properties saved by a PropertyLoadSaver keep their own NoIndex setting.
+func DefaultNoIndex() ClientOption {
+	return clientOption(func(c *Client) {
+		c.defaultNoIndex = true
+	})
+}
+
+// IndexFunc returns a ClientOption that makes a Client call indexed with the
+// name of each property it saves that would be indexed, such as
+// "Address.City" for a field of a nested struct, and save the property as
+// unindexed if indexed returns false. It lets an application decide which
+// properties are worth their index writes in one place, rather than in the
+// tags of every struct. Properties already unindexed, as by a noindex tag,
+// stay unindexed. The function is called once for each property name of an
+// entity saved, or estimated by EstimateIndexWrites, and may be called
+// concurrently.
+func IndexFunc(indexed func(name string) bool) ClientOption {
+	return clientOption(func(c *Client) {
+		c.indexFunc = indexed
+	})
+}
+
+// RetryPredicate returns a ClientOption that makes a Client use retryable to
+// decide which errors are retried, instead of its default classification of
+// conflicts, expired transactions and transient errors. It is consulted by
+// RunInTransaction for the errors returned by its function and by the commit.
+func RetryPredicate(retryable func(error) bool) ClientOption {
+	return clientOption(func(c *Client) {
+		c.retryable = retryable
+	})
+}
@@ -15,8 +15,14 @@
 package datastore
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding"
 	"fmt"
+	"math"
+	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"unicode"
@@ -43,6 +49,7 @@ type Property struct {
 	//	- *Key
 	//	- time.Time
 	//	- []byte (up to 1 megabyte in length)
+	//	- User (a legacy App Engine user)
 	// This set is smaller than the set of valid struct field types that the
 	// datastore can load and save. A Property Value cannot be a slice (apart
 	// from []byte); use multiple Properties instead. Also, a Value's type
@@ -52,6 +59,13 @@ type Property struct {
 	// invalid. Again, this is more restrictive than the set of valid struct
 	// field types.
 	//
+	// The datastore API used by this package has no geographical point
+	// type, and the meaning of App Engine's legacy GeoPt values is not
+	// recognized. Store a point as two float64 properties instead, such as
+	// by a struct field of type struct{ Lat, Lng float64 }, which is
+	// flattened into the properties "Loc.Lat" and "Loc.Lng" for a field
+	// named Loc.
+	//
 	// A Value will have an opaque type when loading entities from an index,
 	// such as via a projection query. Load entities into a struct instead
 	// of a PropertyLoadSaver when using a projection query.
@@ -60,10 +74,17 @@ type Property struct {
 	// Python's None but not directly representable by a Go struct. Loading
 	// a nil-valued property into a struct will set that field to the zero
 	// value.
+	//
+	// A []byte Value is not copied when loading or saving. A loaded []byte,
+	// in a Property or a struct field, refers to the memory decoded from the
+	// datastore's response, which nothing else uses; a saved []byte is sent
+	// as is, so it must not be modified until the call saving it returns.
 	Value interface{}
 	// NoIndex is whether the datastore cannot index this property.
 	// If NoIndex is set to false, []byte values are limited to 1500 bytes and
-	// string values are limited to 1500 bytes.
+	// string values are limited to 1500 bytes. Saving a longer indexed value
+	// fails before anything is sent to the datastore, unless the Client was
+	// created with AutoNoIndex, which saves it as unindexed.
 	NoIndex bool
 	// Multiple is whether the entity can have multiple properties with
 	// the same name. Even if a particular instance only has one property with
@@ -78,9 +99,73 @@ type PropertyLoadSaver interface {
 	Save() ([]Property, error)
 }
 
+// AfterLoader is implemented by destinations that need to compute derived
+// fields or check invariants once an entity has been loaded into them.
+// AfterLoad is called after each load by Get, GetMulti, GetAll and
+// Iterator.Next, including loads that report an *ErrFieldMismatch. An error
+// returned by AfterLoad is returned in place of the load's error: by GetMulti
+// as the element of its MultiError for that entity.
+type AfterLoader interface {
+	AfterLoad() error
+}
+
+// BeforeSaver is implemented by sources that need to validate or normalize
+// themselves before they are saved. BeforeSave is called by Put and PutMulti,
+// on both Client and Transaction, before the source is converted to
+// properties, and before any autonow fields are set. An error returned by
+// BeforeSave aborts the write and is returned unchanged; PutMulti then writes
+// none of its entities.
+type BeforeSaver interface {
+	BeforeSave() error
+}
+
+// KeySetter is implemented by sources that keep track of their own key.
+// After a source is written by Put or PutMulti on a Client, its SetKey method
+// is called with the complete key it was written with, including the ID
+// allocated by the datastore for an incomplete key. It is not called for
+// writes in a transaction, whose keys are only known once the transaction
+// commits; use Commit.Key with the returned PendingKey instead.
+//
+// A destination implementing KeySetter also has its SetKey method called with
+// the key of each entity loaded into it, as by Get, GetMulti, GetAll or
+// Iterator.Next, before its properties are loaded.
+type KeySetter interface {
+	SetKey(*Key)
+}
+
 // PropertyList converts a []Property to implement PropertyLoadSaver.
+//
+// An entity loaded into a PropertyList, as by Get, suits an in-memory cache:
+// it can be shared by goroutines as long as none of them modifies it. Give
+// a goroutine that may modify the entity, such as by loading it into a
+// struct with LoadStruct and changing the struct, its own Copy.
 type PropertyList []Property
 
+// KeyedPropertyList is a PropertyList that also holds the key of its entity.
+// Loading an entity into a KeyedPropertyList sets its Key, so generic code
+// can pass it around without a separate slice of keys; saving it saves its
+// Properties. Like PropertyList, it does not reset its Properties before
+// loading.
+type KeyedPropertyList struct {
+	Key        *Key
+	Properties PropertyList
+}
+
+// Load loads all of the provided properties into l.Properties.
+func (l *KeyedPropertyList) Load(p []Property) error {
+	return l.Properties.Load(p)
+}
+
+// Save saves all of l's properties as a slice of Properties.
+func (l *KeyedPropertyList) Save() ([]Property, error) {
+	return l.Properties.Save()
+}
+
+// SetKey sets l.Key.
+func (l *KeyedPropertyList) SetKey(k *Key) {
+	l.Key = k
+}
+
 var (
 	typeOfPropertyLoadSaver = reflect.TypeOf((*PropertyLoadSaver)(nil)).Elem()
 	typeOfPropertyList      = reflect.TypeOf(PropertyList(nil))
@@ -98,6 +183,34 @@ func (l *PropertyList) Save() ([]Property, error) {
 	return *l, nil
 }
 
+// Copy returns a copy of l that shares no modifiable memory with it. The
+// contents of its []byte values are copied; its other values, including
+// *Key values, cannot be modified and are shared.
+func (l PropertyList) Copy() PropertyList {
+	if l == nil {
+		return nil
+	}
+	c := make(PropertyList, len(l))
+	copy(c, l)
+	for i, p := range c {
+		if b, ok := p.Value.([]byte); ok {
+			c[i].Value = append([]byte(nil), b...)
+		}
+	}
+	return c
+}
+
+// reservedPropertyName returns whether any of the "."-separated parts of name
+// is of the form "__*__", which the datastore reserves for its own use.
+func reservedPropertyName(name string) bool {
+	for _, s := range strings.Split(name, ".") {
+		if len(s) >= 4 && strings.HasPrefix(s, "__") && strings.HasSuffix(s, "__") {
+			return true
+		}
+	}
+	return false
+}
+
 // validPropertyName returns whether name consists of one or more valid Go
 // identifiers joined by ".".
 func validPropertyName(name string) bool {
@@ -132,6 +245,27 @@ func validPropertyName(name string) bool {
 type structTag struct {
 	name    string
 	noIndex bool
+	// index is whether the field is indexed even if its struct is saved
+	// unindexed by default, as by a Client created with DefaultNoIndex, or
+	// is in a noindex struct field.
+	index bool
+	// autoNow is whether the field is set to the current time whenever the
+	// entity is saved.
+	autoNow bool
+	// autoAddOnly is whether the field is set to the current time when the
+	// entity is saved with an incomplete key.
+	autoAddOnly bool
+	// defaultValue, if valid, is the value the field is set to when an entity
+	// without the field's property is loaded.
+	defaultValue reflect.Value
+	// required is whether saving fails if the field has its zero value.
+	required bool
+	// round is the number of decimal places a floating-point field, or the
+	// elements of a floating-point slice field, are rounded to when saved,
+	// or -1 if they are saved as they are.
+	round int
+	// substructCodec is the codec of a flattened, non-slice struct field.
+	substructCodec *structCodec
 }
 
 // structCodec describes how to convert a struct to and from a sequence of
@@ -147,6 +281,11 @@ type structCodec struct {
 	// complete is whether the structCodec is complete. An incomplete
 	// structCodec may be encountered when walking a recursive struct.
 	complete bool
+	// hasDefault is whether a struct or any of its nested or embedded structs
+	// has a field with a default value.
+	hasDefault bool
+	// naming is the naming of the fields the codec was built with.
+	naming *fieldNaming
 }
 
 // fieldCodec is a struct field's index and, if that struct field's type is
@@ -156,75 +295,303 @@ type fieldCodec struct {
 	substructCodec *structCodec
 }
 
-// structCodecs collects the structCodecs that have already been calculated.
+// fieldNaming holds the options of a Client that change the property names
+// of struct fields. A nil *fieldNaming names each field after its datastore
+// tag, or after the field itself.
+type fieldNaming struct {
+	// transform is set by FieldNameTransform, or nil to use the field names
+	// as they are.
+	transform func(string) string
+	// jsonTags is set by UseJSONTags.
+	jsonTags bool
+
+	// codecs holds the codecs built with transform, which no other naming
+	// can share since functions cannot be compared, so that they are freed
+	// with the Client. generation is the codecGeneration they were built in.
+	// Both are guarded by structCodecsMutex.
+	codecs     map[codecKey]*structCodec
+	generation int
+}
+
+// jsonTagsNaming is the naming shared by the Clients that only use json tags.
+var jsonTagsNaming = &fieldNaming{jsonTags: true}
+
+// codecKey identifies the codec of a struct type in a cache.
+type codecKey struct {
+	t        reflect.Type
+	jsonTags bool
+}
+
+// structCodecs collects the structCodecs that have already been calculated
+// without a field name transform. A struct type's codec is computed the first
+// time the type is loaded or saved with a naming, and is reused by every
+// later conversion of that type with an equal naming. codecGeneration counts
+// the times the cached codecs were discarded.
 var (
 	structCodecsMutex sync.Mutex
-	structCodecs      = make(map[reflect.Type]*structCodec)
+	structCodecs      = make(map[codecKey]*structCodec)
+	codecGeneration   int
+)
+
+// codecCacheLocked returns the cache of the codecs built with naming, and the
+// naming to build them with, which is shared by all the equal namings without
+// a transform. The structCodecsMutex must be held when calling this function.
+func codecCacheLocked(naming *fieldNaming) (map[codecKey]*structCodec, *fieldNaming) {
+	switch {
+	case naming == nil || naming.transform == nil && !naming.jsonTags:
+		return structCodecs, nil
+	case naming.transform == nil:
+		return structCodecs, jsonTagsNaming
+	}
+	if naming.codecs == nil || naming.generation != codecGeneration {
+		naming.codecs = make(map[codecKey]*structCodec)
+		naming.generation = codecGeneration
+	}
+	return naming.codecs, naming
+}
+
+// A converter converts the values of a registered type to and from
+// properties.
+type converter struct {
+	to   func(interface{}) (Property, error)
+	from func(Property, interface{}) error
+}
+
+var (
+	convertersMutex sync.RWMutex
+	converters      = make(map[reflect.Type]converter)
+)
+
+// RegisterConverter registers functions that convert struct fields of type t
+// to and from properties, in place of the built-in handling of t. It lets an
+// application control how a value type, such as a UUID or an amount of
+// money, is stored without implementing PropertyLoadSaver on every struct
+// that uses it.
+//
+// to is passed a value of type t and returns the property to save. The
+// property's Name and Multiple fields are ignored, and its NoIndex field is
+// combined with the field's noindex option. from is passed a loaded property
+// and a pointer to the value of type t to load it into.
+//
+// Converters apply to fields of type t and to the elements of fields of type
+// []t. A struct type with a converter is stored as a single property rather
+// than being flattened. A converter takes precedence over all other handling
+// of t, including the binary form of a type that implements
+// encoding.BinaryMarshaler. RegisterConverter panics if t is nil or already
+// has a converter. The package registers converters for url.URL and *url.URL,
+// which are stored as the string form of the URL.
+func RegisterConverter(t reflect.Type, to func(interface{}) (Property, error), from func(Property, interface{}) error) {
+	if t == nil || to == nil || from == nil {
+		panic("datastore: RegisterConverter with nil argument")
+	}
+	convertersMutex.Lock()
+	_, dup := converters[t]
+	if !dup {
+		converters[t] = converter{to, from}
+	}
+	convertersMutex.Unlock()
+	if dup {
+		panic(fmt.Sprintf("datastore: converter already registered for type %v", t))
+	}
+
+	// Discard the cached codecs, which may have flattened t. Building a codec
+	// looks up converters, so convertersMutex must not be held here.
+	structCodecsMutex.Lock()
+	structCodecs = make(map[codecKey]*structCodec)
+	codecGeneration++
+	structCodecsMutex.Unlock()
+}
+
+func init() {
+	// URLs are stored as strings, rather than as the blob of their binary
+	// form or as a flattened struct. A nil *url.URL is stored as nil.
+	RegisterConverter(reflect.TypeOf(url.URL{}),
+		func(v interface{}) (Property, error) {
+			u := v.(url.URL)
+			return Property{Value: u.String()}, nil
+		},
+		func(p Property, dst interface{}) error {
+			u, err := parseURLProperty(p)
+			if err == nil && u != nil {
+				*dst.(*url.URL) = *u
+			}
+			return err
+		})
+	RegisterConverter(reflect.TypeOf((*url.URL)(nil)),
+		func(v interface{}) (Property, error) {
+			if u := v.(*url.URL); u != nil {
+				return Property{Value: u.String()}, nil
+			}
+			return Property{}, nil
+		},
+		func(p Property, dst interface{}) error {
+			u, err := parseURLProperty(p)
+			if err == nil {
+				*dst.(**url.URL) = u
+			}
+			return err
+		})
+}
+
+// parseURLProperty parses the value of p, a string or nil, as a URL.
+func parseURLProperty(p Property) (*url.URL, error) {
+	switch s := p.Value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return url.Parse(s)
+	}
+	return nil, fmt.Errorf("type mismatch: %T versus url.URL", p.Value)
+}
+
+// lookupConverter returns the converter registered for t, if any.
+func lookupConverter(t reflect.Type) (converter, bool) {
+	convertersMutex.RLock()
+	defer convertersMutex.RUnlock()
+	c, ok := converters[t]
+	return c, ok
+}
+
+// hasConverter reports whether a converter is registered for t.
+func hasConverter(t reflect.Type) bool {
+	_, ok := lookupConverter(t)
+	return ok
+}
+
+var (
+	typeOfBinaryMarshaler   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	typeOfBinaryUnmarshaler = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+	typeOfValuer            = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+	typeOfScanner           = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
 )
 
-// getStructCodec returns the structCodec for the given struct type.
-func getStructCodec(t reflect.Type) (*structCodec, error) {
+// builtinType reports whether struct fields of type t have a built-in
+// representation or a registered converter, which take precedence over the
+// interfaces t implements. Types of an integer, boolean, string,
+// floating-point, slice or pointer kind have a built-in representation, as do
+// time.Time and User.
+func builtinType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Slice, reflect.Ptr, reflect.Interface:
+		return true
+	}
+	return t == typeOfTime || t == typeOfUser || hasConverter(t)
+}
+
+// implements reports whether t or *t implements the interface out, and *t
+// implements the interface in.
+func implements(t reflect.Type, out, in reflect.Type) bool {
+	pt := reflect.PtrTo(t)
+	return (t.Implements(out) || pt.Implements(out)) && pt.Implements(in)
+}
+
+// sqlValued reports whether struct fields of type t are saved as the value
+// returned by their driver.Valuer implementation and loaded with their
+// sql.Scanner implementation, as for sql.NullString. This is the case for
+// types without a built-in representation that implement driver.Valuer and,
+// through a pointer, sql.Scanner.
+func sqlValued(t reflect.Type) bool {
+	return !builtinType(t) && implements(t, typeOfValuer, typeOfScanner)
+}
+
+// binaryMarshaled reports whether struct fields of type t are saved as a
+// blob of their binary form. This is the case for types without a built-in
+// representation that implement encoding.BinaryMarshaler and, through a
+// pointer, encoding.BinaryUnmarshaler, unless they are sqlValued.
+func binaryMarshaled(t reflect.Type) bool {
+	return !builtinType(t) && !sqlValued(t) && implements(t, typeOfBinaryMarshaler, typeOfBinaryUnmarshaler)
+}
+
+// getStructCodec returns the structCodec for the given struct type, naming
+// its fields as naming asks.
+func getStructCodec(t reflect.Type, naming *fieldNaming) (*structCodec, error) {
 	structCodecsMutex.Lock()
 	defer structCodecsMutex.Unlock()
-	return getStructCodecLocked(t)
+	return getStructCodecLocked(t, naming)
 }
 
 // getStructCodecLocked implements getStructCodec. The structCodecsMutex must
 // be held when calling this function.
-func getStructCodecLocked(t reflect.Type) (ret *structCodec, retErr error) {
-	c, ok := structCodecs[t]
+func getStructCodecLocked(t reflect.Type, naming *fieldNaming) (ret *structCodec, retErr error) {
+	cache, naming := codecCacheLocked(naming)
+	key := codecKey{t, naming != nil && naming.jsonTags}
+	c, ok := cache[key]
 	if ok {
 		return c, nil
 	}
 	c = &structCodec{
 		byIndex: make([]structTag, t.NumField()),
 		byName:  make(map[string]fieldCodec),
+		naming:  naming,
 	}
 
 	// Add c to the structCodecs map before we are sure it is good. If t is
 	// a recursive type, it needs to find the incomplete entry for itself in
 	// the map.
-	structCodecs[t] = c
+	cache[key] = c
 	defer func() {
 		if retErr != nil {
-			delete(structCodecs, t)
+			delete(cache, key)
 		}
 	}()
 
 	for i := range c.byIndex {
 		f := t.Field(i)
-		name, opts := f.Tag.Get("datastore"), ""
+		name, ok := f.Tag.Lookup("datastore")
+		if !ok && naming != nil && naming.jsonTags {
+			// Only the name of a json tag is used, not its options.
+			name = f.Tag.Get("json")
+			if i := strings.Index(name, ","); i != -1 {
+				name = name[:i]
+			}
+		}
+		opts := ""
 		if i := strings.Index(name, ","); i != -1 {
 			name, opts = name[:i], name[i+1:]
 		}
 		if name == "" {
 			if !f.Anonymous {
 				name = f.Name
+				if naming != nil && naming.transform != nil && f.PkgPath == "" {
+					name = naming.transform(name)
+					if !validPropertyName(name) || reservedPropertyName(name) {
+						return nil, fmt.Errorf("datastore: field name transform returned invalid property name %q for field %q", name, f.Name)
+					}
+				}
 			}
 		} else if name == "-" {
 			c.byIndex[i] = structTag{name: name}
 			continue
 		} else if !validPropertyName(name) {
 			return nil, fmt.Errorf("datastore: struct tag has invalid property name: %q", name)
+		} else if reservedPropertyName(name) {
+			return nil, fmt.Errorf("datastore: struct tag has reserved property name: %q", name)
 		}
 
+		var subCodec *structCodec
 		substructType, fIsSlice := reflect.Type(nil), false
-		switch f.Type.Kind() {
-		case reflect.Struct:
+		switch {
+		case hasConverter(f.Type), sqlValued(f.Type), binaryMarshaled(f.Type):
+			// The field is saved as a single property.
+		case f.Type.Kind() == reflect.Struct:
 			substructType = f.Type
-		case reflect.Slice:
-			if f.Type.Elem().Kind() == reflect.Struct {
+		case f.Type.Kind() == reflect.Slice:
+			if elem := f.Type.Elem(); elem.Kind() == reflect.Struct && !hasConverter(elem) && !sqlValued(elem) && !binaryMarshaled(elem) {
 				substructType = f.Type.Elem()
 			}
-			fIsSlice = f.Type != typeOfByteSlice
+			// Byte slices, including named ones like json.RawMessage, are
+			// saved as a single blob.
+			fIsSlice = f.Type.Elem().Kind() != reflect.Uint8
 			c.hasSlice = c.hasSlice || fIsSlice
 		}
 
-		if substructType != nil && substructType != typeOfTime {
+		if substructType != nil && substructType != typeOfTime && substructType != typeOfUser {
 			if name != "" {
 				name = name + "."
 			}
-			sub, err := getStructCodecLocked(substructType)
+			sub, err := getStructCodecLocked(substructType, naming)
 			if err != nil {
 				return nil, err
 			}
@@ -236,6 +603,10 @@ func getStructCodecLocked(t reflect.Type) (ret *structCodec, retErr error) {
 					"datastore: flattening nested structs leads to a slice of slices: field %q", f.Name)
 			}
 			c.hasSlice = c.hasSlice || sub.hasSlice
+			c.hasDefault = c.hasDefault || sub.hasDefault
+			if !fIsSlice {
+				subCodec = sub
+			}
 			for relName := range sub.byName {
 				absName := name + relName
 				if _, ok := c.byName[absName]; ok {
@@ -250,29 +621,129 @@ func getStructCodecLocked(t reflect.Type) (ret *structCodec, retErr error) {
 			c.byName[name] = fieldCodec{index: i}
 		}
 
-		c.byIndex[i] = structTag{
-			name:    name,
-			noIndex: opts == "noindex",
+		tag := structTag{name: name, round: -1, substructCodec: subCodec}
+		for _, opt := range strings.Split(opts, ",") {
+			switch {
+			case opt == "noindex":
+				tag.noIndex = true
+			case opt == "index":
+				tag.index = true
+			case opt == "autonow":
+				tag.autoNow = true
+			case opt == "autoaddonly":
+				tag.autoAddOnly = true
+			case opt == "required":
+				tag.required = true
+			case strings.HasPrefix(opt, "default="):
+				v, err := parseDefault(f.Type, strings.TrimPrefix(opt, "default="))
+				if err != nil {
+					return nil, fmt.Errorf("datastore: invalid default for field %q: %v", f.Name, err)
+				}
+				tag.defaultValue = v
+				c.hasDefault = true
+			case strings.HasPrefix(opt, "round="):
+				n, err := strconv.Atoi(strings.TrimPrefix(opt, "round="))
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("datastore: invalid round for field %q: want a non-negative number of decimal places", f.Name)
+				}
+				t := f.Type
+				if t.Kind() == reflect.Slice {
+					t = t.Elem()
+				}
+				if t.Kind() != reflect.Float32 && t.Kind() != reflect.Float64 {
+					return nil, fmt.Errorf("datastore: round requires a floating-point field: field %q", f.Name)
+				}
+				tag.round = n
+			}
+		}
+		if tag.index && tag.noIndex {
+			return nil, fmt.Errorf("datastore: struct tag has both index and noindex options: field %q", f.Name)
+		}
+		if (tag.autoNow || tag.autoAddOnly) && f.Type != typeOfTime {
+			return nil, fmt.Errorf("datastore: autonow and autoaddonly require a time.Time field: field %q", f.Name)
 		}
+		c.byIndex[i] = tag
 	}
 	c.complete = true
 	return c, nil
 }
 
+// parseDefault parses s, the default value in a struct tag, as a value of
+// type t. t must be a bool, integer, floating-point or string type.
+func parseDefault(t reflect.Type, s string) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Bool:
+		x, err := strconv.ParseBool(s)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		v.SetBool(x)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		v.SetInt(x)
+	case reflect.Float32, reflect.Float64:
+		x, err := strconv.ParseFloat(s, t.Bits())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		v.SetFloat(x)
+	case reflect.String:
+		v.SetString(s)
+	default:
+		return reflect.Value{}, fmt.Errorf("defaults are only supported for bool, integer, float and string fields, not %v", t)
+	}
+	return v, nil
+}
+
+// roundFloat returns v, a floating-point value, rounded half away from zero
+// to places decimal places.
+func roundFloat(v reflect.Value, places int) reflect.Value {
+	x, p := v.Float(), math.Pow10(places)
+	r := math.Floor(math.Abs(x)*p+0.5) / p
+	if math.IsInf(r, 0) || math.IsNaN(r) {
+		// x is too large to have a fractional part at this precision.
+		return v
+	}
+	ret := reflect.New(v.Type()).Elem()
+	ret.SetFloat(math.Copysign(r, x))
+	return ret
+}
+
+// setDefaults sets each field of v that has a default value to that value,
+// unless the loaded property names include the field's. prefix is the
+// property name prefix of v's fields.
+func setDefaults(codec *structCodec, v reflect.Value, loaded map[string]bool, prefix string) {
+	for i, tag := range codec.byIndex {
+		switch {
+		case tag.defaultValue.IsValid():
+			if !loaded[prefix+tag.name] {
+				v.Field(i).Set(tag.defaultValue)
+			}
+		case tag.substructCodec != nil && tag.substructCodec.hasDefault:
+			setDefaults(tag.substructCodec, v.Field(i), loaded, prefix+tag.name)
+		}
+	}
+}
+
 // structPLS adapts a struct to be a PropertyLoadSaver.
 type structPLS struct {
 	v     reflect.Value
 	codec *structCodec
 }
 
-// newStructPLS returns a PropertyLoadSaver for the struct pointer p.
-func newStructPLS(p interface{}) (PropertyLoadSaver, error) {
+// newStructPLS returns a PropertyLoadSaver for the struct pointer p, naming
+// its fields as naming asks.
+func newStructPLS(p interface{}, naming *fieldNaming) (PropertyLoadSaver, error) {
 	v := reflect.ValueOf(p)
 	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
 		return nil, ErrInvalidEntityType
 	}
 	v = v.Elem()
-	codec, err := getStructCodec(v.Type())
+	codec, err := getStructCodec(v.Type(), naming)
 	if err != nil {
 		return nil, err
 	}
@@ -282,7 +753,12 @@ func newStructPLS(p interface{}) (PropertyLoadSaver, error) {
 // LoadStruct loads the properties from p to dst.
 // dst must be a struct pointer.
 func LoadStruct(dst interface{}, p []Property) error {
-	x, err := newStructPLS(dst)
+	return loadStruct(dst, p, nil)
+}
+
+// loadStruct is LoadStruct, naming the fields of dst as naming asks.
+func loadStruct(dst interface{}, p []Property, naming *fieldNaming) error {
+	x, err := newStructPLS(dst, naming)
 	if err != nil {
 		return err
 	}
@@ -291,8 +767,57 @@ func LoadStruct(dst interface{}, p []Property) error {
 
 // SaveStruct returns the properties from src as a slice of Properties.
 // src must be a struct pointer.
+//
+// A field of a slice of struct type, such as the Items []LineItem of an
+// Order, is flattened: each field of LineItem is saved as a multi-valued
+// property, such as "Items.Price", holding a value for each element in
+// order. Loading rebuilds one element per value, so an empty or nil slice
+// is saved as no properties and loads as a nil slice. The elements cannot
+// themselves contain slices other than []byte, and recursive struct types
+// are rejected. Structs nest to any depth: a slice of Address, each with a
+// Geo struct holding a Point, is saved as properties like
+// "Addrs.Geo.Point.Lat".
+//
+// This package does not save embedded entity values, but loads them, such
+// as those written by other client libraries, as if they had been saved
+// flattened. A list of embedded entities loads into a slice of structs,
+// with an element lacking a nested property loading as its zero value.
+//
+// A field of type interface{} is saved as a property of the type of the
+// value it holds, or as a nil property if it holds nil. The value may be of
+// any valid field type other than a struct or a slice, apart from []byte.
+// When loading, the field is set to the property value, which has one of the
+// types listed for Property.Value, such as int64 for an int that was saved. A
+// field of type []interface{} holds a multi-valued property.
+//
+// A field of an integer type, including named ones such as time.Duration, is
+// saved as an int64 property; a time.Duration is stored as its number of
+// nanoseconds, and loads back as the same duration.
+//
+// A field of a named byte slice type, such as json.RawMessage, is saved as a
+// []byte property holding its bytes verbatim, and loaded back unchanged.
+//
+// A field whose type implements encoding.BinaryMarshaler, and whose pointer
+// type implements encoding.BinaryUnmarshaler, is saved as a []byte property
+// holding its binary form, if the type has no built-in representation. For
+// example, a struct type implementing the interfaces is marshaled rather than
+// flattened, but a string type is saved as a string. A converter registered
+// with RegisterConverter takes precedence over the binary form.
+//
+// Similarly, a field whose type implements driver.Valuer, and whose pointer
+// type implements sql.Scanner, such as sql.NullString or sql.NullInt64, is
+// saved as the value returned by its Value method, if the type has no
+// built-in representation. A nil value, such as that of an invalid
+// sql.NullString, is saved as a nil property. When loading, the field's Scan
+// method is called with the property's value, so a nil property loads as an
+// invalid sql.NullString. This takes precedence over the binary form.
+//
+// A field of type url.URL or *url.URL is saved as a string property holding
+// the URL's String form, or as a nil property for a nil *url.URL, and is
+// parsed back when loading. A value that does not parse fails to load with
+// an *ErrFieldMismatch for the field, as a type mismatch would.
 func SaveStruct(src interface{}) ([]Property, error) {
-	x, err := newStructPLS(src)
+	x, err := newStructPLS(src, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -20,8 +20,11 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
@@ -94,6 +97,8 @@ type Query struct {
 	projection []string
 
 	distinct bool
+	dedup    bool
+	prefetch bool
 	keysOnly bool
 	eventual bool
 	limit    int32
@@ -101,7 +106,18 @@ type Query struct {
 	start    []byte
 	end      []byte
 
+	// maxResults is the most results GetAll accepts, or zero for no maximum.
+	maxResults int32
+	// collectLoadErrors is whether GetAll reports load errors in a MultiError.
+	collectLoadErrors bool
+	// strictProjection is whether projection results fail to load into
+	// structs with properties outside the projection.
+	strictProjection bool
+
 	trans *Transaction
+	// cursorTx is the transaction of the start or end cursor, if the cursor
+	// was read in one.
+	cursorTx *Transaction
 
 	err error
 }
@@ -120,6 +136,17 @@ func (q *Query) clone() *Query {
 	return &x
 }
 
+// Kind returns a derivative query for the given entity kind, replacing the
+// kind passed to NewQuery. An empty kind makes the query kindless.
+//
+// The kind of a query is always the one it was given explicitly; it is never
+// inferred from the type of the dst argument passed to GetAll or Next.
+func (q *Query) Kind(kind string) *Query {
+	q = q.clone()
+	q.kind = kind
+	return q
+}
+
 // Ancestor returns a derivative query with an ancestor filter.
 // The ancestor should not be nil.
 func (q *Query) Ancestor(ancestor *Key) *Query {
@@ -128,6 +155,10 @@ func (q *Query) Ancestor(ancestor *Key) *Query {
 		q.err = errors.New("datastore: nil query ancestor")
 		return q
 	}
+	if !ancestor.valid() || ancestor.Incomplete() {
+		q.err = errors.New("datastore: invalid or incomplete query ancestor")
+		return q
+	}
 	q.ancestor = ancestor
 	return q
 }
@@ -141,6 +172,17 @@ func (q *Query) EventualConsistency() *Query {
 	return q
 }
 
+// AsOf returns a derivative query that reads the entities as they were at
+// time t. The datastore API used by this package has no read time in its
+// read options, so running the query fails with an error rather than
+// returning the latest entities. An ancestor query run in a transaction reads
+// a consistent snapshot.
+func (q *Query) AsOf(t time.Time) *Query {
+	q = q.clone()
+	q.err = errReadTime
+	return q
+}
+
 // Transaction returns a derivative query that is associated with the given
 // transaction.
 //
@@ -158,10 +200,28 @@ func (q *Query) Transaction(t *Transaction) *Query {
 // The filterStr argument must be a field name followed by optional space,
 // followed by an operator, one of ">", "<", ">=", "<=", or "=".
 // Fields are compared against the provided value using the operator.
-// Multiple filters are AND'ed together.
+// Multiple filters are AND'ed together, so a conjunction of conditions built
+// at run time, for example from user input, can be expressed by calling
+// Filter once per condition. The datastore does not support OR: to match
+// entities satisfying any of several conditions, run one query per condition
+// and merge the results.
 // Field names which contain spaces, quote marks, or operator characters
 // should be passed as quoted Go string literals as returned by strconv.Quote
 // or the fmt package's %q verb.
+//
+// A filter on a multi-valued property, such as one saved from a slice field,
+// matches an entity if any one of the property's values satisfies it; value
+// is a single element, not a slice. So Filter("Tags =", "go") matches the
+// entities tagged "go" among other tags. Each filter is satisfied
+// independently, which is surprising for inequalities on the same property:
+// Filter("Scores >", 1).Filter("Scores <", 2) matches an entity with scores
+// 0 and 3, since 3 is greater than 1 and 0 is less than 2, even though no
+// single score is between 1 and 2. Equality filters on the same property
+// likewise match entities that have all of the given values.
+//
+// The special field name "__key__" filters on the entity's key, in which case
+// value must be a *Key. Combined with an order on "__key__", it allows stable
+// pagination by key.
 func (q *Query) Filter(filterStr string, value interface{}) *Query {
 	q = q.clone()
 	filterStr = strings.TrimSpace(filterStr)
@@ -194,16 +254,51 @@ func (q *Query) Filter(filterStr string, value interface{}) *Query {
 		q.err = fmt.Errorf("datastore: invalid syntax for quoted field name %q", f.FieldName)
 		return q
 	}
+	if _, ok := f.Value.(*Key); f.FieldName == keyFieldName && !ok {
+		q.err = fmt.Errorf("datastore: %s filter value must be a *Key, got %T", keyFieldName, f.Value)
+		return q
+	}
 	q.filter = append(q.filter, f)
 	return q
 }
 
+// FilterExists returns a derivative query that only matches entities that
+// have at least one indexed value for the named field. It is implemented as
+// the inequality filter fieldName >= nil, since nil sorts before every other
+// value.
+//
+// Because it is an inequality filter, the restrictions on inequality filters
+// apply: the query cannot have an inequality filter on another field, and its
+// first sort order, if any, must be on fieldName. The field must be indexed;
+// entities whose values for the field are all unindexed are never matched.
+// An entity with several values for the field is matched, and returned, once.
+//
+// The datastore cannot directly find entities that lack a field, because
+// such entities are absent from the field's index. To find them, for
+// example during a schema migration, compare the keys returned by a
+// keys-only FilterExists query with those of the whole kind.
+func (q *Query) FilterExists(fieldName string) *Query {
+	q = q.clone()
+	q.filter = append(q.filter, filter{
+		FieldName: fieldName,
+		Op:        greaterEq,
+		Value:     nil,
+	})
+	return q
+}
+
 // Order returns a derivative query with a field-based sort order. Orders are
 // applied in the order they are added. The default order is ascending; to sort
 // in descending order prefix the fieldName with a minus sign (-).
 // Field names which contain spaces, quote marks, or the minus sign
 // should be passed as quoted Go string literals as returned by strconv.Quote
 // or the fmt package's %q verb.
+//
+// Ordering a keys-only query by the special "__scatter__" property returns a
+// pseudo-random sample of keys that are spread evenly across the kind. These
+// keys can be used as split points for scanning a large kind in parallel:
+//
+//	q := datastore.NewQuery("Gopher").Order("__scatter__").KeysOnly().Limit(32)
 func (q *Query) Order(fieldName string) *Query {
 	q = q.clone()
 	fieldName, dir := strings.TrimSpace(fieldName), ascending
@@ -229,6 +324,46 @@ func (q *Query) Order(fieldName string) *Query {
 	return q
 }
 
+// Reverse returns a derivative query whose results are in the reverse order,
+// with each of its sort orders flipped between ascending and descending, as
+// for reading a feed ordered by time newest first:
+//
+//	q := datastore.NewQuery("Post").Order("Created").Reverse() // Same as Order("-Created").
+//
+// Only the sort orders are flipped. The datastore breaks ties between
+// results with equal sort values by key ascending, both in q and in its
+// reverse, so those results are not reversed unless q ends with an explicit
+// order on "__key__".
+//
+// A query without sort orders returns its results in key order; its reverse
+// is ordered by key descending. A query without sort orders but with an
+// inequality filter on a property is ordered by that property, so its
+// reverse is ordered by the property descending. A reversed query needs
+// indexes for the flipped orders, as a query with those orders would. The
+// cursors of a query cannot be used with its reverse, whose results are in
+// another order.
+func (q *Query) Reverse() *Query {
+	q = q.clone()
+	if len(q.order) == 0 {
+		for _, f := range q.filter {
+			if f.Op != equal && f.FieldName != keyFieldName {
+				q.order = []order{{FieldName: f.FieldName, Direction: descending}}
+				return q
+			}
+		}
+		q.order = []order{{FieldName: keyFieldName, Direction: descending}}
+		return q
+	}
+	for i := range q.order {
+		if q.order[i].Direction == ascending {
+			q.order[i].Direction = descending
+		} else {
+			q.order[i].Direction = ascending
+		}
+	}
+	return q
+}
+
 // unquote optionally interprets s as a double-quoted or backquoted Go
 // string literal if it begins with the relevant character.
 func unquote(s string) (string, error) {
@@ -246,6 +381,25 @@ func (q *Query) Project(fieldNames ...string) *Query {
 	return q
 }
 
+// StrictProjection returns a derivative query whose projection results are
+// checked against the structs they are loaded into.
+//
+// A projection result holds only the projected properties, and loading it
+// into a struct sets just the fields of those properties: the other fields
+// keep their values, which are zero for the structs GetAll appends, and no
+// error is reported. A struct with fewer fields than the projection fails
+// with an *ErrFieldMismatch, as for any property without a field. With
+// StrictProjection, loading into a struct with a property outside the
+// projection also fails with an *ErrFieldMismatch, after the projected
+// fields are loaded, so that a projection that no longer covers the struct
+// is noticed rather than leaving fields unset. Results loaded into a
+// PropertyLoadSaver are not checked.
+func (q *Query) StrictProjection() *Query {
+	q = q.clone()
+	q.strictProjection = true
+	return q
+}
+
 // Distinct returns a derivative query that yields de-duplicated entities with
 // respect to the set of projected fields. It is only used for projection
 // queries.
@@ -255,6 +409,37 @@ func (q *Query) Distinct() *Query {
 	return q
 }
 
+// DedupKeys returns a derivative query that yields each key at most once,
+// dropping any later result with the key of an earlier one. The order of the
+// remaining results is unchanged.
+//
+// A query returns the same key more than once when it projects a
+// multi-valued property: there is one result for each of the entity's values
+// of the property. Queries merged by RunMerged may also match the same
+// entity; with DedupKeys, a result of the query is dropped if the merged
+// stream has already returned its key. The limit and offset of the query,
+// and Count, count the results before they are deduplicated.
+func (q *Query) DedupKeys() *Query {
+	q = q.clone()
+	q.dedup = true
+	return q
+}
+
+// Prefetch returns a derivative query whose iterator fetches the next batch
+// of results in the background while the current one is being consumed, so
+// that a large scan does not wait for a call at each batch boundary. At most
+// one batch is fetched ahead, which holds up to two batches in memory.
+//
+// The fetch ahead is made with the iterator's context: cancelling it stops a
+// fetch in progress, whose error is then returned by Next once the current
+// batch is exhausted. An iterator abandoned before then leaves at most one
+// fetch to complete in the background.
+func (q *Query) Prefetch() *Query {
+	q = q.clone()
+	q.prefetch = true
+	return q
+}
+
 // KeysOnly returns a derivative query that yields only keys, not keys and
 // entities. It cannot be used with projection queries.
 func (q *Query) KeysOnly() *Query {
@@ -275,6 +460,45 @@ func (q *Query) Limit(limit int) *Query {
 	return q
 }
 
+// ErrTooManyResults is returned by GetAll when a query matches more results
+// than its MaxResults.
+var ErrTooManyResults = errors.New("datastore: query has more results than its maximum")
+
+// MaxResults returns a derivative query for which GetAll fails with
+// ErrTooManyResults, rather than accumulating all the results in memory, if
+// more than max results match. GetAll then returns the first max keys, and
+// appends the first max entities to its dst. Unlike Limit, MaxResults makes an
+// oversized result an error rather than truncating it, as a guard against a
+// query that is missing a limit. Zero, the default, means no maximum. It has
+// no effect on Run.
+func (q *Query) MaxResults(max int) *Query {
+	q = q.clone()
+	if max < 0 {
+		q.err = errors.New("datastore: negative query maximum results")
+		return q
+	}
+	if max >= math.MaxInt32 {
+		q.err = errors.New("datastore: query maximum results overflow")
+		return q
+	}
+	q.maxResults = int32(max)
+	return q
+}
+
+// CollectLoadErrors returns a derivative query for which GetAll loads every
+// result, even if loading some of them into dst fails, and reports the
+// failures in a MultiError aligned with the returned keys: element i is the
+// error loading the entity of key i, or nil if it loaded. The entities that
+// failed to load are still appended to dst, as partially loaded by their
+// Load method or struct fields. Without CollectLoadErrors, GetAll stops at the
+// first load error other than an *ErrFieldMismatch. Errors running the query
+// itself are returned as is. It has no effect on Run.
+func (q *Query) CollectLoadErrors() *Query {
+	q = q.clone()
+	q.collectLoadErrors = true
+	return q
+}
+
 // Offset returns a derivative query that has an offset of how many keys to
 // skip over before returning results. A negative value is invalid.
 func (q *Query) Offset(offset int) *Query {
@@ -299,6 +523,9 @@ func (q *Query) Start(c Cursor) *Query {
 		return q
 	}
 	q.start = c.cc
+	if c.tx != nil {
+		q.cursorTx = c.tx
+	}
 	return q
 }
 
@@ -310,9 +537,28 @@ func (q *Query) End(c Cursor) *Query {
 		return q
 	}
 	q.end = c.cc
+	if c.tx != nil {
+		q.cursorTx = c.tx
+	}
 	return q
 }
 
+// String returns a description of the query as it is sent to the datastore,
+// including its kind, filters, orders, projection, limit, offset and cursors.
+// It is meant for debugging, such as logging a query that does not return the
+// expected results, and its format may change. If the query is invalid, String
+// returns the error that running it would return.
+func (q *Query) String() string {
+	if q.err != nil {
+		return q.err.Error()
+	}
+	var req pb.RunQueryRequest
+	if err := q.toProto(&req); err != nil {
+		return err.Error()
+	}
+	return proto.CompactTextString(req.Query)
+}
+
 // toProto converts the query to a protocol buffer.
 func (q *Query) toProto(req *pb.RunQueryRequest) error {
 	dst := pb.Query{}
@@ -343,7 +589,7 @@ func (q *Query) toProto(req *pb.RunQueryRequest) error {
 		if qf.FieldName == "" {
 			return errors.New("datastore: empty query filter field name")
 		}
-		v, errStr := interfaceToProto(reflect.ValueOf(qf.Value).Interface())
+		v, errStr := interfaceToProto(qf.Value)
 		if errStr != "" {
 			return errors.New("datastore: bad query filter value type: " + errStr)
 		}
@@ -361,7 +607,7 @@ func (q *Query) toProto(req *pb.RunQueryRequest) error {
 	if q.ancestor != nil {
 		filters = append(filters, &pb.Filter{
 			PropertyFilter: &pb.PropertyFilter{
-				Property: &pb.PropertyReference{Name: proto.String("__key__")},
+				Property: &pb.PropertyReference{Name: proto.String(keyFieldName)},
 				Operator: pb.PropertyFilter_HAS_ANCESTOR.Enum(),
 				Value:    &pb.Value{KeyValue: keyToProto(q.ancestor)},
 			}})
@@ -398,6 +644,9 @@ func (q *Query) toProto(req *pb.RunQueryRequest) error {
 	dst.StartCursor = q.start
 	dst.EndCursor = q.end
 
+	if q.cursorTx != nil && q.cursorTx != q.trans {
+		return errors.New("datastore: cursor from a transactional query used outside its transaction")
+	}
 	if t := q.trans; t != nil {
 		if t.id == nil {
 			return errExpiredTransaction
@@ -418,7 +667,14 @@ func (c *Client) Count(ctx context.Context, q *Query) (int, error) {
 
 	// Run a copy of the query, with keysOnly true (if we're not a projection,
 	// since the two are incompatible).
+	ctx = c.namespaced(ctx)
 	newQ := q.clone()
+	newQ.ancestor = c.bindAncestor(ctx, newQ.ancestor)
+	if t := newQ.trans; t != nil && newQ.ancestor != nil {
+		if err := t.useGroups([]*Key{newQ.ancestor}); err != nil {
+			return 0, err
+		}
+	}
 	newQ.keysOnly = len(newQ.projection) == 0
 	req := &pb.RunQueryRequest{}
 
@@ -435,21 +691,63 @@ func (c *Client) Count(ctx context.Context, q *Query) (int, error) {
 		return 0, err
 	}
 	var n int
+	limit := newQ.limit
 	b := res.Batch
 	for {
 		n += len(b.GetEntityResult())
 		if b.GetMoreResults() != pb.QueryResultBatch_NOT_FINISHED {
 			break
 		}
+		if limit >= 0 {
+			limit -= int32(len(b.GetEntityResult()))
+			if limit <= 0 {
+				// The limit is satisfied, even if the server offers more.
+				break
+			}
+		}
 		var err error
-		// TODO(jbd): Support count queries that have a limit and an offset.
-		if err = callNext(ctx, c, req, res, 0, 0); err != nil {
+		// TODO(jbd): Support count queries that have an offset.
+		if err = callNext(ctx, c, req, res, 0, limit); err != nil {
 			return 0, err
 		}
+		b = res.Batch
 	}
 	return int(n), nil
 }
 
+// QueryPlan is what Explain reports about a query.
+//
+// The datastore API used by this package has no explain mode: it does not
+// report which indexes a query would use or what it would cost. A QueryPlan
+// only holds what Explain learns by running the query with a limit of zero.
+type QueryPlan struct {
+	// HasResults is whether the datastore reported that results match the
+	// query beyond the limit of zero.
+	HasResults bool
+}
+
+// Explain checks that q can be run, without fetching any of its results. It
+// runs a keys-only copy of q, unless q is a projection query, with a limit of
+// zero and no offset, so the datastore validates the query and reports any
+// missing composite index as an error, as running q would, but returns no
+// entities. Since the datastore API has no explain mode, the returned plan
+// does not describe the indexes used or the cost of the query; see
+// QueryPlan.
+func (c *Client) Explain(ctx context.Context, q *Query) (*QueryPlan, error) {
+	eq := q.clone()
+	eq.keysOnly = len(eq.projection) == 0
+	eq.limit = 0
+	eq.offset = 0
+	it := c.Run(ctx, eq)
+	if _, err := it.Next(nil); err != Done {
+		if err == nil {
+			err = errors.New("datastore: internal error: query returned more results than the limit")
+		}
+		return nil, err
+	}
+	return &QueryPlan{HasResults: it.MoreResults() == MoreResultsAfterLimit}, nil
+}
+
 func callNext(ctx context.Context, client *Client, req *pb.RunQueryRequest, res *pb.RunQueryResponse, offset, limit int32) error {
 	if res.GetBatch().EndCursor == nil {
 		return errors.New("datastore: internal error: server did not return a cursor")
@@ -476,17 +774,30 @@ func callNext(ctx context.Context, client *Client, req *pb.RunQueryRequest, res
 // mistakenly passed when *[]PropertyList was intended.
 //
 // The keys returned by GetAll will be in a 1-1 correspondence with the entities
-// added to dst.
+// added to dst. If the query matches no entities, GetAll returns an empty,
+// non-nil slice of keys and a nil error, and leaves dst unchanged. The results
+// are in the order the datastore returns them, which is the query's order:
+// the batches fetched for a query are appended in turn, without reordering.
+//
+// If q is a ``keys-only'' query, GetAll only returns the keys. dst may then be
+// nil, or a *[]*Key to which the keys are also appended:
 //
-// If q is a ``keys-only'' query, GetAll ignores dst and only returns the keys.
+//	var keys []*datastore.Key
+//	_, err := client.GetAll(ctx, q.KeysOnly(), &keys)
+//
+// Any other dst is ignored.
 func (c *Client) GetAll(ctx context.Context, q *Query, dst interface{}) ([]*Key, error) {
 	var (
 		dv               reflect.Value
 		mat              multiArgType
 		elemType         reflect.Type
 		errFieldMismatch error
+		keyDst           *[]*Key
+		loadErrs         MultiError
 	)
-	if !q.keysOnly {
+	if q.keysOnly {
+		keyDst, _ = dst.(*[]*Key)
+	} else {
 		dv = reflect.ValueOf(dst)
 		if dv.Kind() != reflect.Ptr || dv.IsNil() {
 			return nil, ErrInvalidEntityType
@@ -498,8 +809,16 @@ func (c *Client) GetAll(ctx context.Context, q *Query, dst interface{}) ([]*Key,
 		}
 	}
 
-	var keys []*Key
-	for t := c.Run(ctx, q); ; {
+	runQ := q
+	if q.maxResults > 0 && (q.limit < 0 || q.limit > q.maxResults) {
+		// Fetch one more result than allowed, to tell whether there are more.
+		runQ = q.clone()
+		runQ.limit = q.maxResults + 1
+	}
+
+	// keys is non-nil even if the query matches no entities.
+	keys := []*Key{}
+	for t := c.Run(ctx, runQ); ; {
 		k, e, err := t.next()
 		if err == Done {
 			break
@@ -507,6 +826,9 @@ func (c *Client) GetAll(ctx context.Context, q *Query, dst interface{}) ([]*Key,
 		if err != nil {
 			return keys, err
 		}
+		if q.maxResults > 0 && len(keys) == int(q.maxResults) {
+			return keys, ErrTooManyResults
+		}
 		if !q.keysOnly {
 			ev := reflect.New(elemType)
 			if elemType.Kind() == reflect.Map {
@@ -525,7 +847,18 @@ func (c *Client) GetAll(ctx context.Context, q *Query, dst interface{}) ([]*Key,
 				x := reflect.MakeMap(elemType)
 				ev.Elem().Set(x)
 			}
-			if err = loadEntity(ev.Interface(), e); err != nil {
+			err = c.loadEntity(ev.Interface(), e)
+			if err == nil {
+				err = q.checkProjection(ev.Interface(), c.naming)
+			}
+			if q.collectLoadErrors {
+				if err != nil && loadErrs == nil {
+					loadErrs = make(MultiError, len(keys), len(keys)+1)
+				}
+				if loadErrs != nil {
+					loadErrs = append(loadErrs, err)
+				}
+			} else if err != nil {
 				if _, ok := err.(*ErrFieldMismatch); ok {
 					// We continue loading entities even in the face of field mismatch errors.
 					// If we encounter any other error, that other error is returned. Otherwise,
@@ -539,17 +872,44 @@ func (c *Client) GetAll(ctx context.Context, q *Query, dst interface{}) ([]*Key,
 				ev = ev.Elem()
 			}
 			dv.Set(reflect.Append(dv, ev))
+		} else if keyDst != nil {
+			*keyDst = append(*keyDst, k)
 		}
 		keys = append(keys, k)
 	}
+	if loadErrs != nil {
+		return keys, loadErrs
+	}
 	return keys, errFieldMismatch
 }
 
 // Run runs the given query in the given context.
+//
+// The returned Iterator fetches results from the datastore in batches as they
+// are consumed, and only holds the current batch in memory. Prefer it to
+// GetAll for queries that may match a large number of entities.
+//
+// The datastore API used by this package reports no read time or snapshot
+// version for the batches of a query, and cannot read entities as of a past
+// time, so the batches of a non-transactional query are not read from a
+// single snapshot. For an incremental sync, save a time.Time field with the
+// autonow tag option and filter on it, such as with Filter("Updated >", t),
+// for the entities written since an earlier sync. Only an ancestor query run
+// in a transaction reads a consistent snapshot.
 func (c *Client) Run(ctx context.Context, q *Query) *Iterator {
 	if q.err != nil {
 		return &Iterator{err: q.err}
 	}
+	ctx = c.namespaced(ctx)
+	if a := c.bindAncestor(ctx, q.ancestor); a != q.ancestor {
+		q = q.clone()
+		q.ancestor = a
+	}
+	if q.trans != nil && q.ancestor != nil {
+		if err := q.trans.useGroups([]*Key{q.ancestor}); err != nil {
+			return &Iterator{err: err}
+		}
+	}
 	t := &Iterator{
 		ctx:    ctx,
 		client: c,
@@ -580,6 +940,7 @@ func (c *Client) Run(ctx context.Context, q *Query) *Iterator {
 			t.err = err
 			break
 		}
+		b = t.res.GetBatch()
 		skip := b.GetSkippedResults()
 		if skip < 0 {
 			t.err = errors.New("datastore: internal error: negative number of skipped_results")
@@ -590,9 +951,112 @@ func (c *Client) Run(ctx context.Context, q *Query) *Iterator {
 	if offset < 0 {
 		t.err = errors.New("datastore: internal error: query offset was overshot")
 	}
+	t.skipped = q.offset - offset
+	if t.limit >= 0 {
+		t.limit -= int32(len(b.GetEntityResult()))
+	}
+	if t.err == nil {
+		t.startPrefetch()
+	}
 	return t
 }
 
+// SkippedResults returns the number of results that the datastore skipped to
+// satisfy the query's offset. It is less than the offset if fewer results
+// than the offset matched the query, which lets callers paginating with
+// Offset tell how far the results extend, as in "showing 51-100 of 120".
+func (t *Iterator) SkippedResults() int {
+	return int(t.skipped)
+}
+
+// QueryResult is a result of a query sent by RunChan.
+type QueryResult struct {
+	// Key is the key of the entity. It is nil if Err is non-nil.
+	Key *Key
+	// Properties holds the entity's properties, unless the query is
+	// keys-only. They can be loaded into a struct with LoadStruct.
+	Properties PropertyList
+	// Err is the error encountered while running the query, if any. A
+	// QueryResult with a non-nil Err is the last one sent.
+	Err error
+}
+
+// RunChan runs the given query in the given context and sends its results on
+// ch as they are fetched. RunChan returns immediately; ch is closed once all
+// the results have been sent, after sending a QueryResult with a non-nil Err
+// if the query failed, or when ctx is done.
+func (c *Client) RunChan(ctx context.Context, q *Query, ch chan<- QueryResult) {
+	go func() {
+		defer close(ch)
+		it := c.Run(ctx, q)
+		for {
+			var r QueryResult
+			r.Key, r.Err = it.Next(&r.Properties)
+			if r.Err == Done {
+				return
+			}
+			select {
+			case ch <- r:
+			case <-ctx.Done():
+				return
+			}
+			if r.Err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// NamespaceResult holds the results of a query run in one namespace by
+// GetAllInNamespaces.
+type NamespaceResult struct {
+	// Namespace is the namespace the query was run in.
+	Namespace string
+	// Keys are the keys of the matching entities.
+	Keys []*Key
+	// Entities holds the matching entities, aligned with Keys, unless the
+	// query is keys-only.
+	Entities []PropertyList
+	// Err is the error returned by GetAll for the namespace, if any. Keys and
+	// Entities hold the results fetched before the error.
+	Err error
+}
+
+// GetAllInNamespaces runs q with GetAll in each of the given namespaces, as
+// for a report spanning several tenants, and returns the results of each
+// namespace, in the order of namespaces. The namespace of ctx is ignored.
+//
+// At most parallelism queries are run at once; a parallelism of zero or less
+// runs them one at a time. Any limit or offset of q applies to each namespace
+// separately. A query that fails in one namespace does not stop the others:
+// its error is reported in the Err field of that namespace's result.
+func (c *Client) GetAllInNamespaces(ctx context.Context, q *Query, namespaces []string, parallelism int) []NamespaceResult {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	results := make([]NamespaceResult, len(namespaces))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, ns := range namespaces {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(r *NamespaceResult, ns string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			r.Namespace = ns
+			var dst interface{}
+			if !q.keysOnly {
+				dst = &r.Entities
+			}
+			r.Keys, r.Err = c.GetAll(WithNamespace(ctx, ns), q, dst)
+		}(&results[i], ns)
+	}
+	wg.Wait()
+	return results
+}
+
 // Iterator is the result of running a query.
 type Iterator struct {
 	ctx    context.Context
@@ -612,6 +1076,128 @@ type Iterator struct {
 	// prevCC is the compiled cursor that marks the end of the previous batch
 	// of results.
 	prevCC []byte
+	// skipped is the number of results skipped to satisfy the query's offset.
+	skipped int32
+	// seen holds the keys returned so far, if the query deduplicates them.
+	seen map[string]bool
+	// returned is the number of results returned so far.
+	returned int
+	// prefetched receives the batch after the current one, if the query
+	// prefetches and the batch is being fetched.
+	prefetched chan prefetchResult
+}
+
+// prefetchResult is a batch of results fetched ahead of consumption.
+type prefetchResult struct {
+	query *pb.Query
+	res   *pb.RunQueryResponse
+	err   error
+}
+
+// startPrefetch starts fetching the batch after the current one, if the
+// query prefetches and there is one.
+func (t *Iterator) startPrefetch() {
+	b := t.res.GetBatch()
+	if !t.q.prefetch || b.GetMoreResults() != pb.QueryResultBatch_NOT_FINISHED || t.limit == 0 {
+		return
+	}
+	// The fetch uses copies of the request's query and of the current end
+	// cursor, so the iterator can be used meanwhile.
+	req := t.req
+	req.Query = proto.Clone(t.req.Query).(*pb.Query)
+	res := &pb.RunQueryResponse{Batch: &pb.QueryResultBatch{EndCursor: b.EndCursor}}
+	ch := make(chan prefetchResult, 1)
+	go func(ctx context.Context, client *Client, limit int32) {
+		err := callNext(ctx, client, &req, res, 0, limit)
+		ch <- prefetchResult{req.Query, res, err}
+	}(t.ctx, t.client, t.limit)
+	t.prefetched = ch
+}
+
+// fetchNext replaces the current batch of results with the next one, waiting
+// for it if it is being prefetched.
+func (t *Iterator) fetchNext() error {
+	if t.prefetched == nil {
+		return callNext(t.ctx, t.client, &t.req, &t.res, 0, t.limit)
+	}
+	r := <-t.prefetched
+	t.prefetched = nil
+	if r.err != nil {
+		return r.err
+	}
+	t.req.Query = r.query
+	t.res = *r.res
+	return nil
+}
+
+// ResultType is the type of the results returned by a query.
+type ResultType int
+
+const (
+	// FullResults are complete entities.
+	FullResults ResultType = iota
+	// ProjectionResults are entities holding only the projected properties.
+	ProjectionResults
+	// KeysOnlyResults are keys, without any properties.
+	KeysOnlyResults
+)
+
+// ResultType returns the type of the results in the batch most recently
+// fetched by the iterator, as reported by the datastore. Projection and
+// keys-only queries return projection and keys-only results respectively.
+func (t *Iterator) ResultType() ResultType {
+	switch t.res.GetBatch().GetEntityResultType() {
+	case pb.EntityResult_PROJECTION:
+		return ProjectionResults
+	case pb.EntityResult_KEY_ONLY:
+		return KeysOnlyResults
+	}
+	return FullResults
+}
+
+// MoreResultsType tells whether a query has more results than those fetched.
+type MoreResultsType int
+
+const (
+	// NotFinished means the iterator has not fetched the last batch of
+	// results. It fetches the next batch as the results are consumed. If
+	// iteration stopped at the query's limit, it means there may be more
+	// results beyond the limit.
+	NotFinished MoreResultsType = iota
+	// MoreResultsAfterLimit means the query's limit was reached and more
+	// results may match. A query started at the iterator's cursor returns
+	// them, so a "next page" control should be shown.
+	MoreResultsAfterLimit
+	// NoMoreResults means no more results match the query. A query started
+	// at the iterator's cursor returns no results.
+	NoMoreResults
+)
+
+// MoreResults reports whether there are more results than those fetched, as
+// reported by the datastore for the batch most recently fetched by the
+// iterator. It is most useful once Next has returned Done, to tell whether a
+// query with a limit has more results after the limit.
+func (t *Iterator) MoreResults() MoreResultsType {
+	switch t.res.GetBatch().GetMoreResults() {
+	case pb.QueryResultBatch_MORE_RESULTS_AFTER_LIMIT:
+		return MoreResultsAfterLimit
+	case pb.QueryResultBatch_NO_MORE_RESULTS:
+		return NoMoreResults
+	}
+	return NotFinished
+}
+
+// BatchResults returns the number of results in the batch most recently
+// fetched by the iterator, for reporting the progress of a long scan. A batch
+// that only skips results to satisfy the query's offset has no results.
+func (t *Iterator) BatchResults() int {
+	return len(t.res.GetBatch().GetEntityResult())
+}
+
+// ResultsReturned returns the number of results Next has returned so far,
+// across all the batches fetched by the iterator.
+func (t *Iterator) ResultsReturned() int {
+	return t.returned
 }
 
 // Done is returned when a query iteration has completed.
@@ -622,19 +1208,148 @@ var Done = errors.New("datastore: query has no more results")
 //
 // If the query is not keys only and dst is non-nil, it also loads the entity
 // stored for that key into the struct pointer or PropertyLoadSaver dst, with
-// the same semantics and possible errors as for the Get function.
+// the same semantics and possible errors as for the Get function. Nothing is
+// loaded into dst if the datastore returned keys-only results.
 func (t *Iterator) Next(dst interface{}) (*Key, error) {
 	k, e, err := t.next()
 	if err != nil {
 		return nil, err
 	}
-	if dst != nil && !t.q.keysOnly {
-		err = loadEntity(dst, e)
+	if dst != nil && !t.q.keysOnly && t.ResultType() != KeysOnlyResults {
+		err = t.load(dst, e)
 	}
 	return k, err
 }
 
+// load loads e, one of the iterator's results, into dst.
+func (t *Iterator) load(dst interface{}, e *pb.Entity) error {
+	if err := t.client.loadEntity(dst, e); err != nil {
+		return err
+	}
+	return t.q.checkProjection(dst, t.client.naming)
+}
+
+// RawResult is a query result whose entity has not been decoded, as returned
+// by Iterator.NextRaw.
+type RawResult struct {
+	// Key is the key of the result.
+	Key *Key
+
+	it     *Iterator
+	entity *pb.Entity // nil for keys-only results.
+}
+
+// NextRaw is like Next, but returns the next result without decoding its
+// entity. The entity is decoded only if the result's Into method is called,
+// so a scan that discards most results, for example after inspecting their
+// keys, does not spend the time to decode them. When there are no more
+// results, Done is returned as the error.
+//
+// Since the kind of a result is known before decoding it, NextRaw lets a
+// kindless query, such as one over all the descendants of an ancestor, load
+// each result into the type for its kind:
+//
+//	r, err := it.NextRaw()
+//	...
+//	switch r.Kind() {
+//	case "Post":
+//		var p Post
+//		err = r.Into(&p)
+//	case "Comment":
+//		var c Comment
+//		err = r.Into(&c)
+//	}
+func (t *Iterator) NextRaw() (*RawResult, error) {
+	k, e, err := t.next()
+	if err != nil {
+		return nil, err
+	}
+	r := &RawResult{Key: k, it: t}
+	if !t.q.keysOnly && t.ResultType() != KeysOnlyResults {
+		r.entity = e
+	}
+	return r, nil
+}
+
+// Kind returns the kind of the result's entity, the kind of its key.
+func (r *RawResult) Kind() string {
+	return r.Key.Kind()
+}
+
+// Into loads the result's entity into the struct pointer or
+// PropertyLoadSaver dst, as Iterator.Next would have. Nothing is loaded if
+// the result is keys-only. Into may be called more than once, decoding the
+// entity each time, and after the iterator has moved on to later results.
+func (r *RawResult) Into(dst interface{}) error {
+	if r.entity == nil {
+		return nil
+	}
+	return r.it.load(dst, r.entity)
+}
+
+// checkProjection returns an *ErrFieldMismatch if q is a strict projection
+// query and dst, the struct pointer a result was loaded into, has a property
+// outside the projection, naming the fields of dst as naming asks.
+func (q *Query) checkProjection(dst interface{}, naming *fieldNaming) error {
+	if !q.strictProjection || len(q.projection) == 0 {
+		return nil
+	}
+	if _, ok := dst.(PropertyLoadSaver); ok {
+		return nil
+	}
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	t := v.Elem().Type()
+	codec, err := getStructCodec(t, naming)
+	if err != nil {
+		return err
+	}
+	projected := make(map[string]bool, len(q.projection))
+	for _, name := range q.projection {
+		projected[name] = true
+	}
+	var missing []string
+	for name, fc := range codec.byName {
+		if !projected[name] && t.Field(fc.index).PkgPath == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return &ErrFieldMismatch{
+		StructType: t,
+		FieldName:  missing[0],
+		Reason:     "not in the query's projection",
+	}
+}
+
 func (t *Iterator) next() (*Key, *pb.Entity, error) {
+	for {
+		k, e, err := t.nextResult()
+		if err != nil {
+			return k, e, err
+		}
+		if !t.q.dedup {
+			t.returned++
+			return k, e, nil
+		}
+		if s := k.String(); !t.seen[s] {
+			if t.seen == nil {
+				t.seen = make(map[string]bool)
+			}
+			t.seen[s] = true
+			t.returned++
+			return k, e, nil
+		}
+	}
+}
+
+// nextResult returns the next result of the query, including any duplicate.
+func (t *Iterator) nextResult() (*Key, *pb.Entity, error) {
 	if t.err != nil {
 		return nil, nil, t.err
 	}
@@ -646,11 +1361,18 @@ func (t *Iterator) next() (*Key, *pb.Entity, error) {
 			t.err = Done
 			return nil, nil, t.err
 		}
+		// The server may report more results after the query's limit has
+		// been reached; they are not part of this query's results.
+		if t.limit == 0 {
+			t.err = Done
+			return nil, nil, t.err
+		}
 		t.prevCC = b.GetEndCursor()
-		if err := callNext(t.ctx, t.client, &t.req, &t.res, 0, t.limit); err != nil {
+		if err := t.fetchNext(); err != nil {
 			t.err = err
 			return nil, nil, t.err
 		}
+		b = t.res.GetBatch()
 		if b.GetSkippedResults() != 0 {
 			t.err = errors.New("datastore: internal error: iterator has skipped results")
 			return nil, nil, t.err
@@ -663,6 +1385,7 @@ func (t *Iterator) next() (*Key, *pb.Entity, error) {
 				return nil, nil, t.err
 			}
 		}
+		t.startPrefetch()
 	}
 
 	// Extract the key from the t.i'th element of t.res.Result.
@@ -679,7 +1402,39 @@ func (t *Iterator) next() (*Key, *pb.Entity, error) {
 }
 
 // Cursor returns a cursor for the iterator's current location.
+//
+// After Next has returned a result, the cursor is the position just after
+// it: a query started at the cursor, with Query.Start, returns the results
+// that follow, so a long job can checkpoint after any result and resume
+// there. The datastore API returns a cursor only at the end of each batch of
+// results, not for each result. At the end of a batch, as after the last
+// result counted by BatchResults, Cursor is free; within a batch it runs the
+// query again, keys-only and offset from the start of the batch, to get
+// one. That costs a call, and the cursor is only best-effort: if entities are
+// concurrently added or removed before the position, it may skip or repeat
+// results.
+//
+// If the iterator's query is associated with a transaction, the cursor may
+// only be used by queries associated with the same transaction, which
+// continue to read from the transaction's snapshot. Using it with another
+// query fails with an error. Reusing cursors across transactions is not
+// supported. Encoding the cursor with String drops its transaction, so
+// encoded cursors are not checked.
 func (t *Iterator) Cursor() (Cursor, error) {
+	return t.cursorAt(t.i)
+}
+
+// cursorAt returns a cursor for the position before the i'th result of the
+// current batch, associated with the query's transaction.
+func (t *Iterator) cursorAt(i int) (Cursor, error) {
+	c, err := t.compiledCursorAt(i)
+	if err == nil && c.cc != nil && t.q != nil {
+		c.tx = t.q.trans
+	}
+	return c, err
+}
+
+func (t *Iterator) compiledCursorAt(i int) (Cursor, error) {
 	if t.err != nil && t.err != Done {
 		return Cursor{}, t.err
 	}
@@ -687,7 +1442,7 @@ func (t *Iterator) Cursor() (Cursor, error) {
 	// return the compiled cursor at that end.
 	b := t.res.Batch
 	skipped := b.GetSkippedResults()
-	if t.i == 0 && skipped == 0 {
+	if i == 0 && skipped == 0 {
 		if t.prevCC == nil {
 			// A nil pointer (of type *pb.CompiledCursor) means no constraint:
 			// passing it as the end cursor of a new query means unlimited results
@@ -698,10 +1453,10 @@ func (t *Iterator) Cursor() (Cursor, error) {
 			// Iterator.Cursor should return "the start" instead of unlimited.
 			return Cursor{}, nil
 		}
-		return Cursor{t.prevCC}, nil
+		return Cursor{cc: t.prevCC}, nil
 	}
-	if t.i == len(b.EntityResult) {
-		return Cursor{b.EndCursor}, nil
+	if i == len(b.EntityResult) {
+		return Cursor{cc: b.EndCursor}, nil
 	}
 	// Otherwise, re-run the query offset to this iterator's position, starting from
 	// the most recent compiled cursor. This is done on a best-effort basis, as it
@@ -709,10 +1464,10 @@ func (t *Iterator) Cursor() (Cursor, error) {
 	// cursor returned may be inconsistent.
 	q := t.q.clone()
 	q.start = t.prevCC
-	q.offset = skipped + int32(t.i)
+	q.offset = skipped + int32(i)
 	q.limit = 0
 	q.keysOnly = len(q.projection) == 0
-	t1 := t.client.Run(t.ctx, t.q)
+	t1 := t.client.Run(t.ctx, q)
 	_, _, err := t1.next()
 	if err != Done {
 		if err == nil {
@@ -720,7 +1475,7 @@ func (t *Iterator) Cursor() (Cursor, error) {
 		}
 		return Cursor{}, err
 	}
-	return Cursor{t1.res.Batch.EndCursor}, nil
+	return Cursor{cc: t1.res.Batch.EndCursor}, nil
 }
 
 // Cursor is an iterator's position. It can be converted to and from an opaque
@@ -728,6 +1483,7 @@ func (t *Iterator) Cursor() (Cursor, error) {
 // query with the same kind, ancestor, filter and order constraints.
 type Cursor struct {
 	cc []byte
+	tx *Transaction // The transaction the cursor was read in, if any.
 }
 
 // String returns a base-64 string representation of a cursor.
@@ -751,5 +1507,5 @@ func DecodeCursor(s string) (Cursor, error) {
 	if err != nil {
 		return Cursor{}, err
 	}
-	return Cursor{b}, nil
+	return Cursor{cc: b}, nil
 }
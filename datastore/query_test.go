@@ -17,12 +17,17 @@ package datastore
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
 	pb "google.golang.org/cloud/internal/datastore"
+	"google.golang.org/cloud/internal/transport"
 )
 
 var (
@@ -54,6 +59,13 @@ func (c fakeClient) Call(ctx context.Context, method string, req, resp proto.Mes
 	return c(req, resp)
 }
 
+// fakeCtxClient is a fakeClient that is also given the context of the call.
+type fakeCtxClient func(ctx context.Context, req, resp proto.Message) (err error)
+
+func (c fakeCtxClient) Call(ctx context.Context, method string, req, resp proto.Message) error {
+	return c(ctx, req, resp)
+}
+
 func fakeRunQuery(in *pb.RunQueryRequest, out *pb.RunQueryResponse) error {
 	expectedIn := &pb.RunQueryRequest{
 		Query: &pb.Query{
@@ -382,6 +394,44 @@ func TestQueriesAreImmutable(t *testing.T) {
 	}
 }
 
+func TestReverse(t *testing.T) {
+	orders := func(q *Query) []string {
+		req := &pb.RunQueryRequest{}
+		if err := q.toProto(req); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, o := range req.Query.Order {
+			got = append(got, fmt.Sprintf("%s %v", o.Property.GetName(), o.GetDirection()))
+		}
+		return got
+	}
+	q := NewQuery("Post").Order("Created").Order("-Score").Order("__key__")
+	r := q.Reverse()
+	if got, want := orders(r), []string{"Created DESCENDING", "Score ASCENDING", "__key__ DESCENDING"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got orders %q, want %q", got, want)
+	}
+	if got, want := orders(r.Reverse()), orders(q); !reflect.DeepEqual(got, want) {
+		t.Errorf("reversed twice: got orders %q, want %q", got, want)
+	}
+	if got, want := orders(q), []string{"Created ASCENDING", "Score DESCENDING", "__key__ ASCENDING"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("original query: got orders %q, want %q", got, want)
+	}
+	if got, want := orders(NewQuery("Post").Reverse()), []string{"__key__ DESCENDING"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("no orders: got orders %q, want %q", got, want)
+	}
+	// The datastore requires the first sort order to be on the property of
+	// an inequality filter.
+	q = NewQuery("Post").Filter("Author =", "a").Filter("Score >", 3)
+	if got, want := orders(q.Reverse()), []string{"Score DESCENDING"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("inequality filter: got orders %q, want %q", got, want)
+	}
+	q = NewQuery("Post").Filter("__key__ >", NewKey(context.Background(), "Post", "p", 0, nil))
+	if got, want := orders(q.Reverse()), []string{"__key__ DESCENDING"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("key inequality filter: got orders %q, want %q", got, want)
+	}
+}
+
 func TestFilterParser(t *testing.T) {
 	testCases := []struct {
 		filterStr     string
@@ -480,3 +530,1206 @@ func TestNamespaceQuery(t *testing.T) {
 		t.Errorf("Count: got namespace %q, want %q", got, want)
 	}
 }
+
+func TestNamespaceInheritance(t *testing.T) {
+	ctx := context.Background()
+	type request struct {
+		namespace, ancestorNamespace string
+	}
+	var got request
+	base := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			in := req.(*pb.RunQueryRequest)
+			got = request{
+				in.GetPartitionId().GetNamespace(),
+				in.Query.GetFilter().GetPropertyFilter().GetValue().GetKeyValue().GetPartitionId().GetNamespace(),
+			}
+			*resp.(*pb.RunQueryResponse) = pb.RunQueryResponse{Batch: &pb.QueryResultBatch{
+				EntityResultType: pb.EntityResult_KEY_ONLY.Enum(),
+				MoreResults:      pb.QueryResultBatch_NO_MORE_RESULTS.Enum(),
+			}}
+			return nil
+		}),
+	}
+	client := base.InNamespace("tenant")
+	for _, tc := range []struct {
+		desc string
+		ctx  context.Context
+		want request
+	}{
+		{"inherited", ctx, request{"tenant", "tenant"}},
+		{"explicit default", WithNamespace(ctx, ""), request{"", ""}},
+		{"explicit named", WithNamespace(ctx, "other"), request{"other", "other"}},
+	} {
+		q := NewQuery("Gopher").Ancestor(NewKey(tc.ctx, "Gopher", "george", 0, nil)).KeysOnly()
+		for _, run := range []func() error{
+			func() error { _, err := client.GetAll(tc.ctx, q, nil); return err },
+			func() error { _, err := client.Count(tc.ctx, q); return err },
+		} {
+			got = request{}
+			if err := run(); err != nil {
+				t.Fatalf("%s: %v", tc.desc, err)
+			}
+			if got != tc.want {
+				t.Errorf("%s: got namespace %q and ancestor namespace %q, want %q and %q",
+					tc.desc, got.namespace, got.ancestorNamespace, tc.want.namespace, tc.want.ancestorNamespace)
+			}
+		}
+	}
+}
+
+func TestScatterQuery(t *testing.T) {
+	q := NewQuery("Gopher").Order("__scatter__").KeysOnly().Limit(32)
+	var req pb.RunQueryRequest
+	if err := q.toProto(&req); err != nil {
+		t.Fatal(err)
+	}
+	want := &pb.Query{
+		Kind: []*pb.KindExpression{{Name: proto.String("Gopher")}},
+		Projection: []*pb.PropertyExpression{
+			{Property: &pb.PropertyReference{Name: proto.String("__key__")}},
+		},
+		Order: []*pb.PropertyOrder{
+			{
+				Property:  &pb.PropertyReference{Name: proto.String("__scatter__")},
+				Direction: pb.PropertyOrder_ASCENDING.Enum(),
+			},
+		},
+		Limit: proto.Int32(32),
+	}
+	if !proto.Equal(req.Query, want) {
+		t.Errorf("got %v, want %v", req.Query, want)
+	}
+}
+
+// fakeKeysClient returns a client that answers queries with the given keys,
+// split into batches. Each query request is passed to check.
+func fakeKeysClient(batches [][]*Key, check func(*pb.RunQueryRequest)) *Client {
+	return &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			in := req.(*pb.RunQueryRequest)
+			check(in)
+			i := 0
+			if c := in.Query.StartCursor; c != nil {
+				i = int(c[0])
+			}
+			b := &pb.QueryResultBatch{
+				EntityResultType: pb.EntityResult_KEY_ONLY.Enum(),
+				MoreResults:      pb.QueryResultBatch_NO_MORE_RESULTS.Enum(),
+			}
+			if i < len(batches)-1 {
+				b.MoreResults = pb.QueryResultBatch_NOT_FINISHED.Enum()
+				b.EndCursor = []byte{byte(i + 1)}
+			}
+			for _, k := range batches[i] {
+				b.EntityResult = append(b.EntityResult, &pb.EntityResult{Entity: &pb.Entity{Key: keyToProto(k)}})
+			}
+			*resp.(*pb.RunQueryResponse) = pb.RunQueryResponse{Batch: b}
+			return nil
+		}),
+	}
+}
+
+func TestProjectionSubset(t *testing.T) {
+	ctx := context.Background()
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			var props []*pb.Property
+			for _, p := range req.(*pb.RunQueryRequest).Query.Projection {
+				if name := p.Property.GetName(); name == "Name" {
+					props = append(props, &pb.Property{Name: proto.String(name), Value: &pb.Value{StringValue: proto.String("George")}})
+				}
+			}
+			*resp.(*pb.RunQueryResponse) = pb.RunQueryResponse{Batch: &pb.QueryResultBatch{
+				EntityResultType: pb.EntityResult_PROJECTION.Enum(),
+				MoreResults:      pb.QueryResultBatch_NO_MORE_RESULTS.Enum(),
+				EntityResult: []*pb.EntityResult{{Entity: &pb.Entity{
+					Key:      keyToProto(NewKey(ctx, "Gopher", "", 1, nil)),
+					Property: props,
+				}}},
+			}}
+			return nil
+		}),
+	}
+	q := NewQuery("Gopher").Project("Name")
+
+	var gs []Gopher
+	if _, err := client.GetAll(ctx, q, &gs); err != nil {
+		t.Fatal(err)
+	}
+	if want := []Gopher{{Name: "George"}}; !reflect.DeepEqual(gs, want) {
+		t.Errorf("got %v, want %v", gs, want)
+	}
+	g := Gopher{Height: 7}
+	if _, err := client.Run(ctx, q).Next(&g); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Gopher{Name: "George", Height: 7}); g != want {
+		t.Errorf("Next: got %v, want the unprojected field untouched: %v", g, want)
+	}
+
+	gs = nil
+	_, err := client.GetAll(ctx, q.StrictProjection(), &gs)
+	if e, ok := err.(*ErrFieldMismatch); !ok || e.FieldName != "Height" {
+		t.Errorf("strict: got error %v, want a field mismatch for Height", err)
+	}
+	if len(gs) != 1 || gs[0].Name != "George" {
+		t.Errorf("strict: got %v, want the projected fields loaded", gs)
+	}
+	gs = nil
+	if _, err := client.GetAll(ctx, NewQuery("Gopher").Project("Name", "Height").StrictProjection(), &gs); err != nil {
+		t.Errorf("strict, full projection: %v", err)
+	}
+	var pl PropertyList
+	if _, err := client.Run(ctx, q.StrictProjection()).Next(&pl); err != nil {
+		t.Errorf("strict, PropertyList: %v", err)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	ctx := context.Background()
+	var moreResults pb.QueryResultBatch_MoreResultsType
+	var callErr error
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			q := req.(*pb.RunQueryRequest).Query
+			if q.Limit == nil || q.GetLimit() != 0 || q.Offset != nil {
+				t.Errorf("got limit %v, offset %v; want a limit of 0 and no offset", q.Limit, q.Offset)
+			}
+			if p := q.Projection; len(p) != 1 || p[0].Property.GetName() != keyFieldName {
+				t.Errorf("got projection %v, want a keys-only query", p)
+			}
+			if callErr != nil {
+				return callErr
+			}
+			*resp.(*pb.RunQueryResponse) = pb.RunQueryResponse{Batch: &pb.QueryResultBatch{
+				EntityResultType: pb.EntityResult_KEY_ONLY.Enum(),
+				MoreResults:      moreResults.Enum(),
+			}}
+			return nil
+		}),
+	}
+	q := NewQuery("Gopher").Filter("Height >", 10).Order("-Height").Offset(5).Limit(20)
+	for _, mr := range []pb.QueryResultBatch_MoreResultsType{pb.QueryResultBatch_MORE_RESULTS_AFTER_LIMIT, pb.QueryResultBatch_NO_MORE_RESULTS} {
+		moreResults = mr
+		plan, err := client.Explain(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := mr == pb.QueryResultBatch_MORE_RESULTS_AFTER_LIMIT; plan.HasResults != want {
+			t.Errorf("%v: got HasResults %v, want %v", mr, plan.HasResults, want)
+		}
+	}
+
+	callErr = &transport.ErrHTTP{StatusCode: http.StatusPreconditionFailed, Body: []byte("no matching index found")}
+	if _, err := client.Explain(ctx, q); err != callErr {
+		t.Errorf("missing index: got error %v, want %v", err, callErr)
+	}
+	if _, err := client.Explain(ctx, NewQuery("Gopher").Filter("Height ~", 1)); err == nil {
+		t.Error("invalid query: got nil error")
+	}
+}
+
+func TestCountMultipleBatches(t *testing.T) {
+	ctx := context.Background()
+	k := NewKey(ctx, "Gopher", "", 1, nil)
+	client := fakeKeysClient([][]*Key{{k, k}, {k}, {k, k, k}}, func(*pb.RunQueryRequest) {})
+	n, err := client.Count(ctx, NewQuery("Gopher"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Errorf("got %d, want 6", n)
+	}
+}
+
+func TestKeyFilterAndOrder(t *testing.T) {
+	k := NewKey(context.Background(), "Gopher", "", 6, nil)
+	q := NewQuery("Gopher").Filter("__key__ >", k).Order("__key__")
+	var req pb.RunQueryRequest
+	if err := q.toProto(&req); err != nil {
+		t.Fatal(err)
+	}
+	wantFilter := &pb.Filter{PropertyFilter: &pb.PropertyFilter{
+		Property: &pb.PropertyReference{Name: proto.String("__key__")},
+		Operator: pb.PropertyFilter_GREATER_THAN.Enum(),
+		Value:    &pb.Value{KeyValue: keyToProto(k)},
+	}}
+	if !proto.Equal(req.Query.Filter, wantFilter) {
+		t.Errorf("got filter %v, want %v", req.Query.Filter, wantFilter)
+	}
+	if got := req.Query.Order[0].Property.GetName(); got != "__key__" {
+		t.Errorf("got order on %q, want __key__", got)
+	}
+
+	if q := NewQuery("Gopher").Filter("__key__ =", "george"); q.err == nil {
+		t.Error("got nil error for a __key__ filter with a string value")
+	}
+}
+
+func TestQueryCursors(t *testing.T) {
+	start, end := Cursor{cc: []byte("start")}, Cursor{cc: []byte("end")}
+	q := NewQuery("Gopher").Start(start).End(end)
+	var req pb.RunQueryRequest
+	if err := q.toProto(&req); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(req.Query.StartCursor); got != "start" {
+		t.Errorf("got start cursor %q, want %q", got, "start")
+	}
+	if got := string(req.Query.EndCursor); got != "end" {
+		t.Errorf("got end cursor %q, want %q", got, "end")
+	}
+
+	if q := NewQuery("Gopher").End(Cursor{}); q.err == nil {
+		t.Error("End with an empty cursor: got nil error")
+	}
+}
+
+func TestRunChan(t *testing.T) {
+	ctx := context.Background()
+	k1, k2, k3 := NewKey(ctx, "Gopher", "", 1, nil), NewKey(ctx, "Gopher", "", 2, nil), NewKey(ctx, "Gopher", "", 3, nil)
+	client := fakeKeysClient([][]*Key{{k1, k2}, {k3}}, func(*pb.RunQueryRequest) {})
+
+	ch := make(chan QueryResult)
+	client.RunChan(ctx, NewQuery("Gopher").KeysOnly(), ch)
+	var got []*Key
+	for r := range ch {
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		got = append(got, r.Key)
+	}
+	if want := []*Key{k1, k2, k3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got keys %v, want %v", got, want)
+	}
+
+	// A failing query sends its error and closes the channel.
+	ch = make(chan QueryResult)
+	client.RunChan(ctx, NewQuery("Gopher").Offset(-1), ch)
+	if r := <-ch; r.Err == nil {
+		t.Error("got nil error for an invalid query")
+	}
+	if _, ok := <-ch; ok {
+		t.Error("channel not closed after an error")
+	}
+
+	// Cancelling the context stops sending results.
+	cctx, cancel := context.WithCancel(ctx)
+	ch = make(chan QueryResult)
+	client.RunChan(cctx, NewQuery("Gopher").KeysOnly(), ch)
+	<-ch
+	cancel()
+	for range ch {
+	}
+}
+
+func TestGetAllKeysOnlyDst(t *testing.T) {
+	ctx := context.Background()
+	k1, k2, k3 := NewKey(ctx, "Gopher", "", 1, nil), NewKey(ctx, "Gopher", "", 2, nil), NewKey(ctx, "Gopher", "", 3, nil)
+	client := fakeKeysClient([][]*Key{{k1, k2}, {k3}}, func(*pb.RunQueryRequest) {})
+	q := NewQuery("Gopher").KeysOnly()
+
+	existing := NewKey(ctx, "Gopher", "", 9, nil)
+	dst := []*Key{existing}
+	keys, err := client.GetAll(ctx, q, &dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []*Key{existing, k1, k2, k3}; !reflect.DeepEqual(dst, want) {
+		t.Errorf("got dst %v, want %v", dst, want)
+	}
+	if want := []*Key{k1, k2, k3}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got keys %v, want %v", keys, want)
+	}
+
+	if keys, err := client.GetAll(ctx, q, nil); err != nil || len(keys) != 3 {
+		t.Errorf("nil dst: got %d keys and error %v, want 3 keys", len(keys), err)
+	}
+}
+
+func TestGetAllLimit(t *testing.T) {
+	ctx := context.Background()
+	// The datastore has five gophers, and returns at most two per batch.
+	var limits []int32
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			q := req.(*pb.RunQueryRequest).Query
+			limits = append(limits, q.GetLimit())
+			start := 0
+			if c := q.StartCursor; c != nil {
+				start = int(c[0])
+			}
+			end := start + 2
+			if end > 5 {
+				end = 5
+			}
+			if q.Limit != nil && start+int(q.GetLimit()) < end {
+				end = start + int(q.GetLimit())
+			}
+			b := &pb.QueryResultBatch{
+				EntityResultType: pb.EntityResult_FULL.Enum(),
+				MoreResults:      pb.QueryResultBatch_NOT_FINISHED.Enum(),
+				EndCursor:        []byte{byte(end)},
+			}
+			if end == 5 {
+				b.MoreResults = pb.QueryResultBatch_NO_MORE_RESULTS.Enum()
+			}
+			for i := start; i < end; i++ {
+				b.EntityResult = append(b.EntityResult, &pb.EntityResult{Entity: &pb.Entity{
+					Key: keyToProto(NewKey(ctx, "Gopher", "", int64(i+1), nil)),
+					Property: []*pb.Property{
+						{Name: proto.String("Height"), Value: &pb.Value{IntegerValue: proto.Int64(int64(i))}},
+					},
+				}})
+			}
+			*resp.(*pb.RunQueryResponse) = pb.RunQueryResponse{Batch: b}
+			return nil
+		}),
+	}
+	var dst []Gopher
+	keys, err := client.GetAll(ctx, NewQuery("Gopher").Limit(3), &dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[2].ID() != 3 || !reflect.DeepEqual(dst, []Gopher{{Height: 0}, {Height: 1}, {Height: 2}}) {
+		t.Errorf("got keys %v and entities %v, want the first three gophers", keys, dst)
+	}
+	if want := []int32{3, 1}; !reflect.DeepEqual(limits, want) {
+		t.Errorf("got request limits %v, want %v", limits, want)
+	}
+
+	limits = nil
+	keys, err = client.GetAll(ctx, NewQuery("Gopher").KeysOnly(), nil)
+	if err != nil || len(keys) != 5 || len(limits) != 3 {
+		t.Errorf("keys-only: got %d keys in %d batches and error %v, want 5 keys in 3 batches", len(keys), len(limits), err)
+	}
+}
+
+func TestGetAllEmpty(t *testing.T) {
+	ctx := context.Background()
+	client := fakeKeysClient([][]*Key{{}}, func(*pb.RunQueryRequest) {})
+	q := NewQuery("Gopher")
+
+	for _, dst := range []interface{}{&[]Gopher{}, &[]*Gopher{}, &[]PropertyList{}, &[]PropertyMap{}} {
+		keys, err := client.GetAll(ctx, q, dst)
+		if err != nil {
+			t.Errorf("%T: %v", dst, err)
+			continue
+		}
+		if keys == nil || len(keys) != 0 {
+			t.Errorf("%T: got keys %#v, want an empty non-nil slice", dst, keys)
+		}
+		if n := reflect.ValueOf(dst).Elem().Len(); n != 0 {
+			t.Errorf("%T: got %d entities, want 0", dst, n)
+		}
+	}
+
+	var keyDst []*Key
+	keys, err := client.GetAll(ctx, q.KeysOnly(), &keyDst)
+	if err != nil || keys == nil || len(keys) != 0 || len(keyDst) != 0 {
+		t.Errorf("keys-only: got keys %#v, dst %v and error %v", keys, keyDst, err)
+	}
+
+	if _, err := client.GetAll(ctx, q, &[]interface{}{}); err != ErrInvalidEntityType {
+		t.Errorf("*[]interface{}: got error %v, want ErrInvalidEntityType", err)
+	}
+
+	it := client.Run(ctx, q)
+	if _, err := it.Next(&Gopher{}); err != Done {
+		t.Errorf("Next: got error %v, want Done", err)
+	}
+}
+
+func TestFilterExistsProto(t *testing.T) {
+	req := &pb.RunQueryRequest{}
+	if err := NewQuery("Gopher").FilterExists("Email").toProto(req); err != nil {
+		t.Fatal(err)
+	}
+	f := req.Query.Filter.GetPropertyFilter()
+	if f.GetProperty().GetName() != "Email" || f.GetOperator() != pb.PropertyFilter_GREATER_THAN_OR_EQUAL {
+		t.Errorf("got filter %v, want Email >=", f)
+	}
+	if !proto.Equal(f.Value, &pb.Value{}) {
+		t.Errorf("got filter value %v, want null", f.Value)
+	}
+}
+
+func TestTransactionalCursor(t *testing.T) {
+	ctx := context.Background()
+	k := NewKey(ctx, "Gopher", "", 1, nil)
+	var nQuery int
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			switch resp := resp.(type) {
+			case *pb.BeginTransactionResponse:
+				resp.Transaction = []byte("tx")
+			case *pb.RunQueryResponse:
+				nQuery++
+				resp.Batch = &pb.QueryResultBatch{
+					EntityResultType: pb.EntityResult_KEY_ONLY.Enum(),
+					EntityResult:     []*pb.EntityResult{{Entity: &pb.Entity{Key: keyToProto(k)}}},
+					EndCursor:        []byte("end"),
+					MoreResults:      pb.QueryResultBatch_NO_MORE_RESULTS.Enum(),
+				}
+			}
+			return nil
+		}),
+	}
+	tx, err := client.NewTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewQuery("Gopher").KeysOnly()
+	it := client.Run(ctx, q.Transaction(tx))
+	if _, err := it.Next(nil); err != nil {
+		t.Fatal(err)
+	}
+	c, err := it.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Run(ctx, q.Transaction(tx).Start(c)).Next(nil); err != nil {
+		t.Errorf("same transaction: %v", err)
+	}
+	n := nQuery
+	if _, err := client.Run(ctx, q.Start(c)).Next(nil); err == nil || !strings.Contains(err.Error(), "outside its transaction") {
+		t.Errorf("no transaction: got error %v", err)
+	}
+	if nQuery != n {
+		t.Errorf("got %d queries for a misused cursor, want none", nQuery-n)
+	}
+
+	// An encoded cursor does not carry its transaction.
+	dc, err := DecodeCursor(c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Run(ctx, q.Start(dc)).Next(nil); err != nil {
+		t.Errorf("decoded cursor: %v", err)
+	}
+}
+
+func TestSkippedResults(t *testing.T) {
+	ctx := context.Background()
+	// The datastore skips at most 3 results per batch, and 7 match in all.
+	matched := int32(7)
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			offset := req.(*pb.RunQueryRequest).Query.GetOffset()
+			skip := offset
+			if skip > 3 {
+				skip = 3
+			}
+			if skip > matched {
+				skip = matched
+			}
+			matched -= skip
+			more := pb.QueryResultBatch_NOT_FINISHED
+			if matched == 0 {
+				more = pb.QueryResultBatch_NO_MORE_RESULTS
+			}
+			*resp.(*pb.RunQueryResponse) = pb.RunQueryResponse{Batch: &pb.QueryResultBatch{
+				EntityResultType: pb.EntityResult_KEY_ONLY.Enum(),
+				SkippedResults:   proto.Int32(skip),
+				EndCursor:        []byte("c"),
+				MoreResults:      more.Enum(),
+			}}
+			return nil
+		}),
+	}
+	for _, tc := range []struct{ offset, want int }{{0, 0}, {5, 5}, {10, 7}} {
+		matched = 7
+		it := client.Run(ctx, NewQuery("Gopher").KeysOnly().Offset(tc.offset))
+		if got := it.SkippedResults(); got != tc.want {
+			t.Errorf("offset %d: got %d skipped results, want %d", tc.offset, got, tc.want)
+		}
+	}
+}
+
+func TestLimitStopsPagination(t *testing.T) {
+	ctx := context.Background()
+	var limits []int32
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			in := req.(*pb.RunQueryRequest)
+			limits = append(limits, in.Query.GetLimit())
+			// Return at most two results per batch, and always claim there
+			// are more, as the server may do once a limit is reached.
+			n := int(in.Query.GetLimit())
+			if n > 2 {
+				n = 2
+			}
+			b := &pb.QueryResultBatch{
+				EntityResultType: pb.EntityResult_KEY_ONLY.Enum(),
+				MoreResults:      pb.QueryResultBatch_NOT_FINISHED.Enum(),
+				EndCursor:        []byte("next"),
+			}
+			for i := 0; i < n; i++ {
+				k := NewKey(ctx, "Gopher", "", int64(i+1), nil)
+				b.EntityResult = append(b.EntityResult, &pb.EntityResult{Entity: &pb.Entity{Key: keyToProto(k)}})
+			}
+			*resp.(*pb.RunQueryResponse) = pb.RunQueryResponse{Batch: b}
+			return nil
+		}),
+	}
+	q := NewQuery("Gopher").KeysOnly().Limit(3)
+
+	keys, err := client.GetAll(ctx, q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Errorf("GetAll: got %d keys, want 3", len(keys))
+	}
+	if want := []int32{3, 1}; !reflect.DeepEqual(limits, want) {
+		t.Errorf("GetAll: got request limits %v, want %v", limits, want)
+	}
+
+	limits = nil
+	n, err := client.Count(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("Count: got %d, want 3", n)
+	}
+	if want := []int32{3, 1}; !reflect.DeepEqual(limits, want) {
+		t.Errorf("Count: got request limits %v, want %v", limits, want)
+	}
+}
+
+// loadRecorder is a PropertyLoadSaver that records whether it was loaded.
+type loadRecorder bool
+
+func (r *loadRecorder) Load([]Property) error     { *r = true; return nil }
+func (r *loadRecorder) Save() ([]Property, error) { return nil, nil }
+
+// evenItem fails to load odd times.
+type evenItem struct {
+	Time int64
+}
+
+func (e *evenItem) Load(props []Property) error {
+	if err := LoadStruct(e, props); err != nil {
+		return err
+	}
+	if e.Time%2 != 0 {
+		return fmt.Errorf("odd time %d", e.Time)
+	}
+	return nil
+}
+
+func (e *evenItem) Save() ([]Property, error) { return SaveStruct(e) }
+
+func TestCollectLoadErrors(t *testing.T) {
+	ctx := context.Background()
+	client := fakeFeedClient(map[string][]int64{"Post": {2, 3, 4}}, func(*pb.RunQueryRequest) {})
+
+	var items []evenItem
+	if _, err := client.GetAll(ctx, NewQuery("Post"), &items); err == nil || len(items) != 1 {
+		t.Errorf("without CollectLoadErrors: got %d items and error %v, want 1 item and an error", len(items), err)
+	}
+
+	items = nil
+	keys, err := client.GetAll(ctx, NewQuery("Post").CollectLoadErrors(), &items)
+	me, ok := err.(MultiError)
+	if !ok || len(me) != 3 || me[0] != nil || me[1] == nil || me[2] != nil {
+		t.Fatalf("got error %v, want a MultiError failing the second result", err)
+	}
+	if len(keys) != 3 || len(items) != 3 || items[2].Time != 4 {
+		t.Errorf("got %d keys and items %v, want 3 of each", len(keys), items)
+	}
+
+	items = nil
+	client = fakeFeedClient(map[string][]int64{"Post": {2, 4}}, func(*pb.RunQueryRequest) {})
+	if _, err := client.GetAll(ctx, NewQuery("Post").CollectLoadErrors(), &items); err != nil {
+		t.Errorf("no load errors: got error %v", err)
+	}
+}
+
+func TestIteratorResultType(t *testing.T) {
+	ctx := context.Background()
+	k := NewKey(ctx, "Gopher", "", 1, nil)
+	for _, tc := range []struct {
+		pbType pb.EntityResult_ResultType
+		want   ResultType
+	}{
+		{pb.EntityResult_FULL, FullResults},
+		{pb.EntityResult_PROJECTION, ProjectionResults},
+		{pb.EntityResult_KEY_ONLY, KeysOnlyResults},
+	} {
+		client := &Client{
+			client: fakeClient(func(req, resp proto.Message) error {
+				*resp.(*pb.RunQueryResponse) = pb.RunQueryResponse{Batch: &pb.QueryResultBatch{
+					EntityResultType: tc.pbType.Enum(),
+					MoreResults:      pb.QueryResultBatch_NO_MORE_RESULTS.Enum(),
+					EntityResult:     []*pb.EntityResult{{Entity: &pb.Entity{Key: keyToProto(k)}}},
+				}}
+				return nil
+			}),
+		}
+		it := client.Run(ctx, NewQuery("Gopher"))
+		if got := it.ResultType(); got != tc.want {
+			t.Errorf("%v: got result type %v, want %v", tc.pbType, got, tc.want)
+		}
+		var r loadRecorder
+		if _, err := it.Next(&r); err != nil {
+			t.Fatalf("%v: %v", tc.pbType, err)
+		}
+		if want := tc.want != KeysOnlyResults; bool(r) != want {
+			t.Errorf("%v: got loaded %v, want %v", tc.pbType, r, want)
+		}
+	}
+}
+
+func TestQueryString(t *testing.T) {
+	q := NewQuery("Gopher").Filter("Height >", 10).Order("-Height").Project("Name", "Height").Limit(5)
+	got := q.String()
+	for _, want := range []string{`name:"Gopher"`, `name:"Height"`, `name:"Name"`, `integer_value:10`, `limit:5`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got %s, want it to contain %s", got, want)
+		}
+	}
+
+	if got, want := NewQuery("Gopher").Filter("Height", 1).String(), "datastore: invalid operator"; !strings.HasPrefix(got, want) {
+		t.Errorf("invalid query: got %q, want prefix %q", got, want)
+	}
+}
+
+func TestGetAllInNamespaces(t *testing.T) {
+	ctx := context.Background()
+	var (
+		mu                sync.Mutex
+		running, maxAtOne int
+	)
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			mu.Lock()
+			running++
+			if running > maxAtOne {
+				maxAtOne = running
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				running--
+				mu.Unlock()
+			}()
+			time.Sleep(time.Millisecond)
+
+			ns := req.(*pb.RunQueryRequest).GetPartitionId().GetNamespace()
+			if ns == "bad" {
+				return errors.New("query failed")
+			}
+			k := NewKey(WithNamespace(ctx, ns), "Gopher", "", 1, nil)
+			*resp.(*pb.RunQueryResponse) = pb.RunQueryResponse{Batch: &pb.QueryResultBatch{
+				EntityResultType: pb.EntityResult_FULL.Enum(),
+				MoreResults:      pb.QueryResultBatch_NO_MORE_RESULTS.Enum(),
+				EntityResult: []*pb.EntityResult{{Entity: &pb.Entity{
+					Key:      keyToProto(k),
+					Property: []*pb.Property{{Name: proto.String("Name"), Value: &pb.Value{StringValue: proto.String(ns)}}},
+				}}},
+			}}
+			return nil
+		}),
+	}
+
+	namespaces := []string{"", "a", "bad", "b"}
+	results := client.GetAllInNamespaces(WithNamespace(ctx, "ignored"), NewQuery("Gopher"), namespaces, 2)
+	if len(results) != len(namespaces) {
+		t.Fatalf("got %d results, want %d", len(results), len(namespaces))
+	}
+	for i, r := range results {
+		if r.Namespace != namespaces[i] {
+			t.Errorf("result %d: got namespace %q, want %q", i, r.Namespace, namespaces[i])
+		}
+		if r.Namespace == "bad" {
+			if r.Err == nil {
+				t.Errorf("%q: got nil error", r.Namespace)
+			}
+			continue
+		}
+		if r.Err != nil {
+			t.Errorf("%q: %v", r.Namespace, r.Err)
+			continue
+		}
+		if len(r.Keys) != 1 || r.Keys[0].Namespace() != r.Namespace {
+			t.Errorf("%q: got keys %v", r.Namespace, r.Keys)
+		}
+		if want := []PropertyList{{{Name: "Name", Value: r.Namespace}}}; !reflect.DeepEqual(r.Entities, want) {
+			t.Errorf("%q: got entities %v, want %v", r.Namespace, r.Entities, want)
+		}
+	}
+	if maxAtOne > 2 {
+		t.Errorf("got %d concurrent queries, want at most 2", maxAtOne)
+	}
+}
+
+func TestMaxResults(t *testing.T) {
+	ctx := context.Background()
+	k := NewKey(ctx, "Gopher", "", 1, nil)
+	var limits []int32
+	client := fakeKeysClient([][]*Key{{k, k}, {k, k}}, func(req *pb.RunQueryRequest) {
+		limits = append(limits, req.Query.GetLimit())
+	})
+
+	keys, err := client.GetAll(ctx, NewQuery("Gopher").KeysOnly().MaxResults(4), nil)
+	if err != nil || len(keys) != 4 {
+		t.Errorf("at maximum: got %d keys and error %v, want 4 keys", len(keys), err)
+	}
+	keys, err = client.GetAll(ctx, NewQuery("Gopher").KeysOnly().MaxResults(3), nil)
+	if err != ErrTooManyResults || len(keys) != 3 {
+		t.Errorf("over maximum: got %d keys and error %v, want 3 keys and ErrTooManyResults", len(keys), err)
+	}
+	if limits[len(limits)-2] != 4 {
+		t.Errorf("got request limit %d, want 4", limits[len(limits)-2])
+	}
+	if err := NewQuery("Gopher").MaxResults(-1).err; err == nil {
+		t.Error("got nil error for negative maximum")
+	}
+}
+
+func TestDedupKeys(t *testing.T) {
+	ctx := context.Background()
+	k1, k2, k3 := NewKey(ctx, "Gopher", "", 1, nil), NewKey(ctx, "Gopher", "", 2, nil), NewKey(ctx, "Gopher", "", 3, nil)
+	client := fakeKeysClient([][]*Key{{k1, k2, k1}, {k3, k2}}, func(*pb.RunQueryRequest) {})
+
+	keys, err := client.GetAll(ctx, NewQuery("Gopher").KeysOnly(), nil)
+	if err != nil || len(keys) != 5 {
+		t.Errorf("without DedupKeys: got %d keys and error %v, want 5 keys", len(keys), err)
+	}
+	keys, err = client.GetAll(ctx, NewQuery("Gopher").KeysOnly().DedupKeys(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []*Key{k1, k2, k3}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("with DedupKeys: got %v, want %v", keys, want)
+	}
+}
+
+func TestIteratorMoreResults(t *testing.T) {
+	ctx := context.Background()
+	k := NewKey(ctx, "Gopher", "", 1, nil)
+	for _, tc := range []struct {
+		pbType pb.QueryResultBatch_MoreResultsType
+		want   MoreResultsType
+	}{
+		{pb.QueryResultBatch_NOT_FINISHED, NotFinished},
+		{pb.QueryResultBatch_MORE_RESULTS_AFTER_LIMIT, MoreResultsAfterLimit},
+		{pb.QueryResultBatch_NO_MORE_RESULTS, NoMoreResults},
+	} {
+		client := &Client{
+			client: fakeClient(func(req, resp proto.Message) error {
+				*resp.(*pb.RunQueryResponse) = pb.RunQueryResponse{Batch: &pb.QueryResultBatch{
+					EntityResultType: pb.EntityResult_KEY_ONLY.Enum(),
+					MoreResults:      tc.pbType.Enum(),
+					EndCursor:        []byte("end"),
+					EntityResult:     []*pb.EntityResult{{Entity: &pb.Entity{Key: keyToProto(k)}}},
+				}}
+				return nil
+			}),
+		}
+		it := client.Run(ctx, NewQuery("Gopher").KeysOnly().Limit(1))
+		for {
+			if _, err := it.Next(nil); err == Done {
+				break
+			} else if err != nil {
+				t.Fatalf("%v: %v", tc.pbType, err)
+			}
+		}
+		if got := it.MoreResults(); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.pbType, got, tc.want)
+		}
+	}
+}
+
+// countingPLS counts the entities loaded into it.
+type countingPLS struct {
+	loads int
+	props PropertyList
+}
+
+func (c *countingPLS) Load(props []Property) error {
+	c.loads++
+	c.props = props
+	return nil
+}
+
+func (c *countingPLS) Save() ([]Property, error) { return c.props, nil }
+
+func TestNextRaw(t *testing.T) {
+	ctx := context.Background()
+	client := fakeFeedClient(map[string][]int64{"Post": {3, 2, 1}}, func(*pb.RunQueryRequest) {})
+	it := client.Run(ctx, NewQuery("Post"))
+	var results []*RawResult
+	var dst countingPLS
+	for {
+		r, err := it.NextRaw()
+		if err == Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, r)
+		if r.Key.ID() == 2 {
+			if err := r.Into(&dst); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3", len(results))
+	}
+	if dst.loads != 1 || !reflect.DeepEqual(dst.props, PropertyList{{Name: "Time", Value: int64(2)}}) {
+		t.Errorf("got %d loads of %v, want the second result loaded once", dst.loads, dst.props)
+	}
+	// Results can be decoded after the iterator has moved on.
+	var item feedItem
+	if err := results[0].Into(&item); err != nil || item.Time != 3 {
+		t.Errorf("decoding the first result: got %v, %v", item, err)
+	}
+
+	r, err := client.Run(ctx, NewQuery("Post").KeysOnly()).NextRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	item = feedItem{}
+	if err := r.Into(&item); err != nil || item.Time != 0 {
+		t.Errorf("keys-only: got %v, %v; want nothing loaded", item, err)
+	}
+}
+
+func TestNextRawKindless(t *testing.T) {
+	ctx := context.Background()
+	parent := NewKey(ctx, "Thread", "t", 0, nil)
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			q := req.(*pb.RunQueryRequest).Query
+			if len(q.Kind) != 0 || q.Filter == nil {
+				t.Errorf("got query %v, want a kindless ancestor query", q)
+			}
+			result := func(kind string, id int64, props ...*pb.Property) *pb.EntityResult {
+				return &pb.EntityResult{Entity: &pb.Entity{Key: keyToProto(NewKey(ctx, kind, "", id, parent)), Property: props}}
+			}
+			*resp.(*pb.RunQueryResponse) = pb.RunQueryResponse{Batch: &pb.QueryResultBatch{
+				EntityResultType: pb.EntityResult_FULL.Enum(),
+				MoreResults:      pb.QueryResultBatch_NO_MORE_RESULTS.Enum(),
+				EntityResult: []*pb.EntityResult{
+					result("Gopher", 1, &pb.Property{Name: proto.String("Name"), Value: &pb.Value{StringValue: proto.String("g")}}),
+					result("Post", 2, &pb.Property{Name: proto.String("Time"), Value: &pb.Value{IntegerValue: proto.Int64(5)}}),
+					result("Gopher", 3, &pb.Property{Name: proto.String("Height"), Value: &pb.Value{IntegerValue: proto.Int64(7)}}),
+				},
+			}}
+			return nil
+		}),
+	}
+	it := client.Run(ctx, NewQuery("").Ancestor(parent))
+	var got []interface{}
+	for {
+		r, err := it.NextRaw()
+		if err == Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch r.Kind() {
+		case "Gopher":
+			var g Gopher
+			err = r.Into(&g)
+			got = append(got, g)
+		case "Post":
+			var p feedItem
+			err = r.Into(&p)
+			got = append(got, p)
+		default:
+			t.Errorf("got unexpected kind %q", r.Kind())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []interface{}{Gopher{Name: "g"}, feedItem{Time: 5}, Gopher{Height: 7}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCursorMidBatch(t *testing.T) {
+	ctx := context.Background()
+	var offsets []int32
+	client := fakeFeedClient(map[string][]int64{"Post": {5, 4, 3, 2, 1}}, func(req *pb.RunQueryRequest) {
+		offsets = append(offsets, req.Query.GetOffset())
+	})
+	it := client.Run(ctx, NewQuery("Post"))
+	for i := 0; i < 2; i++ {
+		if _, err := it.Next(&feedItem{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := it.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The cursor within the batch came from a query offset to the position.
+	if want := []int32{0, 2}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("got query offsets %v, want %v", offsets, want)
+	}
+
+	var got []int64
+	for it := client.Run(ctx, NewQuery("Post").Start(c)); ; {
+		var item feedItem
+		if _, err := it.Next(&item); err == Done {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, item.Time)
+	}
+	if want := []int64{3, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resumed at the cursor: got %v, want %v", got, want)
+	}
+}
+
+func TestIteratorProgress(t *testing.T) {
+	ctx := context.Background()
+	k := NewKey(ctx, "Gopher", "", 1, nil)
+	client := fakeKeysClient([][]*Key{{k, k, k}, {k, k}}, func(*pb.RunQueryRequest) {})
+	it := client.Run(ctx, NewQuery("Gopher").KeysOnly())
+	var batches, returned []int
+	for {
+		if _, err := it.Next(nil); err == Done {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		batches = append(batches, it.BatchResults())
+		returned = append(returned, it.ResultsReturned())
+	}
+	if want := []int{3, 3, 3, 2, 2}; !reflect.DeepEqual(batches, want) {
+		t.Errorf("got batch sizes %v, want %v", batches, want)
+	}
+	if want := []int{1, 2, 3, 4, 5}; !reflect.DeepEqual(returned, want) {
+		t.Errorf("got results returned %v, want %v", returned, want)
+	}
+}
+
+func TestMultiValuedPropertyFilter(t *testing.T) {
+	ctx := context.Background()
+	k := NewKey(ctx, "Gopher", "", 1, nil)
+	var filter *pb.Filter
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			filter = req.(*pb.RunQueryRequest).Query.Filter
+			score := func(n int64) *pb.Value { return &pb.Value{IntegerValue: proto.Int64(n)} }
+			*resp.(*pb.RunQueryResponse) = pb.RunQueryResponse{Batch: &pb.QueryResultBatch{
+				EntityResultType: pb.EntityResult_FULL.Enum(),
+				MoreResults:      pb.QueryResultBatch_NO_MORE_RESULTS.Enum(),
+				EntityResult: []*pb.EntityResult{{Entity: &pb.Entity{
+					Key: keyToProto(k),
+					Property: []*pb.Property{{
+						Name:  proto.String("Scores"),
+						Value: &pb.Value{ListValue: []*pb.Value{score(0), score(3)}},
+					}},
+				}}},
+			}}
+			return nil
+		}),
+	}
+	type Player struct {
+		Scores []int
+	}
+	var dst []Player
+	if _, err := client.GetAll(ctx, NewQuery("Player").Filter("Scores >", 1).Filter("Scores <", 2), &dst); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := filter.GetCompositeFilter().GetFilter()
+	if len(fs) != 2 {
+		t.Fatalf("got filter %v, want two property filters", filter)
+	}
+	for i, op := range []pb.PropertyFilter_Operator{pb.PropertyFilter_GREATER_THAN, pb.PropertyFilter_LESS_THAN} {
+		pf := fs[i].GetPropertyFilter()
+		if pf.GetProperty().GetName() != "Scores" || pf.GetOperator() != op || pf.GetValue().ListValue != nil {
+			t.Errorf("filter %d: got %v, want a %v filter on a single Scores value", i, pf, op)
+		}
+	}
+	if want := []Player{{Scores: []int{0, 3}}}; !reflect.DeepEqual(dst, want) {
+		t.Errorf("got %+v, want %+v", dst, want)
+	}
+
+	if err := NewQuery("Player").Filter("Scores =", []int64{1}).toProto(&pb.RunQueryRequest{}); err == nil {
+		t.Error("got nil error for a slice filter value")
+	}
+}
+
+func TestGetAllPreservesOrder(t *testing.T) {
+	ctx := context.Background()
+	// The keys are deliberately not in key order, as for a query sorted by
+	// another property.
+	var batches [][]*Key
+	var want []*Key
+	for _, ids := range [][]int64{{5, 2}, {9}, {1, 7, 3}} {
+		var b []*Key
+		for _, id := range ids {
+			k := NewKey(ctx, "Gopher", "", id, nil)
+			b = append(b, k)
+			want = append(want, k)
+		}
+		batches = append(batches, b)
+	}
+	client := fakeKeysClient(batches, func(*pb.RunQueryRequest) {})
+	got, err := client.GetAll(ctx, NewQuery("Gopher").Order("-Height").KeysOnly(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got keys %v, want %v", got, want)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	ctx := context.Background()
+	var batches [][]*Key
+	var want []*Key
+	for i := int64(0); i < 3; i++ {
+		b := []*Key{NewKey(ctx, "Gopher", "", 2*i+1, nil), NewKey(ctx, "Gopher", "", 2*i+2, nil)}
+		batches = append(batches, b)
+		want = append(want, b...)
+	}
+	fetched := make(chan []byte, len(batches))
+	client := fakeKeysClient(batches, func(req *pb.RunQueryRequest) {
+		fetched <- req.Query.StartCursor
+	})
+	it := client.Run(ctx, NewQuery("Gopher").KeysOnly().Prefetch())
+	// The second batch is fetched before any result is consumed.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-fetched:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("batch %d was not fetched ahead", i)
+		}
+	}
+	var got []*Key
+	for {
+		k, err := it.Next(nil)
+		if err == Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, k)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got keys %v, want %v", got, want)
+	}
+	if c := <-fetched; !reflect.DeepEqual(c, []byte{2}) || len(fetched) != 0 {
+		t.Errorf("got start cursor %v for the last fetch, want [2] and no more fetches", c)
+	}
+}
+
+func TestPrefetchCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	k := NewKey(ctx, "Gopher", "", 1, nil)
+	client := &Client{
+		client: fakeCtxClient(func(ctx context.Context, req, resp proto.Message) error {
+			if req.(*pb.RunQueryRequest).Query.StartCursor != nil {
+				// The fetch ahead only returns once it is cancelled.
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			*resp.(*pb.RunQueryResponse) = pb.RunQueryResponse{Batch: &pb.QueryResultBatch{
+				EntityResultType: pb.EntityResult_KEY_ONLY.Enum(),
+				MoreResults:      pb.QueryResultBatch_NOT_FINISHED.Enum(),
+				EndCursor:        []byte{1},
+				EntityResult:     []*pb.EntityResult{{Entity: &pb.Entity{Key: keyToProto(k)}}},
+			}}
+			return nil
+		}),
+	}
+	it := client.Run(ctx, NewQuery("Gopher").KeysOnly().Prefetch())
+	if _, err := it.Next(nil); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := it.Next(nil); err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestKeyedPropertyList(t *testing.T) {
+	ctx := context.Background()
+	entity := func(k *pb.Key) *pb.Entity {
+		return &pb.Entity{Key: k, Property: []*pb.Property{
+			{Name: proto.String("Name"), Value: &pb.Value{StringValue: proto.String(protoToKey(k).StringID())}},
+		}}
+	}
+	keys := []*Key{NewKey(ctx, "Gopher", "george", 0, nil), NewKey(ctx, "Gopher", "rufus", 0, nil)}
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			switch resp := resp.(type) {
+			case *pb.RunQueryResponse:
+				b := &pb.QueryResultBatch{
+					EntityResultType: pb.EntityResult_FULL.Enum(),
+					MoreResults:      pb.QueryResultBatch_NO_MORE_RESULTS.Enum(),
+				}
+				for _, k := range keys {
+					b.EntityResult = append(b.EntityResult, &pb.EntityResult{Entity: entity(keyToProto(k))})
+				}
+				resp.Batch = b
+			case *pb.LookupResponse:
+				for _, k := range req.(*pb.LookupRequest).Key {
+					resp.Found = append(resp.Found, &pb.EntityResult{Entity: entity(k)})
+				}
+			}
+			return nil
+		}),
+	}
+
+	var lists []PropertyList
+	got, err := client.GetAll(ctx, NewQuery("Gopher"), &lists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, keys) || len(lists) != len(keys) {
+		t.Fatalf("got keys %v and %d lists, want keys %v and as many lists", got, len(lists), keys)
+	}
+	for i, l := range lists {
+		if want := (PropertyList{{Name: "Name", Value: keys[i].StringID()}}); !reflect.DeepEqual(l, want) {
+			t.Errorf("list %d: got %v, want %v", i, l, want)
+		}
+	}
+
+	var keyed []KeyedPropertyList
+	if _, err := client.GetAll(ctx, NewQuery("Gopher"), &keyed); err != nil {
+		t.Fatal(err)
+	}
+	for i, l := range keyed {
+		if !l.Key.Equal(keys[i]) || len(l.Properties) != 1 || l.Properties[0].Value != keys[i].StringID() {
+			t.Errorf("keyed list %d: got %v %v, want key %v", i, l.Key, l.Properties, keys[i])
+		}
+	}
+
+	multi := make([]KeyedPropertyList, len(keys))
+	if err := client.GetMulti(ctx, keys, multi); err != nil {
+		t.Fatal(err)
+	}
+	for i, l := range multi {
+		if !l.Key.Equal(keys[i]) {
+			t.Errorf("GetMulti %d: got key %v, want %v", i, l.Key, keys[i])
+		}
+	}
+
+	// Other KeySetters also get their key when loaded.
+	var g keyedGopher
+	if err := client.Get(ctx, keys[1], &g); err != nil {
+		t.Fatal(err)
+	}
+	if !g.Key.Equal(keys[1]) || g.Name != "rufus" {
+		t.Errorf("Get: got %+v, want key %v", g, keys[1])
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ErrRateLimited is returned by a call to the datastore that exceeds the rate
+// limit set by the cloud.WithRateLimit option, if the limit fails fast.
+var ErrRateLimited = errors.New("datastore: rate limit exceeded")
+
+// rateLimiter is a token bucket that limits the rate of calls made by a
+// Client. A nil *rateLimiter imposes no limit.
+type rateLimiter struct {
+	rate     float64 // Tokens added per second.
+	burst    float64 // Maximum number of tokens.
+	failFast bool
+
+	mu     sync.Mutex
+	tokens float64 // Negative if calls are waiting for tokens.
+	last   time.Time
+	now    func() time.Time
+}
+
+// newRateLimiter returns a rateLimiter allowing qps calls per second with
+// bursts of up to burst calls, or nil if qps is not positive.
+func newRateLimiter(qps float64, burst int, failFast bool) *rateLimiter {
+	if qps <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:     qps,
+		burst:    float64(burst),
+		failFast: failFast,
+		tokens:   float64(burst),
+		now:      time.Now,
+	}
+}
+
+// wait takes a token from the bucket, blocking until one is available or ctx
+// is done. If the limiter fails fast, it returns ErrRateLimited instead of
+// blocking.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		l.mu.Unlock()
+		return nil
+	}
+	if l.failFast {
+		l.mu.Unlock()
+		return ErrRateLimited
+	}
+	// Reserve a token now, so that waiting calls are served in order, and
+	// sleep until it has been added to the bucket.
+	l.tokens--
+	d := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens++ // Return the reserved token.
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
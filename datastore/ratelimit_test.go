@@ -0,0 +1,86 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+)
+
+func TestRateLimiterFailFast(t *testing.T) {
+	now := time.Unix(1e9, 0)
+	l := newRateLimiter(2, 3, true)
+	l.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if err := l.wait(ctx); err != nil {
+			t.Fatalf("call %d within burst: %v", i, err)
+		}
+	}
+	if err := l.wait(ctx); err != ErrRateLimited {
+		t.Errorf("call over burst: got error %v, want ErrRateLimited", err)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if err := l.wait(ctx); err != nil {
+		t.Errorf("call after refill: %v", err)
+	}
+	if err := l.wait(ctx); err != ErrRateLimited {
+		t.Errorf("second call after refill: got error %v, want ErrRateLimited", err)
+	}
+}
+
+func TestRateLimiterBlocks(t *testing.T) {
+	ctx := context.Background()
+	var nCall int
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			nCall++
+			return nil
+		}),
+		limiter: newRateLimiter(100, 1, false),
+	}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := client.DeleteMulti(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 15*time.Millisecond {
+		t.Errorf("3 calls at 100 qps took %v, want about 20ms", d)
+	}
+	if nCall != 3 {
+		t.Errorf("got %d calls, want 3", nCall)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := client.DeleteMulti(ctx, nil); err != context.Canceled {
+		t.Errorf("canceled context: got error %v, want context.Canceled", err)
+	}
+}
+
+func TestNoRateLimit(t *testing.T) {
+	if l := newRateLimiter(0, 10, true); l != nil {
+		t.Errorf("got limiter %+v for zero qps, want nil", l)
+	}
+	var l *rateLimiter
+	if err := l.wait(context.Background()); err != nil {
+		t.Errorf("nil limiter: %v", err)
+	}
+}
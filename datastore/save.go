@@ -15,6 +15,8 @@
 package datastore
 
 import (
+	"database/sql/driver"
+	"encoding"
 	"errors"
 	"fmt"
 	"reflect"
@@ -26,28 +28,251 @@ import (
 
 // saveEntity saves an EntityProto into a PropertyLoadSaver or struct pointer.
 func saveEntity(key *Key, src interface{}) (*pb.Entity, error) {
-	var err error
-	var props []Property
-	if e, ok := src.(PropertyLoadSaver); ok {
-		props, err = e.Save()
-	} else {
-		props, err = SaveStruct(src)
+	props, err := saveProperties(key, src, false, nil)
+	if err != nil {
+		return nil, err
 	}
+	return propertiesToProto(key, props)
+}
+
+// saveEntity is like the package function saveEntity, but saves the
+// properties as the Client's options ask.
+func (c *Client) saveEntity(key *Key, src interface{}) (*pb.Entity, error) {
+	props, err := c.saveProperties(key, src)
 	if err != nil {
 		return nil, err
 	}
 	return propertiesToProto(key, props)
 }
 
-func saveStructProperty(props *[]Property, name string, noIndex, multiple bool, v reflect.Value) error {
+// EstimateIndexWrites estimates the number of index writes made when c saves
+// src as a new entity with key, for capacity planning of large imports. src
+// must be a struct pointer or implement PropertyLoadSaver. The Client's
+// options that name and unindex properties, such as DefaultNoIndex and
+// IndexFunc, apply as they would to Put. src is not modified, even if it has
+// autonow or autoaddonly fields, and its BeforeSave method is not called.
+//
+// The estimate counts two writes for the entity and its entry in the kind
+// index, and two for each indexed property value, which is stored in both an
+// ascending and a descending single-property index. Composite indexes are
+// defined outside the program and are not counted: each adds one write for
+// every combination of indexed values that the entity contributes to it.
+func (c *Client) EstimateIndexWrites(key *Key, src interface{}) (int, error) {
+	if err := key.check(false); err != nil {
+		return 0, err
+	}
+	if _, ok := src.(PropertyLoadSaver); !ok {
+		// Save a copy of the struct, whose autonow and autoaddonly fields
+		// are set in its place.
+		v := reflect.ValueOf(src)
+		if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+			return 0, ErrInvalidEntityType
+		}
+		cp := reflect.New(v.Elem().Type())
+		cp.Elem().Set(v.Elem())
+		src = cp.Interface()
+	}
+	e, err := c.saveEntity(key, src)
+	if err != nil {
+		return 0, err
+	}
+	n := 2
+	for _, p := range e.Property {
+		vals := p.Value.ListValue
+		if vals == nil {
+			vals = []*pb.Value{p.Value}
+		}
+		for _, v := range vals {
+			if v.GetIndexed() {
+				n += 2
+			}
+		}
+	}
+	return n, nil
+}
+
+// saveProperties is like the package function saveProperties, but if the
+// Client was created with DefaultNoIndex, the fields of a struct src not
+// tagged with index are unindexed, if it was created with IndexFunc, the
+// properties its function rejects are unindexed, and if it was created with
+// AutoNoIndex, the properties with values too long to be indexed are
+// unindexed.
+func (c *Client) saveProperties(key *Key, src interface{}) ([]Property, error) {
+	props, err := saveProperties(key, src, c.defaultNoIndex, c.naming)
+	if err != nil {
+		return nil, err
+	}
+	if c.indexFunc != nil {
+		unindexRejected(props, c.indexFunc)
+	}
+	if c.autoNoIndex {
+		unindexLongValues(props)
+	}
+	return props, nil
+}
+
+// saveProperties returns the properties that src, a PropertyLoadSaver or
+// struct pointer, saves for the entity with the given key. If src is a struct
+// pointer and noIndex is set, only the fields tagged with index are indexed.
+// The fields of a struct src are named as naming asks.
+func saveProperties(key *Key, src interface{}, noIndex bool, naming *fieldNaming) ([]Property, error) {
+	if e, ok := src.(PropertyLoadSaver); ok {
+		return e.Save()
+	}
+	x, err := newStructPLS(src, naming)
+	if err != nil {
+		return nil, err
+	}
+	s := x.(structPLS)
+	setAutoTimes(s.v, s.codec, time.Now().UTC(), key.Incomplete())
+	var props []Property
+	if err := s.save(&props, "", noIndex, false); err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+// maxIndexedValueBytes is the length limit of indexed string and []byte values.
+const maxIndexedValueBytes = 1500
+
+// valueBytes returns the length of v if it is a string or []byte, and 0
+// otherwise.
+func valueBytes(v interface{}) int {
+	switch v := v.(type) {
+	case string:
+		return len(v)
+	case []byte:
+		return len(v)
+	}
+	return 0
+}
+
+// unindexLongValues marks the properties named like any indexed property
+// whose value is too long to be indexed as unindexed. All values of a
+// multi-valued property are marked, since they cannot mix indexed and
+// unindexed values.
+func unindexLongValues(props []Property) {
+	var long map[string]bool
+	for _, p := range props {
+		if !p.NoIndex && valueBytes(p.Value) > maxIndexedValueBytes {
+			if long == nil {
+				long = make(map[string]bool)
+			}
+			long[p.Name] = true
+		}
+	}
+	for i := range props {
+		if long[props[i].Name] {
+			props[i].NoIndex = true
+		}
+	}
+}
+
+// unindexRejected marks the indexed properties whose names indexed returns
+// false for as unindexed. indexed is called once for each name.
+func unindexRejected(props []Property, indexed func(string) bool) {
+	var decided map[string]bool
+	for i, p := range props {
+		if p.NoIndex {
+			continue
+		}
+		ok, seen := decided[p.Name]
+		if !seen {
+			ok = indexed(p.Name)
+			if decided == nil {
+				decided = make(map[string]bool)
+			}
+			decided[p.Name] = ok
+		}
+		if !ok {
+			props[i].NoIndex = true
+		}
+	}
+}
+
+// setAutoTimes sets the fields of the struct v that are tagged with autonow,
+// or with autoaddonly if isNew is true, to now. It recurses into nested
+// structs.
+func setAutoTimes(v reflect.Value, codec *structCodec, now time.Time, isNew bool) {
+	for i, t := range codec.byIndex {
+		f := v.Field(i)
+		if t.name == "-" || !f.CanSet() {
+			continue
+		}
+		if t.autoNow || (t.autoAddOnly && isNew) {
+			f.Set(reflect.ValueOf(now))
+			continue
+		}
+		if f.Kind() == reflect.Struct && f.Type() != typeOfTime && f.Type() != typeOfUser && !hasConverter(f.Type()) && !sqlValued(f.Type()) && !binaryMarshaled(f.Type()) {
+			if sub, err := getStructCodec(f.Type(), codec.naming); err == nil {
+				setAutoTimes(f, sub, now, isNew)
+			}
+		}
+	}
+}
+
+// addressable returns a pointer to v, or to a copy of v if v is not
+// addressable, so that methods with pointer receivers can be called on it.
+func addressable(v reflect.Value) reflect.Value {
+	if v.CanAddr() {
+		return v.Addr()
+	}
+	pv := reflect.New(v.Type())
+	pv.Elem().Set(v)
+	return pv
+}
+
+func saveStructProperty(props *[]Property, name string, noIndex, multiple bool, v reflect.Value, naming *fieldNaming) error {
 	p := Property{
 		Name:     name,
 		NoIndex:  noIndex,
 		Multiple: multiple,
 	}
 
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		// An interface{} field is saved as a property of the type of the
+		// value it holds.
+		if v.IsNil() {
+			*props = append(*props, p)
+			return nil
+		}
+		return saveStructProperty(props, name, noIndex, multiple, v.Elem(), naming)
+	}
+	if conv, ok := lookupConverter(v.Type()); ok {
+		cp, err := conv.to(v.Interface())
+		if err != nil {
+			return fmt.Errorf("datastore: converting field %q: %v", name, err)
+		}
+		p.Value, p.NoIndex = cp.Value, noIndex || cp.NoIndex
+		*props = append(*props, p)
+		return nil
+	}
+	if sqlValued(v.Type()) {
+		dv, err := addressable(v).Interface().(driver.Valuer).Value()
+		if err != nil {
+			return fmt.Errorf("datastore: getting value of field %q: %v", name, err)
+		}
+		switch dv.(type) {
+		case nil, int64, float64, bool, string, []byte, time.Time:
+			p.Value = dv
+		default:
+			return fmt.Errorf("datastore: unsupported value type %T for field %q", dv, name)
+		}
+		*props = append(*props, p)
+		return nil
+	}
+	if binaryMarshaled(v.Type()) {
+		b, err := addressable(v).Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("datastore: marshaling field %q: %v", name, err)
+		}
+		p.Value = b
+		*props = append(*props, p)
+		return nil
+	}
+
 	switch x := v.Interface().(type) {
-	case *Key, time.Time:
+	case *Key, time.Time, User:
 		p.Value = x
 	default:
 		switch v.Kind() {
@@ -67,7 +292,7 @@ func saveStructProperty(props *[]Property, name string, noIndex, multiple bool,
 			if !v.CanAddr() {
 				return fmt.Errorf("datastore: unsupported struct field: value is unaddressable")
 			}
-			sub, err := newStructPLS(v.Addr().Interface())
+			sub, err := newStructPLS(v.Addr().Interface(), naming)
 			if err != nil {
 				return fmt.Errorf("datastore: unsupported struct field: %v", err)
 			}
@@ -75,7 +300,7 @@ func saveStructProperty(props *[]Property, name string, noIndex, multiple bool,
 		}
 	}
 	if p.Value == nil {
-		return fmt.Errorf("datastore: unsupported struct field type: %v", v.Type())
+		return fmt.Errorf("datastore: unsupported struct field type %v in field %q", v.Type(), name)
 	}
 	*props = append(*props, p)
 	return nil
@@ -102,24 +327,49 @@ func (s structPLS) save(props *[]Property, prefix string, noIndex, multiple bool
 		if !v.IsValid() || !v.CanSet() {
 			continue
 		}
-		noIndex1 := noIndex || t.noIndex
+		if t.required && isEmptyValue(v) {
+			return fmt.Errorf("datastore: required field %q is empty", name)
+		}
+		noIndex1 := (noIndex || t.noIndex) && !t.index
 		// For slice fields that aren't []byte, save each element.
-		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 && !hasConverter(v.Type()) {
 			for j := 0; j < v.Len(); j++ {
-				if err := saveStructProperty(props, name, noIndex1, true, v.Index(j)); err != nil {
+				elem := v.Index(j)
+				if t.round >= 0 {
+					elem = roundFloat(elem, t.round)
+				}
+				if err := saveStructProperty(props, name, noIndex1, true, elem, s.codec.naming); err != nil {
 					return err
 				}
 			}
 			continue
 		}
 		// Otherwise, save the field itself.
-		if err := saveStructProperty(props, name, noIndex1, multiple, v); err != nil {
+		if t.round >= 0 {
+			v = roundFloat(v, t.round)
+		}
+		if err := saveStructProperty(props, name, noIndex1, multiple, v, s.codec.naming); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// isEmptyValue returns whether v, the value of a field tagged "required", is
+// empty: a zero value, or a slice or map without elements.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	if v.Type() == typeOfTime {
+		return v.Interface().(time.Time).IsZero()
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
 func propertiesToProto(key *Key, props []Property) (*pb.Entity, error) {
 	e := &pb.Entity{
 		Key: keyToProto(key),
@@ -142,12 +392,8 @@ func propertiesToProto(key *Key, props []Property) (*pb.Entity, error) {
 		if indexedProps > maxIndexedProperties {
 			return nil, errors.New("datastore: too many indexed properties")
 		}
-		switch v := p.Value.(type) {
-		case string:
-		case []byte:
-			if len(v) > 1500 && !p.NoIndex {
-				return nil, fmt.Errorf("datastore: cannot index a Property with Name %q", p.Name)
-			}
+		if n := valueBytes(p.Value); n > maxIndexedValueBytes && !p.NoIndex {
+			return nil, fmt.Errorf("datastore: cannot index a Property with Name %q: its value is %d bytes, over the limit of %d bytes for indexed values; mark it noindex", p.Name, n, maxIndexedValueBytes)
 		}
 		val.Indexed = proto.Bool(!p.NoIndex)
 		if p.Multiple {
@@ -159,6 +405,8 @@ func propertiesToProto(key *Key, props []Property) (*pb.Entity, error) {
 				}
 				prevMultiple[p.Name] = x
 				e.Property = append(e.Property, x)
+			} else if x.Value.ListValue[0].GetIndexed() != !p.NoIndex {
+				return nil, fmt.Errorf("datastore: cannot mix indexed and unindexed values for a Property with Name %q", p.Name)
 			}
 			x.Value.ListValue = append(x.Value.ListValue, val)
 		} else {
@@ -190,6 +438,10 @@ func interfaceToProto(iv interface{}) (p *pb.Value, errStr string) {
 		val.DoubleValue = proto.Float64(v)
 	case *Key:
 		if v != nil {
+			// The datastore rejects key values with an empty name and ID.
+			if !v.valid() || v.Incomplete() {
+				return nil, "invalid or incomplete key value"
+			}
 			val.KeyValue = keyToProto(v)
 		}
 	case time.Time:
@@ -199,6 +451,8 @@ func interfaceToProto(iv interface{}) (p *pb.Value, errStr string) {
 		val.TimestampMicrosecondsValue = proto.Int64(toUnixMicro(v))
 	case []byte:
 		val.BlobValue = v
+	case User:
+		val = userToProto(v)
 	default:
 		if iv != nil {
 			return nil, fmt.Sprintf("invalid Value type %t", iv)
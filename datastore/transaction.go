@@ -15,8 +15,12 @@
 package datastore
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"net/http"
+	"reflect"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
@@ -26,24 +30,89 @@ import (
 )
 
 // ErrConcurrentTransaction is returned when a transaction is rolled back due
-// to a conflict with a concurrent transaction.
+// to a conflict with a concurrent transaction. The transaction may succeed if
+// it is retried; RunInTransaction does so automatically.
+//
+// The datastore API does not expose entity versions, so there is no
+// compare-and-swap form of Get and Put. A transaction that gets an entity
+// and puts its new value serves instead: if the entity is modified after it
+// is read, the commit fails with ErrConcurrentTransaction and none of the
+// transaction's mutations are applied.
 var ErrConcurrentTransaction = errors.New("datastore: concurrent transaction")
 
+// ErrEntityExists is returned by Commit when the transaction inserts an entity
+// with Insert or InsertMulti and an entity already exists for its key. None
+// of the transaction's mutations are applied. Unlike ErrConcurrentTransaction,
+// it is not retried by RunInTransaction, since a retry would fail the same way.
+var ErrEntityExists = errors.New("datastore: entity already exists")
+
 var errExpiredTransaction = errors.New("datastore: transaction expired")
 
 // A TransactionOption configures the Transaction returned by NewTransaction.
+//
+// The only transaction options supported by the datastore API are isolation
+// levels. The API does not support declaring a transaction read-only, or
+// naming a previous transaction when retrying one; every transaction may
+// write, and a retried transaction starts afresh. MaxEntityGroups and
+// ReadYourWrites are implemented by the client.
 type TransactionOption interface {
-	apply(*pb.BeginTransactionRequest)
+	apply(*transactionSettings)
+}
+
+// transactionSettings holds the settings of a transaction being begun.
+type transactionSettings struct {
+	req       *pb.BeginTransactionRequest
+	maxGroups int // 0 if the number of entity groups is not limited.
+	// readYourWrites is set by ReadYourWrites.
+	readYourWrites bool
 }
 
 type isolation struct {
 	level pb.BeginTransactionRequest_IsolationLevel
 }
 
-func (i isolation) apply(req *pb.BeginTransactionRequest) {
-	req.IsolationLevel = i.level.Enum()
+func (i isolation) apply(s *transactionSettings) {
+	s.req.IsolationLevel = i.level.Enum()
+}
+
+type maxEntityGroups int
+
+func (n maxEntityGroups) apply(s *transactionSettings) {
+	s.maxGroups = int(n)
+}
+
+// MaxEntityGroups returns a TransactionOption that limits the transaction to
+// n entity groups, the groups of the root keys of the keys it reads and
+// writes. Operations of the transaction that would use more groups fail
+// without contacting the datastore, and are not enqueued. Each incomplete
+// key without a parent counts as a new group.
+//
+// Transactions over fewer groups are faster and less likely to conflict;
+// the limit lets an application keep its transactions small.
+func MaxEntityGroups(n int) TransactionOption {
+	return maxEntityGroups(n)
 }
 
+type readYourWrites struct{}
+
+func (readYourWrites) apply(s *transactionSettings) {
+	s.readYourWrites = true
+}
+
+// ReadYourWrites is a TransactionOption that makes the Get and GetMulti
+// methods of the transaction observe its staged operations: an entity Put or
+// Inserted by the transaction with a complete key is read as staged, and an
+// entity it Deleted is reported missing with ErrNoSuchEntity, without
+// contacting the datastore. Only the keys the transaction has not written are
+// looked up. The last staged operation for a key wins.
+//
+// It is a convenience of the client, not a guarantee of the datastore, which
+// never lets a transaction read its own writes: queries in the transaction,
+// and the entities put with incomplete keys, are not affected, and the
+// staged entities are read as they were saved, not as the datastore would
+// store them.
+var ReadYourWrites TransactionOption = readYourWrites{}
+
 var (
 	// Snapshot causes the transaction to enforce a snapshot isolation level.
 	Snapshot TransactionOption = isolation{pb.BeginTransactionRequest_SNAPSHOT}
@@ -53,37 +122,130 @@ var (
 
 // Transaction represents a set of datastore operations to be committed atomically.
 //
-// Operations are enqueued by calling the Put and Delete methods on Transaction
-// (or their Multi-equivalents).  These operations are only committed when the
-// Commit method is invoked. To ensure consistency, reads must be performed by
-// using Transaction's Get method or by using the Transaction method when
-// building a query.
+// Operations are enqueued by calling the Put, Insert and Delete methods on
+// Transaction (or their Multi-equivalents). These operations are staged
+// locally, without contacting the datastore, and are only committed, in a
+// single request, when the Commit method is invoked. Reads do not observe
+// staged operations, unless the transaction was begun with ReadYourWrites.
+// To ensure consistency, reads must be performed by using Transaction's Get
+// method or by using the Transaction method when building a query.
+//
+// Unlike a Client, a Transaction holds the state of its staged operations and
+// is not safe for concurrent use: it should be used by a single goroutine.
+// Non-transactional calls on the Client that created it hold no such state,
+// and may be made from any number of goroutines.
+//
+// Operations on a Transaction that has already been committed or rolled back
+// fail, rather than being applied outside of the transaction.
 //
-// A Transaction must be committed or rolled back exactly once.
+// A Transaction must be committed or rolled back exactly once. A Transaction
+// can enqueue at most 500 mutations.
 type Transaction struct {
 	id       []byte
 	client   *Client
 	ctx      context.Context
 	mutation *pb.Mutation  // The mutations to apply.
 	pending  []*PendingKey // Incomplete keys pending transaction completion.
+
+	// maxGroups is the limit set by MaxEntityGroups, or 0 if there is none.
+	maxGroups int
+	// groups holds the root keys of the entity groups used so far, and
+	// newGroups counts the incomplete root keys used.
+	groups    map[entityGroup]bool
+	newGroups int
+
+	// beginLatency is how long beginning the transaction took.
+	beginLatency time.Duration
+
+	// staged maps the keys written by the transaction to the entities it put
+	// for them, or to nil for those it deleted, if it was begun with
+	// ReadYourWrites. Otherwise it is nil.
+	staged map[string]*pb.Entity
+}
+
+// entityGroup identifies an entity group by its complete root key.
+type entityGroup struct {
+	namespace, kind, name string
+	id                    int64
 }
 
 // NewTransaction starts a new transaction.
 func (c *Client) NewTransaction(ctx context.Context, opts ...TransactionOption) (*Transaction, error) {
 	req, resp := &pb.BeginTransactionRequest{}, &pb.BeginTransactionResponse{}
+	s := transactionSettings{req: req}
 	for _, o := range opts {
-		o.apply(req)
+		o.apply(&s)
 	}
+	if s.maxGroups < 0 {
+		return nil, fmt.Errorf("datastore: invalid entity group limit %d", s.maxGroups)
+	}
+	start := time.Now()
 	if err := c.call(ctx, "beginTransaction", req, resp); err != nil {
 		return nil, err
 	}
 
-	return &Transaction{
-		id:       resp.Transaction,
-		ctx:      ctx,
-		client:   c,
-		mutation: &pb.Mutation{},
-	}, nil
+	t := &Transaction{
+		id:           resp.Transaction,
+		ctx:          ctx,
+		client:       c,
+		mutation:     &pb.Mutation{},
+		maxGroups:    s.maxGroups,
+		beginLatency: time.Since(start),
+	}
+	if s.readYourWrites {
+		t.staged = make(map[string]*pb.Entity)
+	}
+	return t, nil
+}
+
+// BeginLatency returns how long the call that began the transaction took,
+// including any wait for the rate limit set by cloud.WithRateLimit. It is
+// measured apart from the latency of the transaction's reads and of its
+// commit, so that slow transactions can be diagnosed: a high begin latency
+// points to the network, the rate limit or load on the datastore rather than
+// to the transaction's own work. The package has no metrics hooks, so callers
+// record it with their own.
+func (t *Transaction) BeginLatency() time.Duration {
+	return t.beginLatency
+}
+
+// useGroups records the entity groups of keys as used by the transaction. It
+// returns an error, and records nothing, if that would exceed the limit set by
+// MaxEntityGroups.
+func (t *Transaction) useGroups(keys []*Key) error {
+	if t.maxGroups == 0 {
+		return nil
+	}
+	var added []entityGroup
+	newGroups := t.newGroups
+	for _, k := range keys {
+		if k == nil {
+			continue
+		}
+		for k.parent != nil {
+			k = k.parent
+		}
+		if k.Incomplete() {
+			newGroups++
+			continue
+		}
+		g := entityGroup{k.namespace, k.kind, k.name, k.id}
+		if !t.groups[g] {
+			added = append(added, g)
+			if t.groups == nil {
+				t.groups = make(map[entityGroup]bool)
+			}
+			t.groups[g] = true
+		}
+	}
+	if n := len(t.groups) + newGroups; n > t.maxGroups {
+		for _, g := range added {
+			delete(t.groups, g)
+		}
+		return fmt.Errorf("datastore: transaction uses %d entity groups, the limit is %d", n, t.maxGroups)
+	}
+	t.newGroups = newGroups
+	return nil
 }
 
 // Commit applies the enqueued operations atomically.
@@ -99,28 +261,65 @@ func (t *Transaction) Commit() (*Commit, error) {
 	t.id = nil
 	resp := &pb.CommitResponse{}
 	if err := t.client.call(t.ctx, "commit", req, resp); err != nil {
-		if e, ok := err.(*transport.ErrHTTP); ok && e.StatusCode == http.StatusConflict {
-			// TODO(jbd): Make sure that we explicitly handle the case where response
-			// has an HTTP 409 and the error message indicates that it's an concurrent
-			// transaction error.
+		if isAborted(err) {
 			return nil, ErrConcurrentTransaction
 		}
+		if isAlreadyExists(err) {
+			return nil, ErrEntityExists
+		}
 		return nil, err
 	}
 
 	// Copy any newly minted keys into the returned keys.
-	if len(t.pending) != len(resp.MutationResult.InsertAutoIdKey) {
+	newKeys := resp.GetMutationResult().GetInsertAutoIdKey()
+	if len(t.pending) != len(newKeys) {
 		return nil, errors.New("datastore: internal error: server returned the wrong number of keys")
 	}
-	commit := &Commit{}
+	commit := &Commit{indexUpdates: int(resp.GetMutationResult().GetIndexUpdates())}
 	for i, p := range t.pending {
-		p.key = protoToKey(resp.MutationResult.InsertAutoIdKey[i])
+		p.key = protoToKey(newKeys[i])
 		p.commit = commit
 	}
 
 	return commit, nil
 }
 
+// isAborted reports whether err is the server's response to a commit that was
+// aborted due to contention. The server reports both aborted transactions and
+// attempts to insert existing entities with an HTTP 409; only the former is
+// retryable.
+func isAborted(err error) bool {
+	e, ok := err.(*transport.ErrHTTP)
+	if !ok || e.StatusCode != http.StatusConflict {
+		return false
+	}
+	return !isAlreadyExists(err)
+}
+
+// isAlreadyExists reports whether err is the server's response to a commit
+// inserting an entity that already exists.
+func isAlreadyExists(err error) bool {
+	e, ok := err.(*transport.ErrHTTP)
+	if !ok || (e.StatusCode != http.StatusBadRequest && e.StatusCode != http.StatusConflict) {
+		return false
+	}
+	body := bytes.ToLower(e.Body)
+	return bytes.Contains(body, []byte("already exists")) || bytes.Contains(body, []byte("already_exists"))
+}
+
+// isExpired reports whether err is the server's response to a request made
+// in a transaction that has expired, as happens to long-running
+// transactions. Retrying requires beginning a new transaction.
+func isExpired(err error) bool {
+	e, ok := err.(*transport.ErrHTTP)
+	if !ok || (e.StatusCode != http.StatusBadRequest && e.StatusCode != http.StatusConflict) {
+		return false
+	}
+	body := bytes.ToLower(e.Body)
+	return bytes.Contains(body, []byte("transaction")) &&
+		(bytes.Contains(body, []byte("expired")) || bytes.Contains(body, []byte("no longer valid")))
+}
+
 // Rollback abandons a pending transaction.
 func (t *Transaction) Rollback() error {
 	if t.id == nil {
@@ -131,25 +330,280 @@ func (t *Transaction) Rollback() error {
 	return t.client.call(t.ctx, "rollback", &pb.RollbackRequest{Transaction: id}, &pb.RollbackResponse{})
 }
 
+// Close rolls back the transaction if it has been neither committed nor
+// rolled back, and does nothing otherwise, so it can be deferred right after
+// NewTransaction. Using the transaction after Close returns an error.
+func (t *Transaction) Close() error {
+	if t.id == nil {
+		return nil
+	}
+	return t.Rollback()
+}
+
+// maxTransactionAttempts is the number of times RunInTransaction attempts
+// to commit a transaction before giving up.
+const maxTransactionAttempts = 3
+
+// RunInTransaction runs f in a transaction. f is invoked with a Transaction
+// that f should use for all the transaction's datastore operations.
+//
+// f must not call Commit or Rollback on the provided Transaction.
+//
+// If f returns nil, RunInTransaction commits the transaction, returning the
+// Commit and a nil error if it succeeds. If the commit fails due to a
+// conflicting transaction, RunInTransaction retries f with a new Transaction.
+// It also retries, with a new Transaction, if f or the commit fails because
+// the transaction expired, or with a transient error of the datastore: a
+// throttled request, or a 500, 502, 503 or 504 response. It gives up after
+// three failed attempts, returning the last attempt's error. A Client
+// created with the RetryPredicate option instead retries the errors of f and
+// of the commit for which its predicate returns true.
+//
+// RunInTransaction does not retry once ctx is done: if an attempt failed and
+// ctx has since expired or been cancelled, it returns an error that wraps
+// both ctx.Err() and the failed attempt's error, so errors.Is matches either
+// of them, as with context.DeadlineExceeded and ErrConcurrentTransaction. To
+// bound the total time spent retrying, and not just the number of attempts,
+// give ctx a deadline, as with context.WithTimeout. Other calls made by the
+// Client are not retried, apart from the chunks of Import and Exists.
+//
+// Attempts are retried immediately, unless the failed attempt's error is a
+// throttled response whose Retry-After header asks for a delay: then
+// RunInTransaction waits for that long first, unless the delay would outlast
+// the deadline of ctx, which stops the retries at once. The
+// datastore API gives no other guidance, such as a recommended batch size, to
+// tune bulk loads by; callers can shrink their batches when retries are
+// throttled.
+//
+// If f returns non-nil, then the transaction is rolled back. f is retried
+// with a new Transaction, within the same three attempts, if its error is one
+// RunInTransaction retries, as above: by default a conflict, an expired
+// transaction or a transient error. Conflicts are matched with errors.Is, so
+// f may wrap ErrConcurrentTransaction. Any other error of f is returned
+// unchanged.
+//
+// Note that when f returns, the transaction is not committed. Calling code
+// must not assume that any of f's changes have been committed until
+// RunInTransaction returns nil.
+//
+// Since f may be called multiple times, f should usually be idempotent.
+func (c *Client) RunInTransaction(ctx context.Context, f func(tx *Transaction) error, opts ...TransactionOption) (*Commit, error) {
+	var lastErr error
+	for n := 0; n < maxTransactionAttempts; n++ {
+		if n > 0 {
+			if err := waitRetry(ctx, lastErr); err != nil {
+				return nil, err
+			}
+		}
+		tx, err := c.NewTransaction(ctx, opts...)
+		if err != nil {
+			return nil, err
+		}
+		if err = f(tx); err != nil {
+			tx.Rollback()
+			if c.shouldRetry(err) {
+				lastErr = err
+				continue
+			}
+			return nil, err
+		}
+		cmt, err := tx.Commit()
+		if err == nil || !c.shouldRetry(err) {
+			return cmt, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// waitRetry waits before a retry after err for as long as the server asked,
+// if it did. If ctx is done before then, or its deadline would pass during
+// the wait, since retrying would outlive the caller, it returns the context
+// error wrapped with err.
+func waitRetry(ctx context.Context, err error) error {
+	e, ok := err.(*transport.ErrHTTP)
+	if !ok || e.RetryAfter <= 0 {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w (last attempt: %w)", ctx.Err(), err)
+		}
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(e.RetryAfter).After(deadline) {
+		return fmt.Errorf("%w (last attempt: %w)", context.DeadlineExceeded, err)
+	}
+	t := time.NewTimer(e.RetryAfter)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("%w (last attempt: %w)", ctx.Err(), err)
+	case <-t.C:
+		return nil
+	}
+}
+
+// shouldRetry reports whether RunInTransaction retries after err. Unless the
+// Client has a retry predicate, conflicting and expired transactions, and
+// transient errors, are retried.
+func (c *Client) shouldRetry(err error) bool {
+	if c.retryable != nil {
+		return c.retryable(err)
+	}
+	return errors.Is(err, ErrConcurrentTransaction) || isExpired(err) || isTransient(err)
+}
+
 // Get is the transaction-specific version of the package function Get.
 // All reads performed during the transaction will come from a single consistent
 // snapshot. Furthermore, if the transaction is set to a serializable isolation
 // level, another transaction cannot concurrently modify the data that is read
 // or modified by this transaction.
+//
+// Get reads the state of the datastore as of the transaction's snapshot. It
+// does not observe the Puts and Deletes enqueued on the transaction, which
+// are only applied when the transaction commits, unless the transaction was
+// begun with ReadYourWrites.
 func (t *Transaction) Get(key *Key, dst interface{}) error {
-	err := t.client.get(t.ctx, []*Key{key}, []interface{}{dst}, &pb.ReadOptions{Transaction: t.id})
+	if t.id == nil {
+		return errExpiredTransaction
+	}
+	if err := t.useGroups(t.client.bindKeys([]*Key{key})); err != nil {
+		return err
+	}
+	err := t.get([]*Key{key}, []interface{}{dst})
 	if me, ok := err.(MultiError); ok {
 		return me[0]
 	}
 	return err
 }
 
-// GetMulti is a batch version of Get.
+// get implements GetMulti, reading the staged entities of keys, if any, and
+// looking up the others.
+func (t *Transaction) get(keys []*Key, dst interface{}) error {
+	var staged []int
+	if t.staged != nil {
+		for i, k := range t.client.bindKeys(keys) {
+			if k == nil {
+				continue
+			}
+			if _, ok := t.staged[k.String()]; ok {
+				staged = append(staged, i)
+			}
+		}
+	}
+	if staged == nil {
+		return t.client.get(t.ctx, keys, dst, t.lookupOptions())
+	}
+	v := reflect.ValueOf(dst)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		if mat, _ := checkMultiArg(v.Elem()); mat == multiArgTypeStructPtr {
+			return getAppend(keys, v.Elem(), func(dst interface{}) error {
+				return t.get(keys, dst)
+			})
+		}
+	}
+	multiArgType, _ := checkMultiArg(v)
+	if multiArgType == multiArgTypeInvalid {
+		return errors.New("datastore: dst has invalid type")
+	}
+	if len(keys) != v.Len() {
+		return errors.New("datastore: keys and dst slices have different length")
+	}
+
+	// Look up the keys that are not staged, loading their entities into a
+	// slice of copies of their elements of dst, which are copied back.
+	multiErr, any := make(MultiError, len(keys)), false
+	var lookupKeys []*Key
+	var lookupIndexes []int
+	for i, j := 0, 0; i < len(keys); i++ {
+		if j < len(staged) && staged[j] == i {
+			j++
+			continue
+		}
+		lookupKeys = append(lookupKeys, keys[i])
+		lookupIndexes = append(lookupIndexes, i)
+	}
+	if len(lookupKeys) > 0 {
+		tmp := reflect.MakeSlice(v.Type(), len(lookupKeys), len(lookupKeys))
+		for i, j := range lookupIndexes {
+			tmp.Index(i).Set(v.Index(j))
+		}
+		err := t.client.get(t.ctx, lookupKeys, tmp.Interface(), t.lookupOptions())
+		me, ok := err.(MultiError)
+		if err != nil && !ok {
+			return err
+		}
+		for i, j := range lookupIndexes {
+			v.Index(j).Set(tmp.Index(i))
+			if me != nil && me[i] != nil {
+				multiErr[j], any = me[i], true
+			}
+		}
+	}
+	for _, i := range staged {
+		e := t.staged[t.client.bindKey(keys[i]).String()]
+		if e == nil {
+			multiErr[i], any = ErrNoSuchEntity, true
+			continue
+		}
+		elem := v.Index(i)
+		if multiArgType == multiArgTypePropertyLoadSaver || multiArgType == multiArgTypeStruct {
+			elem = elem.Addr()
+		}
+		if err := t.client.loadEntity(elem.Interface(), e); err != nil {
+			multiErr[i], any = err, true
+		}
+	}
+	if any {
+		return multiErr
+	}
+	return nil
+}
+
+// lookupOptions returns the options for lookups made in the transaction.
+func (t *Transaction) lookupOptions() *lookupOptions {
+	return &lookupOptions{readOptions: &pb.ReadOptions{Transaction: t.id}}
+}
+
+// GetOrCreate loads the entity stored for key into dst. If there is no such
+// entity, GetOrCreate calls create to obtain a new entity, enqueues a Put of
+// it for key and loads it into dst. create must return a value that is a valid
+// src for Put. key must be complete: GetOrCreate fails with an
+// *InvalidKeyError for an incomplete key, whose entity is always new.
+//
+// Because the read and the write happen in the transaction, two transactions
+// racing to create the same entity cannot both commit successfully.
+func (t *Transaction) GetOrCreate(key *Key, dst interface{}, create func() interface{}) error {
+	if err := key.check(true); err != nil {
+		return err
+	}
+	if err := t.Get(key, dst); err != ErrNoSuchEntity {
+		return err
+	}
+	src := create()
+	_, mutation, err := t.put([]*Key{key}, []interface{}{src}, false)
+	if err != nil {
+		if me, ok := err.(MultiError); ok {
+			return me[0]
+		}
+		return err
+	}
+	if src == dst {
+		return nil
+	}
+	// Load dst from the entity put saved, rather than saving src again,
+	// which would set its autonow fields to another time.
+	return t.client.loadEntity(dst, mutation.Upsert[0])
+}
+
+// GetMulti is a batch version of Get. dst must satisfy the same conditions as
+// the dst argument to the Client's GetMulti, including the *[]*S form.
 func (t *Transaction) GetMulti(keys []*Key, dst interface{}) error {
 	if t.id == nil {
 		return errExpiredTransaction
 	}
-	return t.client.get(t.ctx, keys, dst, &pb.ReadOptions{Transaction: t.id})
+	if err := t.useGroups(t.client.bindKeys(keys)); err != nil {
+		return err
+	}
+	return t.get(keys, dst)
 }
 
 // Put is the transaction-specific version of the package function Put.
@@ -158,6 +612,10 @@ func (t *Transaction) GetMulti(keys []*Key, dst interface{}) error {
 // return value from a successful Commit. If key is an incomplete key, the
 // returned pending key will resolve to a unique key generated by the
 // datastore.
+//
+// Put does not contact the datastore. The mutation is staged in the
+// transaction and only sent, together with the transaction's other
+// mutations, by Commit.
 func (t *Transaction) Put(key *Key, src interface{}) (*PendingKey, error) {
 	h, err := t.PutMulti([]*Key{key}, []interface{}{src})
 	if err != nil {
@@ -172,14 +630,63 @@ func (t *Transaction) Put(key *Key, src interface{}) (*PendingKey, error) {
 // PutMulti is a batch version of Put. One PendingKey is returned for each
 // element of src in the same order.
 func (t *Transaction) PutMulti(keys []*Key, src interface{}) ([]*PendingKey, error) {
+	h, _, err := t.put(keys, src, false)
+	return h, err
+}
+
+// Insert is like Put, but only creates an entity: if an entity already exists
+// for key when the transaction commits, Commit fails with ErrEntityExists and
+// none of the transaction's mutations are applied. Of two transactions racing
+// to insert the same entity, at most one commits successfully. An incomplete
+// key is completed as for Put; its entity is always new.
+func (t *Transaction) Insert(key *Key, src interface{}) (*PendingKey, error) {
+	h, err := t.InsertMulti([]*Key{key}, []interface{}{src})
+	if err != nil {
+		if me, ok := err.(MultiError); ok {
+			return nil, me[0]
+		}
+		return nil, err
+	}
+	return h[0], nil
+}
+
+// InsertMulti is a batch version of Insert.
+func (t *Transaction) InsertMulti(keys []*Key, src interface{}) ([]*PendingKey, error) {
+	h, _, err := t.put(keys, src, true)
+	return h, err
+}
+
+// put implements PutMulti and InsertMulti. If insert is true, the entities
+// with complete keys are inserted rather than upserted. It also returns the
+// mutation it enqueued, which is nil for an empty batch.
+func (t *Transaction) put(keys []*Key, src interface{}, insert bool) ([]*PendingKey, *pb.Mutation, error) {
 	if t.id == nil {
-		return nil, errExpiredTransaction
+		return nil, nil, errExpiredTransaction
 	}
-	mutation, err := putMutation(keys, src)
+	keys = t.client.bindKeys(keys)
+	mutation, err := t.client.putMutation(keys, src)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if len(keys) == 0 {
+		// putMutation returns no mutation for an empty batch.
+		return nil, nil, nil
+	}
+	if insert {
+		mutation.Insert, mutation.Upsert = mutation.Upsert, nil
+	}
+	if err := t.checkMutationLen(mutation); err != nil {
+		return nil, nil, err
+	}
+	if err := t.useGroups(keys); err != nil {
+		return nil, nil, err
 	}
 	proto.Merge(t.mutation, mutation)
+	if t.staged != nil {
+		for _, e := range append(mutation.Upsert, mutation.Insert...) {
+			t.staged[protoToKey(e.Key).String()] = e
+		}
+	}
 
 	// Prepare the returned handles, pre-populating where possible.
 	ret := make([]*PendingKey, len(keys))
@@ -195,7 +702,7 @@ func (t *Transaction) PutMulti(keys []*Key, src interface{}) ([]*PendingKey, err
 		ret[i] = h
 	}
 
-	return ret, nil
+	return ret, mutation, nil
 }
 
 // Delete is the transaction-specific version of the package function Delete.
@@ -214,16 +721,73 @@ func (t *Transaction) DeleteMulti(keys []*Key) error {
 	if t.id == nil {
 		return errExpiredTransaction
 	}
+	keys = t.client.bindKeys(keys)
 	mutation, err := deleteMutation(keys)
 	if err != nil {
 		return err
 	}
+	if err := t.checkMutationLen(mutation); err != nil {
+		return err
+	}
+	if err := t.useGroups(keys); err != nil {
+		return err
+	}
 	proto.Merge(t.mutation, mutation)
+	if t.staged != nil {
+		for _, k := range keys {
+			t.staged[k.String()] = nil
+		}
+	}
+	return nil
+}
+
+// checkMutationLen returns an error if enqueuing m would make the transaction
+// exceed the datastore's limit on mutations per commit. Unlike non-transactional
+// writes, a transaction's mutations cannot be split across several commits.
+func (t *Transaction) checkMutationLen(m *pb.Mutation) error {
+	if n := mutationLen(t.mutation) + mutationLen(m); n > maxMutations {
+		return fmt.Errorf("datastore: too many mutations in transaction: %d, the limit is %d", n, maxMutations)
+	}
 	return nil
 }
 
 // Commit represents the result of a committed transaction.
-type Commit struct{}
+//
+// The datastore does not report conflicts for individual mutations: when a
+// transaction conflicts with another one, the commit fails as a whole with
+// ErrConcurrentTransaction and none of its mutations are applied.
+//
+// Nor does the datastore identify commits: the commit response carries no
+// transaction or operation ID, and entities carry no version that a write
+// could be conditioned on. A commit whose response was lost may therefore
+// have been applied, and cannot be recognized when retried. To make such a
+// retry idempotent, record an entity keyed by a token unique to the
+// operation in the same transaction as the operation's writes, and skip the
+// writes if that entity already exists:
+//
+//	_, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+//		marker := datastore.NewKey(ctx, "Operation", token, 0, nil)
+//		var op Operation
+//		if err := tx.Get(marker, &op); err == nil {
+//			return nil // Already applied.
+//		} else if err != datastore.ErrNoSuchEntity {
+//			return err
+//		}
+//		if _, err := tx.Put(marker, &Operation{Done: time.Now()}); err != nil {
+//			return err
+//		}
+//		// The operation's writes.
+//		...
+//	})
+type Commit struct {
+	indexUpdates int
+}
+
+// IndexUpdates returns the number of index updates made by the commit, as
+// reported by the datastore.
+func (c *Commit) IndexUpdates() int {
+	return c.indexUpdates
+}
 
 // Key resolves a pending key handle into a final key.
 func (c *Commit) Key(p *PendingKey) *Key {
@@ -0,0 +1,803 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	pb "google.golang.org/cloud/internal/datastore"
+	"google.golang.org/cloud/internal/transport"
+)
+
+// fakeTxClient returns a client whose commits fail with the errors in
+// commitErrs, in order, and succeed once they are exhausted. It counts the
+// number of transactions begun in *nBegin.
+func fakeTxClient(nBegin *int, commitErrs ...error) *Client {
+	return &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			switch resp := resp.(type) {
+			case *pb.BeginTransactionResponse:
+				*nBegin++
+				resp.Transaction = []byte("tx")
+			case *pb.CommitResponse:
+				if len(commitErrs) > 0 {
+					err := commitErrs[0]
+					commitErrs = commitErrs[1:]
+					return err
+				}
+				resp.MutationResult = &pb.MutationResult{}
+			}
+			return nil
+		}),
+	}
+}
+
+func TestBeginLatency(t *testing.T) {
+	const delay = 10 * time.Millisecond
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			if resp, ok := resp.(*pb.BeginTransactionResponse); ok {
+				time.Sleep(delay)
+				resp.Transaction = []byte("tx")
+			}
+			return nil
+		}),
+	}
+	tx, err := client.NewTransaction(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if got := tx.BeginLatency(); got < delay {
+		t.Errorf("got begin latency %v, want at least %v", got, delay)
+	}
+}
+
+func TestCommitErrors(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		err     error
+		aborted bool
+		exists  bool
+	}{
+		{
+			desc:    "contention",
+			err:     &transport.ErrHTTP{StatusCode: http.StatusConflict, Body: []byte("too much contention on these datastore entities")},
+			aborted: true,
+		},
+		{
+			desc:    "entity already exists",
+			err:     &transport.ErrHTTP{StatusCode: http.StatusConflict, Body: []byte("entity already exists")},
+			aborted: false,
+			exists:  true,
+		},
+		{
+			desc:    "internal error",
+			err:     &transport.ErrHTTP{StatusCode: http.StatusInternalServerError},
+			aborted: false,
+		},
+		{
+			desc:    "network error",
+			err:     errors.New("connection reset"),
+			aborted: false,
+		},
+	}
+	for _, tc := range testCases {
+		var nBegin int
+		tx, err := fakeTxClient(&nBegin, tc.err).NewTransaction(context.Background())
+		if err != nil {
+			t.Fatalf("%s: NewTransaction: %v", tc.desc, err)
+		}
+		_, err = tx.Commit()
+		if got := err == ErrConcurrentTransaction; got != tc.aborted {
+			t.Errorf("%s: got error %v, want ErrConcurrentTransaction: %v", tc.desc, err, tc.aborted)
+		}
+		if tc.exists && err != ErrEntityExists {
+			t.Errorf("%s: got error %v, want ErrEntityExists", tc.desc, err)
+		}
+		if !tc.aborted && !tc.exists && err != tc.err {
+			t.Errorf("%s: got error %v, want %v", tc.desc, err, tc.err)
+		}
+	}
+}
+
+func TestTransactionInsert(t *testing.T) {
+	ctx := context.Background()
+	key := NewKey(ctx, "Gopher", "george", 0, nil)
+	var nBegin int
+	var inserted []string
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			switch req := req.(type) {
+			case *pb.BeginTransactionRequest:
+				nBegin++
+				resp.(*pb.BeginTransactionResponse).Transaction = []byte("tx")
+			case *pb.CommitRequest:
+				m := req.GetMutation()
+				if len(m.Upsert) != 0 {
+					t.Errorf("got %d upserts, want none", len(m.Upsert))
+				}
+				for _, e := range m.Insert {
+					name := e.Key.PathElement[0].GetName()
+					for _, n := range inserted {
+						if n == name {
+							// A concurrent transaction created the entity.
+							return &transport.ErrHTTP{StatusCode: http.StatusBadRequest, Body: []byte("entity already exists")}
+						}
+					}
+					inserted = append(inserted, name)
+				}
+				resp.(*pb.CommitResponse).MutationResult = &pb.MutationResult{}
+			}
+			return nil
+		}),
+	}
+	create := func(tx *Transaction) error {
+		_, err := tx.Insert(key, &Gopher{Name: "George"})
+		return err
+	}
+	if _, err := client.RunInTransaction(ctx, create); err != nil {
+		t.Fatalf("first insert: %v", err)
+	}
+	if _, err := client.RunInTransaction(ctx, create); err != ErrEntityExists {
+		t.Errorf("second insert: got error %v, want ErrEntityExists", err)
+	}
+	if nBegin != 2 {
+		t.Errorf("got %d transactions, want 2, without retries", nBegin)
+	}
+}
+
+func TestRunInTransactionRetries(t *testing.T) {
+	aborted := &transport.ErrHTTP{StatusCode: http.StatusConflict}
+
+	var nBegin, nCall int
+	_, err := fakeTxClient(&nBegin, aborted, aborted).RunInTransaction(context.Background(), func(tx *Transaction) error {
+		nCall++
+		return nil
+	})
+	if err != nil {
+		t.Errorf("RunInTransaction: %v", err)
+	}
+	if nBegin != 3 || nCall != 3 {
+		t.Errorf("got %d transactions and %d calls, want 3 of each", nBegin, nCall)
+	}
+
+	nBegin, nCall = 0, 0
+	_, err = fakeTxClient(&nBegin, aborted, aborted, aborted).RunInTransaction(context.Background(), func(tx *Transaction) error {
+		nCall++
+		return nil
+	})
+	if err != ErrConcurrentTransaction {
+		t.Errorf("got error %v, want ErrConcurrentTransaction", err)
+	}
+	if nBegin != maxTransactionAttempts {
+		t.Errorf("got %d transactions, want %d", nBegin, maxTransactionAttempts)
+	}
+
+	// A conflict that f wraps is retried too.
+	nBegin, nCall = 0, 0
+	_, err = fakeTxClient(&nBegin).RunInTransaction(context.Background(), func(tx *Transaction) error {
+		nCall++
+		if nCall == 1 {
+			return fmt.Errorf("load: %w", ErrConcurrentTransaction)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("RunInTransaction: %v", err)
+	}
+	if nBegin != 2 || nCall != 2 {
+		t.Errorf("wrapped conflict: got %d transactions and %d calls, want 2 of each", nBegin, nCall)
+	}
+
+	nBegin = 0
+	wantErr := errors.New("user error")
+	_, err = fakeTxClient(&nBegin).RunInTransaction(context.Background(), func(tx *Transaction) error {
+		return wantErr
+	})
+	if err != wantErr {
+		t.Errorf("got error %v, want %v", err, wantErr)
+	}
+	if nBegin != 1 {
+		t.Errorf("got %d transactions, want 1", nBegin)
+	}
+}
+
+func TestRunInTransactionExpired(t *testing.T) {
+	expired := &transport.ErrHTTP{
+		StatusCode: http.StatusBadRequest,
+		Body:       []byte("The referenced transaction has expired or is no longer valid."),
+	}
+
+	var nBegin, nCall int
+	_, err := fakeTxClient(&nBegin, expired).RunInTransaction(context.Background(), func(tx *Transaction) error {
+		nCall++
+		return nil
+	})
+	if err != nil {
+		t.Errorf("RunInTransaction: %v", err)
+	}
+	if nBegin != 2 || nCall != 2 {
+		t.Errorf("commit expired: got %d transactions and %d calls, want 2 of each", nBegin, nCall)
+	}
+
+	nBegin, nCall = 0, 0
+	_, err = fakeTxClient(&nBegin).RunInTransaction(context.Background(), func(tx *Transaction) error {
+		nCall++
+		if nCall == 1 {
+			return expired
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("RunInTransaction: %v", err)
+	}
+	if nBegin != 2 || nCall != 2 {
+		t.Errorf("read expired: got %d transactions and %d calls, want 2 of each", nBegin, nCall)
+	}
+
+	nBegin = 0
+	_, err = fakeTxClient(&nBegin, expired, expired, expired).RunInTransaction(context.Background(), func(tx *Transaction) error {
+		return nil
+	})
+	if err != expired {
+		t.Errorf("got error %v, want %v", err, expired)
+	}
+	if nBegin != maxTransactionAttempts {
+		t.Errorf("got %d transactions, want %d", nBegin, maxTransactionAttempts)
+	}
+}
+
+func TestRunInTransactionTransient(t *testing.T) {
+	unavailable := &transport.ErrHTTP{StatusCode: http.StatusServiceUnavailable}
+	internal := &transport.ErrHTTP{StatusCode: http.StatusInternalServerError}
+
+	var nBegin, nCall int
+	_, err := fakeTxClient(&nBegin, unavailable).RunInTransaction(context.Background(), func(tx *Transaction) error {
+		nCall++
+		if nCall == 1 {
+			return internal
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("RunInTransaction: %v", err)
+	}
+	if nBegin != 3 || nCall != 3 {
+		t.Errorf("got %d transactions and %d calls, want 3 of each", nBegin, nCall)
+	}
+
+	nBegin = 0
+	badRequest := &transport.ErrHTTP{StatusCode: http.StatusBadRequest}
+	_, err = fakeTxClient(&nBegin, badRequest).RunInTransaction(context.Background(), func(tx *Transaction) error {
+		return nil
+	})
+	if err != badRequest {
+		t.Errorf("got error %v, want %v", err, badRequest)
+	}
+	if nBegin != 1 {
+		t.Errorf("got %d transactions, want 1", nBegin)
+	}
+}
+
+func TestRunInTransactionRetryPredicate(t *testing.T) {
+	ctx := context.Background()
+	unavailable := &transport.ErrHTTP{StatusCode: http.StatusServiceUnavailable}
+	var nBegin int
+	var consulted []error
+	client := fakeTxClient(&nBegin, unavailable, ErrConcurrentTransaction)
+	RetryPredicate(func(err error) bool {
+		consulted = append(consulted, err)
+		return err == unavailable
+	}).applyClient(client)
+	_, err := client.RunInTransaction(ctx, func(tx *Transaction) error { return nil })
+	if err != ErrConcurrentTransaction {
+		t.Errorf("got error %v, want ErrConcurrentTransaction", err)
+	}
+	if nBegin != 2 {
+		t.Errorf("got %d transactions, want 2", nBegin)
+	}
+	if want := []error{unavailable, ErrConcurrentTransaction}; !reflect.DeepEqual(consulted, want) {
+		t.Errorf("predicate consulted with %v, want %v", consulted, want)
+	}
+}
+
+func TestRunInTransactionRetryAfter(t *testing.T) {
+	throttled := &transport.ErrHTTP{StatusCode: http.StatusTooManyRequests, RetryAfter: 20 * time.Millisecond}
+	var nBegin int
+	client := fakeTxClient(&nBegin, throttled)
+	client.retryable = func(err error) bool { return err == throttled }
+	start := time.Now()
+	if _, err := client.RunInTransaction(context.Background(), func(tx *Transaction) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < throttled.RetryAfter {
+		t.Errorf("retried after %v, want at least %v", d, throttled.RetryAfter)
+	}
+	if nBegin != 2 {
+		t.Errorf("got %d transactions, want 2", nBegin)
+	}
+
+	// A delay longer than the context's deadline is not waited for at all.
+	throttled.RetryAfter = time.Hour
+	nBegin = 0
+	client = fakeTxClient(&nBegin, throttled)
+	client.retryable = func(err error) bool { return err == throttled }
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start = time.Now()
+	if _, err := client.RunInTransaction(ctx, func(tx *Transaction) error { return nil }); !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, throttled) {
+		t.Errorf("got error %v, want %v wrapping %v", err, context.DeadlineExceeded, throttled)
+	}
+	if d := time.Since(start); d >= time.Second/2 {
+		t.Errorf("gave up after %v, want at once", d)
+	}
+	if nBegin != 1 {
+		t.Errorf("got %d transactions, want 1", nBegin)
+	}
+}
+
+func TestRunInTransactionContextDone(t *testing.T) {
+	aborted := &transport.ErrHTTP{StatusCode: http.StatusConflict}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var nBegin, nCall int
+	_, err := fakeTxClient(&nBegin, aborted, aborted).RunInTransaction(ctx, func(tx *Transaction) error {
+		nCall++
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || !errors.Is(err, ErrConcurrentTransaction) {
+		t.Errorf("got error %v, want context.Canceled wrapping ErrConcurrentTransaction", err)
+	}
+	if nBegin != 1 || nCall != 1 {
+		t.Errorf("got %d transactions and %d calls, want 1 of each", nBegin, nCall)
+	}
+}
+
+func TestRunInTransactionDeadline(t *testing.T) {
+	aborted := &transport.ErrHTTP{StatusCode: http.StatusConflict}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	var nBegin, nCall int
+	_, err := fakeTxClient(&nBegin, aborted, aborted).RunInTransaction(ctx, func(tx *Transaction) error {
+		nCall++
+		// Each attempt takes longer than the whole budget.
+		time.Sleep(30 * time.Millisecond)
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, ErrConcurrentTransaction) {
+		t.Errorf("got error %v, want context.DeadlineExceeded wrapping ErrConcurrentTransaction", err)
+	}
+	if nCall != 1 {
+		t.Errorf("got %d calls, want 1", nCall)
+	}
+}
+
+func TestMutationLimit(t *testing.T) {
+	ctx := context.Background()
+	keys := func(n int) []*Key {
+		keys := make([]*Key, n)
+		for i := range keys {
+			keys[i] = NewKey(ctx, "Gopher", "", int64(i+1), nil)
+		}
+		return keys
+	}
+
+	gophers := func(n int) []*Gopher {
+		src := make([]*Gopher, n)
+		for i := range src {
+			src[i] = &Gopher{}
+		}
+		return src
+	}
+
+	var nBegin, nCall int
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			nCall++
+			return nil
+		}),
+	}
+	if _, err := client.PutMulti(ctx, keys(maxMutations+1), gophers(maxMutations+1)); err == nil {
+		t.Error("PutMulti: got nil error for too many entities")
+	}
+	if err := client.DeleteMulti(ctx, keys(maxMutations+1)); err == nil {
+		t.Error("DeleteMulti: got nil error for too many keys")
+	}
+	if nCall != 0 {
+		t.Errorf("got %d calls, want 0", nCall)
+	}
+
+	tx, err := fakeTxClient(&nBegin).NewTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.PutMulti(keys(maxMutations-1), gophers(maxMutations-1)); err != nil {
+		t.Fatalf("PutMulti: %v", err)
+	}
+	if err := tx.Delete(keys(1)[0]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := tx.Delete(keys(1)[0]); err == nil {
+		t.Error("Delete: got nil error for too many mutations in transaction")
+	}
+}
+
+func TestMaxEntityGroups(t *testing.T) {
+	ctx := context.Background()
+	var nBegin int
+	client := fakeTxClient(&nBegin)
+	if _, err := client.NewTransaction(ctx, MaxEntityGroups(-1)); err == nil {
+		t.Error("NewTransaction: got nil error for a negative limit")
+	}
+
+	tx, err := client.NewTransaction(ctx, MaxEntityGroups(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootA, rootB := NewKey(ctx, "Team", "a", 0, nil), NewKey(ctx, "Team", "b", 0, nil)
+	if _, err := tx.PutMulti([]*Key{
+		NewKey(ctx, "Gopher", "george", 0, rootA),
+		NewIncompleteKey(ctx, "Gopher", rootA),
+	}, []*Gopher{{}, {}}); err != nil {
+		t.Fatalf("PutMulti in one group: %v", err)
+	}
+	if err := tx.Delete(rootB); err != nil {
+		t.Fatalf("Delete in a second group: %v", err)
+	}
+	if _, err := tx.Put(NewIncompleteKey(ctx, "Team", nil), &Gopher{}); err == nil {
+		t.Error("Put of a new root entity: got nil error")
+	}
+	if err := tx.Get(NewKey(ctx, "Team", "c", 0, nil), &Gopher{}); err == nil {
+		t.Error("Get in a third group: got nil error")
+	}
+	if err := tx.Delete(NewKey(ctx, "Gopher", "rufus", 0, rootB)); err != nil {
+		t.Errorf("Delete in a used group: %v", err)
+	}
+	if n := mutationLen(tx.mutation); n != 4 {
+		t.Errorf("got %d mutations enqueued, want 4", n)
+	}
+}
+
+func TestGetOrCreate(t *testing.T) {
+	ctx := context.Background()
+	key := NewKey(ctx, "Gopher", "george", 0, nil)
+	var commit *pb.CommitRequest
+	newClient := func(found bool) *Client {
+		return &Client{
+			client: fakeClient(func(req, resp proto.Message) error {
+				switch resp := resp.(type) {
+				case *pb.BeginTransactionResponse:
+					resp.Transaction = []byte("tx")
+				case *pb.LookupResponse:
+					e := &pb.Entity{Key: keyToProto(key)}
+					if found {
+						e.Property = []*pb.Property{
+							{Name: proto.String("Name"), Value: &pb.Value{StringValue: proto.String("Existing")}},
+						}
+						resp.Found = []*pb.EntityResult{{Entity: e}}
+					} else {
+						resp.Missing = []*pb.EntityResult{{Entity: e}}
+					}
+				case *pb.CommitResponse:
+					commit = req.(*pb.CommitRequest)
+					resp.MutationResult = &pb.MutationResult{}
+				}
+				return nil
+			}),
+		}
+	}
+
+	for _, found := range []bool{true, false} {
+		commit = nil
+		var g Gopher
+		_, err := newClient(found).RunInTransaction(ctx, func(tx *Transaction) error {
+			return tx.GetOrCreate(key, &g, func() interface{} {
+				return &Gopher{Name: "Created"}
+			})
+		})
+		if err != nil {
+			t.Fatalf("found=%v: %v", found, err)
+		}
+		wantName, wantPuts := "Existing", 0
+		if !found {
+			wantName, wantPuts = "Created", 1
+		}
+		if g.Name != wantName {
+			t.Errorf("found=%v: got name %q, want %q", found, g.Name, wantName)
+		}
+		if got := len(commit.GetMutation().GetUpsert()); got != wantPuts {
+			t.Errorf("found=%v: got %d puts, want %d", found, got, wantPuts)
+		}
+	}
+
+	// dst is loaded from the entity committed, not from another save of the
+	// entity created.
+	type Stamped struct {
+		Name      string
+		UpdatedAt time.Time `datastore:",autonow"`
+	}
+	commit = nil
+	var s Stamped
+	_, err := newClient(false).RunInTransaction(ctx, func(tx *Transaction) error {
+		return tx.GetOrCreate(key, &s, func() interface{} {
+			return &Stamped{Name: "Created"}
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var committed Stamped
+	if err := loadEntity(&committed, commit.Mutation.Upsert[0]); err != nil {
+		t.Fatal(err)
+	}
+	if s != committed {
+		t.Errorf("got %+v, want the committed %+v", s, committed)
+	}
+
+	// An incomplete key is rejected before create is called.
+	_, err = newClient(false).RunInTransaction(ctx, func(tx *Transaction) error {
+		return tx.GetOrCreate(NewIncompleteKey(ctx, "Gopher", nil), &Gopher{}, func() interface{} {
+			t.Error("create called for an incomplete key")
+			return &Gopher{}
+		})
+	})
+	if e, ok := err.(*InvalidKeyError); !ok || e.Reason != KeyIncomplete {
+		t.Errorf("incomplete key: got error %v, want an incomplete key error", err)
+	}
+}
+
+func TestTransactionBuffersMutations(t *testing.T) {
+	ctx := context.Background()
+	var methods []string
+	var commit *pb.CommitRequest
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			switch resp := resp.(type) {
+			case *pb.BeginTransactionResponse:
+				methods = append(methods, "beginTransaction")
+				resp.Transaction = []byte("tx")
+			case *pb.CommitResponse:
+				methods = append(methods, "commit")
+				commit = req.(*pb.CommitRequest)
+				resp.MutationResult = &pb.MutationResult{
+					InsertAutoIdKey: []*pb.Key{keyToProto(NewKey(ctx, "Gopher", "", 3, nil))},
+				}
+			default:
+				methods = append(methods, fmt.Sprintf("%T", req))
+			}
+			return nil
+		}),
+	}
+
+	tx, err := client.NewTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Put(NewKey(ctx, "Gopher", "", 1, nil), &Gopher{Name: "George"}); err != nil {
+		t.Fatal(err)
+	}
+	pk, err := tx.Put(NewIncompleteKey(ctx, "Gopher", nil), &Gopher{Name: "Rufus"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete(NewKey(ctx, "Gopher", "", 2, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"beginTransaction"}; !reflect.DeepEqual(methods, want) {
+		t.Fatalf("before Commit: got calls %q, want %q", methods, want)
+	}
+
+	c, err := tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"beginTransaction", "commit"}; !reflect.DeepEqual(methods, want) {
+		t.Errorf("after Commit: got calls %q, want %q", methods, want)
+	}
+	m := commit.GetMutation()
+	if len(m.Upsert) != 1 || len(m.InsertAutoId) != 1 || len(m.Delete) != 1 {
+		t.Errorf("got mutation %v, want one upsert, one insert and one delete", m)
+	}
+	if commit.GetMode() != pb.CommitRequest_TRANSACTIONAL || string(commit.Transaction) != "tx" {
+		t.Errorf("got mode %v and transaction %q, want a transactional commit of %q", commit.GetMode(), commit.Transaction, "tx")
+	}
+	if got := c.Key(pk); got.ID() != 3 {
+		t.Errorf("got pending key %v, want ID 3", got)
+	}
+}
+
+func TestExpiredTransaction(t *testing.T) {
+	var nBegin int
+	tx, err := fakeTxClient(&nBegin).NewTransaction(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	key := NewKey(context.Background(), "Gopher", "", 1, nil)
+	if err := tx.Get(key, &Gopher{}); err != errExpiredTransaction {
+		t.Errorf("Get: got error %v, want errExpiredTransaction", err)
+	}
+	if _, err := tx.Put(key, &Gopher{}); err != errExpiredTransaction {
+		t.Errorf("Put: got error %v, want errExpiredTransaction", err)
+	}
+	if err := tx.Delete(key); err != errExpiredTransaction {
+		t.Errorf("Delete: got error %v, want errExpiredTransaction", err)
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	ctx := context.Background()
+	var lookedUp []string
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			switch resp := resp.(type) {
+			case *pb.BeginTransactionResponse:
+				resp.Transaction = []byte("tx")
+			case *pb.LookupResponse:
+				for _, k := range req.(*pb.LookupRequest).Key {
+					lookedUp = append(lookedUp, protoToKey(k).StringID())
+					resp.Found = append(resp.Found, &pb.EntityResult{Entity: &pb.Entity{
+						Key: k,
+						Property: []*pb.Property{
+							{Name: proto.String("Name"), Value: &pb.Value{StringValue: proto.String("stored")}},
+						},
+					}})
+				}
+			}
+			return nil
+		}),
+	}
+	george := NewKey(ctx, "Gopher", "george", 0, nil)
+	rufus := NewKey(ctx, "Gopher", "rufus", 0, nil)
+	bob := NewKey(ctx, "Gopher", "bob", 0, nil)
+
+	tx, err := client.NewTransaction(ctx, ReadYourWrites)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Put(george, &Gopher{Name: "George", Height: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete(rufus); err != nil {
+		t.Fatal(err)
+	}
+	var g Gopher
+	if err := tx.Get(george, &g); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Gopher{Name: "George", Height: 1}); g != want {
+		t.Errorf("staged put: got %+v, want %+v", g, want)
+	}
+	if err := tx.Get(rufus, &Gopher{}); err != ErrNoSuchEntity {
+		t.Errorf("staged delete: got error %v, want ErrNoSuchEntity", err)
+	}
+	if lookedUp != nil {
+		t.Errorf("staged keys were looked up: %q", lookedUp)
+	}
+
+	gs := make([]Gopher, 3)
+	err = tx.GetMulti([]*Key{george, bob, rufus}, gs)
+	if want := (MultiError{nil, nil, ErrNoSuchEntity}); !reflect.DeepEqual(err, want) {
+		t.Errorf("GetMulti: got error %v, want %v", err, want)
+	}
+	if want := []Gopher{{Name: "George", Height: 1}, {Name: "stored"}, {}}; !reflect.DeepEqual(gs, want) {
+		t.Errorf("GetMulti: got %+v, want %+v", gs, want)
+	}
+	if want := []string{"bob"}; !reflect.DeepEqual(lookedUp, want) {
+		t.Errorf("GetMulti: got lookups of %q, want %q", lookedUp, want)
+	}
+
+	// The last staged operation wins.
+	if _, err := tx.Put(rufus, &Gopher{Name: "Rufus"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete(george); err != nil {
+		t.Fatal(err)
+	}
+	var ptrs []*Gopher
+	if err := tx.GetMulti([]*Key{george, rufus}, &ptrs); err != nil {
+		t.Fatal(err)
+	}
+	if len(ptrs) != 1 || ptrs[0].Name != "Rufus" {
+		t.Errorf("after put and delete: got %+v, want only Rufus", ptrs)
+	}
+
+	// Without ReadYourWrites, staged operations are not observed.
+	tx, err = client.NewTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Put(george, &Gopher{Name: "George"}); err != nil {
+		t.Fatal(err)
+	}
+	g = Gopher{}
+	if err := tx.Get(george, &g); err != nil || g.Name != "stored" {
+		t.Errorf("without ReadYourWrites: got %+v, error %v; want the stored entity", g, err)
+	}
+}
+
+func TestTransactionClose(t *testing.T) {
+	var rollbacks int
+	client := &Client{
+		client: fakeClient(func(req, resp proto.Message) error {
+			switch resp := resp.(type) {
+			case *pb.BeginTransactionResponse:
+				resp.Transaction = []byte("tx")
+			case *pb.CommitResponse:
+				resp.MutationResult = &pb.MutationResult{}
+			case *pb.RollbackResponse:
+				rollbacks++
+			}
+			return nil
+		}),
+	}
+	ctx := context.Background()
+	tx, err := client.NewTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rollbacks != 1 {
+		t.Errorf("open transaction: got %d rollbacks, want 1", rollbacks)
+	}
+	if err := tx.Close(); err != nil {
+		t.Errorf("second Close: got error %v", err)
+	}
+	if _, err := tx.Put(NewKey(ctx, "Gopher", "g", 0, nil), &Gopher{}); err == nil {
+		t.Error("Put after Close: got nil error")
+	}
+
+	tx, err = client.NewTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Close(); err != nil || rollbacks != 1 {
+		t.Errorf("committed transaction: got error %v and %d rollbacks, want nil and 1", err, rollbacks)
+	}
+}
+
+func TestTransactionPutEmpty(t *testing.T) {
+	var nBegin int
+	tx, err := fakeTxClient(&nBegin).NewTransaction(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := tx.PutMulti(nil, []Gopher{}); keys != nil || err != nil {
+		t.Errorf("PutMulti: got %v, %v; want nil, nil", keys, err)
+	}
+	if keys, err := tx.InsertMulti(nil, []Gopher{}); keys != nil || err != nil {
+		t.Errorf("InsertMulti: got %v, %v; want nil, nil", keys, err)
+	}
+	if _, err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
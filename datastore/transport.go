@@ -0,0 +1,102 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+)
+
+// TransportConfig holds the connection parameters of a transport returned by
+// NewTransport. A zero field is replaced by the default given for it.
+type TransportConfig struct {
+	// MaxIdleConnsPerHost is the number of idle connections to the
+	// datastore kept open for reuse. The default is 64; the net/http
+	// default of 2 makes a Client that is used concurrently close and reopen
+	// connections constantly.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept open. The
+	// default is 90 seconds.
+	IdleConnTimeout time.Duration
+	// KeepAlive is the period of TCP keep-alive probes on open connections.
+	// The default is 30 seconds.
+	KeepAlive time.Duration
+	// DialTimeout bounds the time taken to open a connection. The default
+	// is 30 seconds.
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout bounds the time taken by the TLS handshake of a
+	// new connection. The default is 10 seconds.
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout, if not zero, bounds the time spent waiting for
+	// the response to a request once it has been sent. Since it applies to
+	// every call, including long queries, it is not set by default; a
+	// deadline on each call's context is usually preferable.
+	ResponseHeaderTimeout time.Duration
+}
+
+// NewTransport returns an HTTP transport tuned for sustained traffic to the
+// datastore: it keeps enough idle connections for concurrent calls to reuse,
+// sends TCP keep-alives, and caches TLS sessions so that new connections
+// resume them rather than doing a full handshake. It uses the proxy given by
+// the environment, as http.DefaultTransport does.
+//
+// NewClient authenticates with a transport of its own, so to use the returned
+// transport, wrap it in an authenticated client given to cloud.WithBaseHTTP:
+//
+//	ts, err := google.DefaultTokenSource(ctx, datastore.ScopeDatastore)
+//	...
+//	hc := &http.Client{Transport: &oauth2.Transport{
+//		Source: ts,
+//		Base:   datastore.NewTransport(datastore.TransportConfig{MaxIdleConnsPerHost: 128}),
+//	}}
+//	client, err := datastore.NewClient(ctx, projectID, cloud.WithBaseHTTP(hc))
+//
+// Create the transport once and share it, along with the Client: each
+// transport has its own pool of connections.
+func NewTransport(cfg TransportConfig) *http.Transport {
+	if cfg.MaxIdleConnsPerHost == 0 {
+		cfg.MaxIdleConnsPerHost = 64
+	}
+	if cfg.IdleConnTimeout == 0 {
+		cfg.IdleConnTimeout = 90 * time.Second
+	}
+	if cfg.KeepAlive == 0 {
+		cfg.KeepAlive = 30 * time.Second
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = 30 * time.Second
+	}
+	if cfg.TLSHandshakeTimeout == 0 {
+		cfg.TLSHandshakeTimeout = 10 * time.Second
+	}
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: cfg.KeepAlive,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		TLSClientConfig: &tls.Config{
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		},
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/cloud/internal/datastore"
+)
+
+// User is the value of a legacy App Engine user property. New applications
+// should store user information in ordinary properties instead; User exists so
+// that entities written by App Engine applications can be loaded.
+type User struct {
+	// Email is the user's email address.
+	Email string
+	// AuthDomain is the domain the user authenticated with.
+	AuthDomain string
+	// ID is the user's unique, permanent ID, if known.
+	ID string
+	// FederatedIdentity is the user's OpenID identifier, if any.
+	FederatedIdentity string
+}
+
+// meaningUser is the meaning of an entity value that holds a User.
+const meaningUser = 20
+
+var typeOfUser = reflect.TypeOf(User{})
+
+// The names of the properties of a user entity value.
+const (
+	userEmail             = "email"
+	userAuthDomain        = "auth_domain"
+	userID                = "user_id"
+	userFederatedIdentity = "federated_identity"
+)
+
+func userToProto(u User) *pb.Value {
+	e := &pb.Entity{}
+	add := func(name, value string) {
+		if value != "" {
+			e.Property = append(e.Property, &pb.Property{
+				Name:  proto.String(name),
+				Value: &pb.Value{StringValue: proto.String(value)},
+			})
+		}
+	}
+	add(userEmail, u.Email)
+	add(userAuthDomain, u.AuthDomain)
+	add(userID, u.ID)
+	add(userFederatedIdentity, u.FederatedIdentity)
+	return &pb.Value{EntityValue: e, Meaning: proto.Int32(meaningUser)}
+}
+
+func protoToUser(e *pb.Entity) User {
+	var u User
+	for _, p := range e.Property {
+		v := p.GetValue().GetStringValue()
+		switch p.GetName() {
+		case userEmail:
+			u.Email = v
+		case userAuthDomain:
+			u.AuthDomain = v
+		case userID:
+			u.ID = v
+		case userFederatedIdentity:
+			u.FederatedIdentity = v
+		}
+	}
+	return u
+}
@@ -0,0 +1,73 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/cloud/internal/datastore"
+)
+
+func TestLoadLegacyUser(t *testing.T) {
+	str := func(s string) *pb.Value { return &pb.Value{StringValue: proto.String(s)} }
+	e := &pb.Entity{
+		Key: keyToProto(testKey0),
+		Property: []*pb.Property{
+			{Name: proto.String("Owner"), Value: &pb.Value{
+				Meaning: proto.Int32(meaningUser),
+				EntityValue: &pb.Entity{Property: []*pb.Property{
+					{Name: proto.String("email"), Value: str("gopher@example.com")},
+					{Name: proto.String("auth_domain"), Value: str("example.com")},
+					{Name: proto.String("user_id"), Value: str("42")},
+				}},
+			}},
+			// An entity value that is not a user is flattened.
+			{Name: proto.String("Other"), Value: &pb.Value{EntityValue: &pb.Entity{Property: []*pb.Property{
+				{Name: proto.String("Name"), Value: str("x")},
+			}}}},
+		},
+	}
+	type Doc struct {
+		Owner User
+		Other struct{ Name string }
+	}
+	var got Doc
+	if err := loadEntity(&got, e); err != nil {
+		t.Fatal(err)
+	}
+	want := Doc{Owner: User{Email: "gopher@example.com", AuthDomain: "example.com", ID: "42"}}
+	want.Other.Name = "x"
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// A User round-trips as a single property.
+	e2, err := saveEntity(testKey0, &want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(e2.Property[0].Value.EntityValue, e.Property[0].Value.EntityValue) {
+		t.Errorf("got saved user %v, want %v", e2.Property[0].Value, e.Property[0].Value)
+	}
+	var pl PropertyList
+	if err := loadEntity(&pl, e); err != nil {
+		t.Fatal(err)
+	}
+	if pl[0].Value != want.Owner || pl[1].Name != "Other.Name" {
+		t.Errorf("got properties %v", pl)
+	}
+}
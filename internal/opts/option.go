@@ -21,4 +21,31 @@ type DialOpt struct {
 
 	HTTPClient *http.Client
 	GRPCClient *grpc.ClientConn
+
+	// RateLimit is the maximum number of calls per second, or zero for no
+	// limit. RateBurst is the number of calls that may be made at once.
+	// If RateLimitFailFast is set, calls over the limit fail instead of
+	// blocking.
+	RateLimit         float64
+	RateBurst         int
+	RateLimitFailFast bool
+
+	// JSONEncoding makes HTTP transports send and receive JSON instead of
+	// protocol buffers.
+	JSONEncoding bool
+
+	// DeterministicEncoding makes HTTP transports encode identical requests
+	// as identical bytes.
+	DeterministicEncoding bool
+
+	// Headers are added to each HTTP request.
+	Headers http.Header
+
+	// QuotaProject is the project billed for the requests, if not the
+	// project accessed.
+	QuotaProject string
+
+	// HTTPMethods maps API methods to the HTTP methods used to call them,
+	// overriding the transport's default.
+	HTTPMethods map[string]string
 }
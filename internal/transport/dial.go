@@ -18,6 +18,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2"
@@ -33,6 +34,10 @@ import (
 type ErrHTTP struct {
 	StatusCode int
 	Body       []byte
+	// RetryAfter is the delay before retrying that the server asked for in
+	// a Retry-After header, as on throttled responses, or zero if the
+	// response had none.
+	RetryAfter time.Duration
 	err        error
 }
 
@@ -97,9 +102,14 @@ func NewProtoClient(ctx context.Context, opt ...cloud.ClientOption) (*ProtoClien
 	}
 
 	return &ProtoClient{
-		client:    client,
-		endpoint:  o.Endpoint,
-		userAgent: o.UserAgent,
+		client:        client,
+		endpoint:      o.Endpoint,
+		userAgent:     o.UserAgent,
+		json:          o.JSONEncoding,
+		deterministic: o.DeterministicEncoding,
+		headers:       o.Headers,
+		quotaProject:  o.QuotaProject,
+		httpMethods:   o.HTTPMethods,
 	}, nil
 }
 
@@ -18,31 +18,97 @@ import (
 	"bytes"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
 )
 
+// reqBufPool and respBufPool hold buffers for marshaling requests and reading
+// responses, so that they can be reused across calls.
+var (
+	reqBufPool  = sync.Pool{New: func() interface{} { return proto.NewBuffer(nil) }}
+	respBufPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+)
+
+// pooledBody is an HTTP request body backed by a pooled buffer. The buffer is
+// returned to the pool when the HTTP transport closes the body, which is
+// the point after which it will no longer be read.
+type pooledBody struct {
+	*bytes.Reader
+	buf  *proto.Buffer
+	once sync.Once
+}
+
+func (b *pooledBody) Close() error {
+	b.once.Do(func() {
+		b.buf.Reset()
+		reqBufPool.Put(b.buf)
+	})
+	return nil
+}
+
 type ProtoClient struct {
 	client    *http.Client
 	endpoint  string
 	userAgent string
+
+	// json makes the client encode requests and responses as JSON rather
+	// than as protocol buffers.
+	json bool
+	// deterministic makes the client encode identical protocol buffer
+	// requests as identical bytes.
+	deterministic bool
+	// headers are added to each request.
+	headers http.Header
+	// quotaProject, if set, is sent as the project billed for each request.
+	quotaProject string
+	// httpMethods maps API methods to the HTTP methods overriding POST.
+	httpMethods map[string]string
+}
+
+// HTTPMethod returns the HTTP method of the requests made by Call for the API
+// method named method. It is POST, the method of every datastore API method,
+// unless overridden with cloud.WithHTTPMethod.
+func (c *ProtoClient) HTTPMethod(method string) string {
+	if m, ok := c.httpMethods[method]; ok {
+		return m
+	}
+	return "POST"
+}
+
+// CloseIdleConnections closes the idle connections of the client's HTTP
+// transport.
+func (c *ProtoClient) CloseIdleConnections() {
+	c.client.CloseIdleConnections()
 }
 
 func (c *ProtoClient) Call(ctx context.Context, method string, req, resp proto.Message) error {
-	payload, err := proto.Marshal(req)
+	httpReq, err := http.NewRequest(c.HTTPMethod(method), c.endpoint+method, nil)
 	if err != nil {
 		return err
 	}
-
-	httpReq, err := http.NewRequest("POST", c.endpoint+method, bytes.NewReader(payload))
+	// The headers set below take precedence over the custom headers.
+	for k, vs := range c.headers {
+		httpReq.Header[k] = append([]string(nil), vs...)
+	}
+	if c.json {
+		err = setJSONBody(httpReq, req)
+	} else {
+		err = setProtoBody(httpReq, req, c.deterministic)
+	}
 	if err != nil {
 		return err
 	}
-	httpReq.Header.Set("Content-Type", "application/x-protobuf")
 	if ua := c.userAgent; ua != "" {
 		httpReq.Header.Set("User-Agent", ua)
 	}
+	if p := c.quotaProject; p != "" {
+		httpReq.Header.Set("X-Goog-User-Project", p)
+	}
 
 	errc := make(chan error, 1)
 	cancel := makeReqCancel(httpReq)
@@ -55,11 +121,17 @@ func (c *ProtoClient) Call(ctx context.Context, method string, req, resp proto.M
 		}
 		defer r.Body.Close()
 
-		body, err := ioutil.ReadAll(r.Body)
+		rbuf := respBufPool.Get().(*bytes.Buffer)
+		defer func() {
+			rbuf.Reset()
+			respBufPool.Put(rbuf)
+		}()
+		_, err = rbuf.ReadFrom(r.Body)
 		if r.StatusCode != http.StatusOK {
 			err = &ErrHTTP{
 				StatusCode: r.StatusCode,
-				Body:       body,
+				Body:       append([]byte(nil), rbuf.Bytes()...),
+				RetryAfter: parseRetryAfter(r.Header.Get("Retry-After"), time.Now()),
 				err:        err,
 			}
 		}
@@ -67,7 +139,12 @@ func (c *ProtoClient) Call(ctx context.Context, method string, req, resp proto.M
 			errc <- err
 			return
 		}
-		errc <- proto.Unmarshal(body, resp)
+		if c.json {
+			errc <- jsonpb.Unmarshal(rbuf, resp)
+			return
+		}
+		// proto.Unmarshal copies bytes fields, so resp does not alias rbuf.
+		errc <- proto.Unmarshal(rbuf.Bytes(), resp)
 	}()
 
 	select {
@@ -78,3 +155,60 @@ func (c *ProtoClient) Call(ctx context.Context, method string, req, resp proto.M
 		return err
 	}
 }
+
+// setProtoBody sets the body of httpReq to the protocol buffer encoding of
+// msg, using a pooled buffer, deterministically if deterministic is set. It
+// also asks for a protocol buffer response.
+func setProtoBody(httpReq *http.Request, msg proto.Message, deterministic bool) error {
+	buf := reqBufPool.Get().(*proto.Buffer)
+	buf.SetDeterministic(deterministic)
+	body := &pooledBody{buf: buf}
+	if err := buf.Marshal(msg); err != nil {
+		body.Close()
+		return err
+	}
+	if payload := buf.Bytes(); len(payload) > 0 {
+		body.Reader = bytes.NewReader(payload)
+		httpReq.Body = body
+		httpReq.ContentLength = int64(len(payload))
+	} else {
+		body.Close()
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("Accept", "application/x-protobuf")
+	return nil
+}
+
+// setJSONBody sets the body of httpReq to the JSON encoding of msg. It also
+// asks for a JSON response.
+func setJSONBody(httpReq *http.Request, msg proto.Message) error {
+	var buf bytes.Buffer
+	if err := (&jsonpb.Marshaler{}).Marshal(&buf, msg); err != nil {
+		return err
+	}
+	httpReq.Body = ioutil.NopCloser(&buf)
+	httpReq.ContentLength = int64(buf.Len())
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "application/json")
+	return nil
+}
+
+// parseRetryAfter returns the delay from now given by v, the value of a
+// Retry-After header: either a number of seconds or an HTTP date. It returns
+// zero if v is empty, invalid or in the past.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	t, err := http.ParseTime(v)
+	if err != nil || !t.After(now) {
+		return 0
+	}
+	return t.Sub(now)
+}
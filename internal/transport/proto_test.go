@@ -0,0 +1,313 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/cloud"
+	pb "google.golang.org/cloud/internal/datastore"
+	"google.golang.org/cloud/internal/opts"
+)
+
+// newEchoServer returns a server that responds to each request with the
+// request's body.
+func newEchoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write(b)
+	}))
+}
+
+func TestCallReusesBuffers(t *testing.T) {
+	ts := newEchoServer()
+	defer ts.Close()
+	c := &ProtoClient{client: http.DefaultClient, endpoint: ts.URL + "/"}
+
+	for _, name := range []string{"a", "a much longer name than the first one", "b", ""} {
+		req := &pb.PartitionId{Namespace: proto.String(name)}
+		if name == "" {
+			req = &pb.PartitionId{}
+		}
+		resp := &pb.PartitionId{}
+		if err := c.Call(context.Background(), "echo", req, resp); err != nil {
+			t.Fatalf("%q: Call: %v", name, err)
+		}
+		if !proto.Equal(req, resp) {
+			t.Errorf("got %v, want %v", resp, req)
+		}
+	}
+}
+
+func TestCallHeaders(t *testing.T) {
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		json bool
+		want string
+	}{
+		{false, "application/x-protobuf"},
+		{true, "application/json"},
+	} {
+		c := &ProtoClient{client: http.DefaultClient, endpoint: ts.URL + "/", json: tc.json}
+		req := &pb.PartitionId{Namespace: proto.String("gopherspace")}
+		if err := c.Call(context.Background(), "echo", req, &pb.PartitionId{}); err != nil {
+			t.Fatalf("json=%v: %v", tc.json, err)
+		}
+		if got := header.Get("Content-Type"); got != tc.want {
+			t.Errorf("json=%v: got Content-Type %q, want %q", tc.json, got, tc.want)
+		}
+		if got := header.Get("Accept"); got != tc.want {
+			t.Errorf("json=%v: got Accept %q, want %q", tc.json, got, tc.want)
+		}
+	}
+}
+
+func TestCallCustomHeaders(t *testing.T) {
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer ts.Close()
+	c := &ProtoClient{
+		client:    http.DefaultClient,
+		endpoint:  ts.URL + "/",
+		userAgent: "gopher",
+		headers: http.Header{
+			"X-Request-Id": {"1234"},
+			"Content-Type": {"text/plain"},
+			"User-Agent":   {"impostor"},
+		},
+	}
+	if err := c.Call(context.Background(), "echo", &pb.PartitionId{Namespace: proto.String("ns")}, &pb.PartitionId{}); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{
+		"X-Request-Id": "1234",
+		"Content-Type": "application/x-protobuf",
+		"User-Agent":   "gopher",
+	} {
+		if got := header.Get(k); got != want {
+			t.Errorf("got %s %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestCallQuotaProject(t *testing.T) {
+	var header http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer ts.Close()
+	c := &ProtoClient{client: http.DefaultClient, endpoint: ts.URL + "/"}
+	call := func() {
+		if err := c.Call(context.Background(), "echo", &pb.PartitionId{Namespace: proto.String("ns")}, &pb.PartitionId{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	call()
+	if got, ok := header["X-Goog-User-Project"]; ok {
+		t.Errorf("no quota project: got X-Goog-User-Project %q, want none", got)
+	}
+
+	c.quotaProject = "billing-project"
+	// The quota project takes precedence over a custom header.
+	c.headers = http.Header{"X-Goog-User-Project": {"other"}}
+	call()
+	if got := header["X-Goog-User-Project"]; !reflect.DeepEqual(got, []string{"billing-project"}) {
+		t.Errorf("got X-Goog-User-Project %q, want %q", got, "billing-project")
+	}
+}
+
+func TestCallHTTPMethod(t *testing.T) {
+	var methods []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer ts.Close()
+	var o opts.DialOpt
+	cloud.WithHTTPMethod("lookup", "PUT").Resolve(&o)
+	c := &ProtoClient{
+		client:      http.DefaultClient,
+		endpoint:    ts.URL + "/",
+		httpMethods: o.HTTPMethods,
+	}
+	for _, method := range []string{"lookup", "commit"} {
+		if err := c.Call(context.Background(), method, &pb.PartitionId{Namespace: proto.String("ns")}, &pb.PartitionId{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"PUT", "POST"}; !reflect.DeepEqual(methods, want) {
+		t.Errorf("got HTTP methods %q, want %q", methods, want)
+	}
+}
+
+func TestCallRetryAfter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "120")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+	c := &ProtoClient{client: http.DefaultClient, endpoint: ts.URL + "/"}
+	err := c.Call(context.Background(), "commit", &pb.PartitionId{}, &pb.PartitionId{})
+	e, ok := err.(*ErrHTTP)
+	if !ok {
+		t.Fatalf("got error %v, want an *ErrHTTP", err)
+	}
+	if e.StatusCode != http.StatusTooManyRequests || e.RetryAfter != 2*time.Minute {
+		t.Errorf("got status %d, retry after %v; want 429, %v", e.StatusCode, e.RetryAfter, 2*time.Minute)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		v    string
+		want time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"5", 5 * time.Second},
+		{"-5", 0},
+		{"soon", 0},
+		{"Wed, 21 Oct 2015 07:29:30 GMT", 90 * time.Second},
+		{"Wed, 21 Oct 2015 07:27:00 GMT", 0},
+	} {
+		if got := parseRetryAfter(tc.v, now); got != tc.want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestCallDeterministic(t *testing.T) {
+	var bodies [][]byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, b)
+	}))
+	defer ts.Close()
+	var o opts.DialOpt
+	cloud.WithDeterministicEncoding().Resolve(&o)
+	c := &ProtoClient{client: http.DefaultClient, endpoint: ts.URL + "/", deterministic: o.DeterministicEncoding}
+
+	newReq := func() *pb.CommitRequest {
+		return &pb.CommitRequest{
+			Mode: pb.CommitRequest_NON_TRANSACTIONAL.Enum(),
+			Mutation: &pb.Mutation{Upsert: []*pb.Entity{{
+				Key: &pb.Key{PathElement: []*pb.Key_PathElement{{Kind: proto.String("Gopher"), Name: proto.String("george")}}},
+				Property: []*pb.Property{
+					{Name: proto.String("Name"), Value: &pb.Value{StringValue: proto.String("George")}},
+					{Name: proto.String("Height"), Value: &pb.Value{IntegerValue: proto.Int64(7)}},
+				},
+			}}},
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.Call(context.Background(), "commit", newReq(), &pb.CommitResponse{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf proto.Buffer
+	buf.SetDeterministic(true)
+	if err := buf.Marshal(newReq()); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range bodies {
+		if !bytes.Equal(b, buf.Bytes()) {
+			t.Errorf("request %d: got body %x, want %x", i, b, buf.Bytes())
+		}
+	}
+}
+
+func TestCallJSON(t *testing.T) {
+	var contentType string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+		w.Write(b)
+	}))
+	defer ts.Close()
+	c := &ProtoClient{client: http.DefaultClient, endpoint: ts.URL + "/", json: true}
+
+	req := &pb.Key{
+		PartitionId: &pb.PartitionId{Namespace: proto.String("gopherspace")},
+		PathElement: []*pb.Key_PathElement{
+			{Kind: proto.String("Gopher"), Id: proto.Int64(1)},
+		},
+	}
+	resp := &pb.Key{}
+	if err := c.Call(context.Background(), "echo", req, resp); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(req, resp) {
+		t.Errorf("got %v, want %v", resp, req)
+	}
+	if want := "application/json"; contentType != want {
+		t.Errorf("got Content-Type %q, want %q", contentType, want)
+	}
+}
+
+func BenchmarkCall(b *testing.B) {
+	ts := newEchoServer()
+	defer ts.Close()
+	c := &ProtoClient{client: http.DefaultClient, endpoint: ts.URL + "/"}
+
+	req := &pb.Key{
+		PartitionId: &pb.PartitionId{Namespace: proto.String("gopherspace")},
+		PathElement: []*pb.Key_PathElement{
+			{Kind: proto.String("Gopher"), Name: proto.String("george")},
+		},
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := c.Call(context.Background(), "echo", req, &pb.Key{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -23,6 +23,10 @@ import (
 )
 
 // ClientOption is used when construct clients for each cloud service.
+//
+// WithRateLimit, WithJSONEncoding, WithDeterministicEncoding, WithHeaders,
+// WithQuotaProject and WithHTTPMethod are currently only supported by the
+// datastore package.
 type ClientOption interface {
 	// Resolve configures the given DialOpts for this option.
 	Resolve(*opts.DialOpt)
@@ -98,3 +102,112 @@ type withBaseGRPC struct{ client *grpc.ClientConn }
 func (w withBaseGRPC) Resolve(o *opts.DialOpt) {
 	o.GRPCClient = w.client
 }
+
+// WithRateLimit returns a ClientOption that limits a client to qps calls per
+// second, allowing bursts of up to burst calls. Calls over the limit block
+// until they are allowed or their context is done, unless failFast is true,
+// in which case they fail immediately. The limit is shared by all the
+// goroutines using the client.
+func WithRateLimit(qps float64, burst int, failFast bool) ClientOption {
+	return withRateLimit{qps, burst, failFast}
+}
+
+type withRateLimit struct {
+	qps      float64
+	burst    int
+	failFast bool
+}
+
+func (w withRateLimit) Resolve(o *opts.DialOpt) {
+	o.RateLimit = w.qps
+	o.RateBurst = w.burst
+	o.RateLimitFailFast = w.failFast
+}
+
+// WithJSONEncoding returns a ClientOption that makes a client encode its
+// requests and responses as JSON instead of protocol buffers. JSON is larger
+// and slower to encode, but easier to inspect and understood by proxies that
+// do not support protocol buffers.
+func WithJSONEncoding() ClientOption {
+	return withJSONEncoding{}
+}
+
+type withJSONEncoding struct{}
+
+func (w withJSONEncoding) Resolve(o *opts.DialOpt) {
+	o.JSONEncoding = true
+}
+
+// WithDeterministicEncoding returns a ClientOption that makes a client encode
+// its requests deterministically, so that identical requests are sent as
+// identical bytes, as needed to sign or cache requests or to compare them
+// with golden files. In particular, map entries are encoded in a stable order.
+// Deterministic encoding is slower, so it is off by default. Determinism only
+// holds for a given version of the protocol buffer library. JSON requests,
+// sent with WithJSONEncoding, are always deterministic.
+func WithDeterministicEncoding() ClientOption {
+	return withDeterministicEncoding{}
+}
+
+type withDeterministicEncoding struct{}
+
+func (w withDeterministicEncoding) Resolve(o *opts.DialOpt) {
+	o.DeterministicEncoding = true
+}
+
+// WithHeaders returns a ClientOption that adds the given headers to every HTTP
+// request made by a client, such as to propagate tracing or routing metadata.
+// The headers the client sets itself, such as Content-Type, User-Agent and
+// Authorization, take precedence over them.
+func WithHeaders(h http.Header) ClientOption {
+	return withHeaders(h)
+}
+
+type withHeaders http.Header
+
+func (w withHeaders) Resolve(o *opts.DialOpt) {
+	if o.Headers == nil {
+		o.Headers = make(http.Header)
+	}
+	for k, vs := range w {
+		for _, v := range vs {
+			o.Headers.Add(k, v)
+		}
+	}
+}
+
+// WithQuotaProject returns a ClientOption that makes a client bill its usage
+// and charge its quota to the project with the given ID, by sending it in the
+// X-Goog-User-Project header of every request. The data accessed is still
+// that of the project the client was created for, such as the datastore
+// client's project ID; only the accounting changes. This lets a service
+// account shared by several projects bill each one's usage to it. The
+// client's credentials must have permission to use the quota project.
+func WithQuotaProject(projectID string) ClientOption {
+	return withQuotaProject(projectID)
+}
+
+type withQuotaProject string
+
+func (w withQuotaProject) Resolve(o *opts.DialOpt) {
+	o.QuotaProject = string(w)
+}
+
+// WithHTTPMethod returns a ClientOption that makes a client send the requests
+// calling the API method apiMethod, such as "lookup", with the HTTP method
+// httpMethod instead of POST. The request body is unchanged, so the server,
+// or a proxy in front of it, must accept it with httpMethod.
+func WithHTTPMethod(apiMethod, httpMethod string) ClientOption {
+	return withHTTPMethod{apiMethod, httpMethod}
+}
+
+type withHTTPMethod struct {
+	apiMethod, httpMethod string
+}
+
+func (w withHTTPMethod) Resolve(o *opts.DialOpt) {
+	if o.HTTPMethods == nil {
+		o.HTTPMethods = make(map[string]string)
+	}
+	o.HTTPMethods[w.apiMethod] = w.httpMethod
+}